@@ -0,0 +1,295 @@
+package jsonrps
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// AckMethod acknowledges the notifications delivered with acknowledgement,
+// by their Notification.DeliveryID in the params
+// (e.g. {"deliveryIds": ["1", "2"]}). It may be sent as a notification.
+const AckMethod = "ack"
+
+// Defaults of the delivery with acknowledgement of Broker
+const (
+	// DefaultAckTimeout is the default Broker.AckTimeout
+	DefaultAckTimeout = 30 * time.Second
+
+	// DefaultMaxRedeliveries is the default Broker.MaxRedeliveries
+	DefaultMaxRedeliveries = 5
+)
+
+// ackSubscriber is the NotificationSink of a subscription with
+// acknowledgement, which tracks the notifications delivered to a session
+// until they are acknowledged.
+//
+// Named subscribers outlive their sessions: their unacknowledged
+// notifications are kept while detached, and redelivered once a session
+// subscribes again with the same name. Unnamed subscribers are dropped
+// with their session, and the unacknowledged notifications of a member of
+// a consumer group are delivered to the other members.
+type ackSubscriber struct {
+	broker *Broker
+	name   string
+	topic  string
+
+	// the fields below are protected by broker.ackMu
+	sess    *Session         // the attached session, nil while detached
+	out     NotificationSink // the sink of the attached session
+	sub     *Subscription
+	pending map[string]*delivery
+}
+
+// delivery is a notification delivered to a subscriber and not yet
+// acknowledged
+type delivery struct {
+	notification Notification
+	subscriber   *ackSubscriber
+	redeliveries int
+	timer        *time.Timer // nil while the subscriber is detached
+}
+
+// ackSubscriberKey returns the key of the named subscriber of the topic
+func ackSubscriberKey(name, topic string) string {
+	return name + "\x00" + topic
+}
+
+// attachSubscriber attaches the session, receiving the notifications
+// through out, to the subscriber of the topic with the name, created if
+// needed, and redelivers its unacknowledged notifications. A session
+// previously attached is unsubscribed.
+func (b *Broker) attachSubscriber(sess *Session, out NotificationSink, topic, name string) *ackSubscriber {
+	b.ackMu.Lock()
+	var subscriber *ackSubscriber
+	if name != "" {
+		subscriber = b.subscribers[ackSubscriberKey(name, topic)]
+	}
+	if subscriber == nil {
+		subscriber = &ackSubscriber{broker: b, name: name, topic: topic, pending: make(map[string]*delivery)}
+		if name != "" {
+			if b.subscribers == nil {
+				b.subscribers = make(map[string]*ackSubscriber)
+			}
+			b.subscribers[ackSubscriberKey(name, topic)] = subscriber
+		}
+	}
+	previous := subscriber.sub
+	subscriber.sess, subscriber.out, subscriber.sub = sess, out, nil
+	pending := make([]*delivery, 0, len(subscriber.pending))
+	for _, d := range subscriber.pending {
+		pending = append(pending, d)
+	}
+	b.ackMu.Unlock()
+
+	if previous != nil {
+		previous.Unsubscribe()
+	}
+	slices.SortFunc(pending, func(a, b *delivery) int {
+		return cmp.Compare(a.notification.Seq, b.notification.Seq)
+	})
+	for _, d := range pending {
+		b.redeliver(d)
+	}
+	context.AfterFunc(sess.context(), func() {
+		b.detachSubscriber(subscriber, sess)
+	})
+	return subscriber
+}
+
+// detachSubscriber detaches the session from the subscriber, unless
+// another session is attached since. Unnamed subscribers are dropped.
+func (b *Broker) detachSubscriber(subscriber *ackSubscriber, sess *Session) {
+	if subscriber.name == "" {
+		b.ackMu.Lock()
+		sub := subscriber.sub
+		b.ackMu.Unlock()
+		dropped := b.dropSubscriber(subscriber)
+		if sub != nil && sub.group != nil {
+			// the other members of the group take over
+			for _, notification := range dropped {
+				notification.DeliveryID = ""
+				if err := writeDelivery(sub.group, &notification); err != nil {
+					sess.logger().Debug("Handing over notification failed", "topic", notification.Topic, "seq", notification.Seq, "error", err)
+				}
+			}
+		}
+		return
+	}
+	b.ackMu.Lock()
+	defer b.ackMu.Unlock()
+	if subscriber.sess != sess {
+		return
+	}
+	subscriber.sess, subscriber.out, subscriber.sub = nil, nil, nil
+	for _, d := range subscriber.pending {
+		if d.timer != nil {
+			d.timer.Stop()
+			d.timer = nil
+		}
+	}
+}
+
+// dropSubscriber forgets the subscriber with its unacknowledged
+// notifications, which it returns in order
+func (b *Broker) dropSubscriber(subscriber *ackSubscriber) []Notification {
+	b.ackMu.Lock()
+	defer b.ackMu.Unlock()
+	if subscriber.name != "" && b.subscribers[ackSubscriberKey(subscriber.name, subscriber.topic)] == subscriber {
+		delete(b.subscribers, ackSubscriberKey(subscriber.name, subscriber.topic))
+	}
+	dropped := make([]Notification, 0, len(subscriber.pending))
+	for id, d := range subscriber.pending {
+		if d.timer != nil {
+			d.timer.Stop()
+		}
+		delete(b.deliveries, id)
+		dropped = append(dropped, d.notification)
+	}
+	slices.SortFunc(dropped, func(a, b Notification) int {
+		return cmp.Compare(a.Seq, b.Seq)
+	})
+	subscriber.pending = make(map[string]*delivery)
+	subscriber.sess, subscriber.out = nil, nil
+	return dropped
+}
+
+// WriteResponse delivers the notification to the attached session with a
+// new delivery ID, tracked until acknowledged. While detached, the
+// notification is kept for the next session.
+func (subscriber *ackSubscriber) WriteResponse(response *JSONRPCResponse) error {
+	var notification Notification
+	if err := json.Unmarshal(response.Params, &notification); err != nil {
+		return err
+	}
+
+	b := subscriber.broker
+	b.ackMu.Lock()
+	b.lastDeliveryID++
+	notification.DeliveryID = strconv.FormatUint(b.lastDeliveryID, 10)
+	d := &delivery{notification: notification, subscriber: subscriber}
+	if b.deliveries == nil {
+		b.deliveries = make(map[string]*delivery)
+	}
+	b.deliveries[notification.DeliveryID] = d
+	subscriber.pending[notification.DeliveryID] = d
+	out := subscriber.out
+	if out != nil {
+		d.timer = time.AfterFunc(b.ackTimeout(), func() {
+			b.redeliver(d)
+		})
+	}
+	b.ackMu.Unlock()
+
+	if out == nil {
+		return nil
+	}
+	return writeDelivery(out, &notification)
+}
+
+// redeliver delivers the notification again to the attached session, or
+// gives it up once redelivered MaxRedeliveries times
+func (b *Broker) redeliver(d *delivery) {
+	b.ackMu.Lock()
+	subscriber := d.subscriber
+	if b.deliveries[d.notification.DeliveryID] != d || subscriber.sess == nil {
+		b.ackMu.Unlock()
+		return
+	}
+	if d.timer != nil {
+		d.timer.Stop()
+	}
+	maxRedeliveries := b.MaxRedeliveries
+	if maxRedeliveries <= 0 {
+		maxRedeliveries = DefaultMaxRedeliveries
+	}
+	if d.redeliveries >= maxRedeliveries {
+		delete(b.deliveries, d.notification.DeliveryID)
+		delete(subscriber.pending, d.notification.DeliveryID)
+		sess := subscriber.sess
+		b.ackMu.Unlock()
+		sess.logger().Warn("Giving up unacknowledged notification",
+			"topic", d.notification.Topic, "seq", d.notification.Seq, "subscriber", subscriber.name)
+		if b.DeadLetter != nil {
+			notification := d.notification
+			notification.DeliveryID = ""
+			b.DeadLetter(subscriber.name, notification)
+		}
+		return
+	}
+	d.redeliveries++
+	d.timer = time.AfterFunc(b.ackTimeout(), func() {
+		b.redeliver(d)
+	})
+	sess, out := subscriber.sess, subscriber.out
+	b.ackMu.Unlock()
+
+	if err := writeDelivery(out, &d.notification); err != nil {
+		sess.logger().Debug("Redelivering notification failed", "error", err)
+	}
+}
+
+// ackTimeout returns the AckTimeout of the broker, or DefaultAckTimeout
+func (b *Broker) ackTimeout() time.Duration {
+	if b.AckTimeout <= 0 {
+		return DefaultAckTimeout
+	}
+	return b.AckTimeout
+}
+
+// writeDelivery writes the notification with its delivery ID to the sink
+func writeDelivery(sink NotificationSink, notification *Notification) error {
+	params, err := json.Marshal(notification)
+	if err != nil {
+		return err
+	}
+	return sink.WriteResponse(newNotification(params))
+}
+
+// ack acknowledges the deliveries to the session, or to any session if nil,
+// and returns the number of deliveries acknowledged
+func (b *Broker) ack(sess *Session, ids []string) int {
+	b.ackMu.Lock()
+	defer b.ackMu.Unlock()
+	acked := 0
+	for _, id := range ids {
+		d := b.deliveries[id]
+		if d == nil || (sess != nil && d.subscriber.sess != sess) {
+			continue
+		}
+		if d.timer != nil {
+			d.timer.Stop()
+		}
+		delete(b.deliveries, id)
+		delete(d.subscriber.pending, id)
+		acked++
+	}
+	return acked
+}
+
+// Ack acknowledges the deliveries by their Notification.DeliveryID, and
+// returns the number of deliveries acknowledged
+func (b *Broker) Ack(deliveryIDs ...string) int {
+	return b.ack(nil, deliveryIDs)
+}
+
+// ackResult is the result of AckMethod
+type ackResult struct {
+	Acked int `json:"acked"`
+}
+
+// serveAck acknowledges the deliveries to the session in the request
+func (b *Broker) serveAck(ctx context.Context, sess *Session, req *JSONRPCRequest) *JSONRPCResponse {
+	var params struct {
+		DeliveryIDs []string `json:"deliveryIds"`
+	}
+	if err := json.Unmarshal(req.Params, &params); err != nil || len(params.DeliveryIDs) == 0 {
+		return NewErrorResponse(req.ID, ErrCodeInvalidParams, "invalid params", "deliveryIds is required")
+	}
+	acked := b.ack(sess, params.DeliveryIDs)
+	resp, _ := NewResultResponse(req.ID, ackResult{Acked: acked})
+	return resp
+}
@@ -0,0 +1,175 @@
+package jsonrps_test
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/yookoala/jsonrps"
+)
+
+// startBrokerSession serves the methods of the broker on a session pair,
+// and returns the client session with its incoming messages. The session
+// context of the server is cancelled by end.
+func startBrokerSession(t *testing.T, broker *jsonrps.Broker) (client *jsonrps.Session, messages <-chan *jsonrps.JSONRPCResponse, end func()) {
+	t.Helper()
+	return startBrokerSessionAs(t, broker, nil)
+}
+
+// startBrokerSessionAs starts a broker session like startBrokerSession,
+// authenticated as the principal
+func startBrokerSessionAs(t *testing.T, broker *jsonrps.Broker, principal *jsonrps.Principal) (client *jsonrps.Session, messages <-chan *jsonrps.JSONRPCResponse, end func()) {
+	t.Helper()
+	mux := jsonrps.NewMethodMux()
+	broker.Register(mux)
+
+	client, server := jsonrps.NewSessionPair(&jsonrps.SessionPairConfig{Method: "events", Logger: newTestLogger(t)})
+	ctx, cancel := context.WithCancel(jsonrps.ContextWithPrincipal(context.Background(), principal))
+	server.Context = ctx
+	go (&jsonrps.Dispatcher{Handler: mux}).HandleSession(server)
+	if err := client.ReadResponseHeader(); err != nil {
+		t.Fatalf("Unexpected response header error: %v", err)
+	}
+
+	ch := make(chan *jsonrps.JSONRPCResponse, 16)
+	go func() {
+		defer close(ch)
+		for {
+			resp, err := client.ReadResponse()
+			if err != nil {
+				return
+			}
+			ch <- resp
+		}
+	}()
+	end = func() {
+		cancel()
+		client.Close()
+	}
+	t.Cleanup(end)
+	return client, ch, end
+}
+
+// nextMessage returns the next incoming message, failing after a second
+func nextMessage(t *testing.T, messages <-chan *jsonrps.JSONRPCResponse) *jsonrps.JSONRPCResponse {
+	t.Helper()
+	select {
+	case resp, ok := <-messages:
+		if !ok {
+			t.Fatal("Unexpected end of session")
+		}
+		return resp
+	case <-time.After(time.Second):
+		t.Fatal("Expected a message")
+	}
+	return nil
+}
+
+// nextDelivery returns the next notification, skipping other messages
+func nextDelivery(t *testing.T, messages <-chan *jsonrps.JSONRPCResponse) jsonrps.Notification {
+	t.Helper()
+	for {
+		resp := nextMessage(t, messages)
+		if resp.Method != jsonrps.NotificationMethod {
+			continue
+		}
+		var n jsonrps.Notification
+		if err := json.Unmarshal(resp.Params, &n); err != nil {
+			t.Fatalf("Unexpected params error: %v", err)
+		}
+		return n
+	}
+}
+
+// sendRequest writes a request to the session
+func sendRequest(t *testing.T, sess *jsonrps.Session, method, params string, id any) {
+	t.Helper()
+	err := sess.WriteRequest(&jsonrps.JSONRPCRequest{
+		Version: jsonrps.JSONRPCVersion,
+		Method:  method,
+		Params:  json.RawMessage(params),
+		ID:      id,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected write error: %v", err)
+	}
+}
+
+func TestBroker_Ack(t *testing.T) {
+	var mu sync.Mutex
+	var deadLetters []jsonrps.Notification
+	broker := &jsonrps.Broker{
+		AckTimeout:      30 * time.Millisecond,
+		MaxRedeliveries: 1,
+		DeadLetter: func(subscriber string, notification jsonrps.Notification) {
+			mu.Lock()
+			defer mu.Unlock()
+			deadLetters = append(deadLetters, notification)
+		},
+	}
+	client, messages, _ := startBrokerSession(t, broker)
+	sendRequest(t, client, jsonrps.SubscribeMethod, `{"topic":"jobs","ack":true}`, 1)
+	if resp := nextMessage(t, messages); resp.Error != nil {
+		t.Fatalf("Unexpected subscribe error: %v", resp.Error)
+	}
+
+	broker.Publish("jobs", "a")
+	broker.Publish("jobs", "b")
+	a, b := nextDelivery(t, messages), nextDelivery(t, messages)
+	if a.DeliveryID == "" || b.DeliveryID == "" || a.DeliveryID == b.DeliveryID {
+		t.Fatalf("Expected distinct delivery IDs, got %q and %q", a.DeliveryID, b.DeliveryID)
+	}
+
+	// the acknowledged notification is not redelivered
+	sendRequest(t, client, jsonrps.AckMethod, `{"deliveryIds":["`+a.DeliveryID+`"]}`, nil)
+	redelivered := nextDelivery(t, messages)
+	if redelivered.DeliveryID != b.DeliveryID || string(redelivered.Data) != `"b"` {
+		t.Errorf("Expected redelivery of b, got %+v", redelivered)
+	}
+
+	// given up after MaxRedeliveries
+	if !waitFor(t, time.Second, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(deadLetters) == 1
+	}) {
+		t.Fatal("Expected a dead letter")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if string(deadLetters[0].Data) != `"b"` || deadLetters[0].Seq != 2 {
+		t.Errorf("Unexpected dead letter %+v", deadLetters[0])
+	}
+}
+
+func TestBroker_Ack_Reconnect(t *testing.T) {
+	broker := &jsonrps.Broker{AckTimeout: time.Hour}
+	client, messages, end := startBrokerSession(t, broker)
+	sendRequest(t, client, jsonrps.SubscribeMethod, `{"topic":"jobs","ack":true,"subscriber":"worker"}`, 1)
+	nextMessage(t, messages)
+	broker.Publish("jobs", "a")
+	delivered := nextDelivery(t, messages)
+	end()
+
+	// the unacknowledged notification is redelivered to the next session
+	client, messages, _ = startBrokerSession(t, broker)
+	sendRequest(t, client, jsonrps.SubscribeMethod, `{"topic":"jobs","ack":true,"subscriber":"worker"}`, 1)
+	redelivered := nextDelivery(t, messages)
+	if redelivered.DeliveryID != delivered.DeliveryID || string(redelivered.Data) != `"a"` {
+		t.Errorf("Expected redelivery of %+v, got %+v", delivered, redelivered)
+	}
+
+	sendRequest(t, client, jsonrps.AckMethod, `{"deliveryIds":["`+delivered.DeliveryID+`","unknown"]}`, "ack")
+	resp := nextMessage(t, messages)
+	for resp.ID != "ack" {
+		resp = nextMessage(t, messages)
+	}
+	if resp.Error != nil || string(resp.Result) != `{"acked":1}` {
+		t.Errorf("Expected one delivery acknowledged, got %#v", resp)
+	}
+	if acked := broker.Ack(delivered.DeliveryID); acked != 0 {
+		t.Errorf("Expected the delivery already acknowledged, got %d", acked)
+	}
+}
@@ -0,0 +1,213 @@
+package jsonrps
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"slices"
+)
+
+// Principal is the authenticated identity behind a session
+type Principal struct {
+	// Name identifies the principal (e.g. user name or service account)
+	Name string
+
+	// Roles are the roles granted to the principal
+	Roles []string
+}
+
+// HasRole reports whether the principal has been granted the role
+func (p *Principal) HasRole(role string) bool {
+	return p != nil && slices.Contains(p.Roles, role)
+}
+
+// principalContextKey is the context key for the session principal
+type principalContextKey struct{}
+
+// ContextWithPrincipal returns a copy of ctx carrying the principal.
+// Session authentication should use it to derive Session.Context.
+func ContextWithPrincipal(ctx context.Context, principal *Principal) context.Context {
+	return context.WithValue(ctx, principalContextKey{}, principal)
+}
+
+// PrincipalFromContext returns the principal carried by ctx, or nil
+// if the context has none
+func PrincipalFromContext(ctx context.Context) *Principal {
+	if ctx == nil {
+		return nil
+	}
+	principal, _ := ctx.Value(principalContextKey{}).(*Principal)
+	return principal
+}
+
+// sessionPrincipal returns the principal of the handler context, or else
+// of Session.Context
+func sessionPrincipal(ctx context.Context, sess *Session) *Principal {
+	principal := PrincipalFromContext(ctx)
+	if principal == nil && sess != nil {
+		principal = PrincipalFromContext(sess.Context)
+	}
+	return principal
+}
+
+// AccessRule is a declarative rule of an AccessPolicy.
+//
+// Method, topic and principal patterns use the syntax of [path.Match]. A
+// pattern ending with "**" matches any name starting with the part before
+// "**" (e.g. "audit/**" matches "audit/eu/login"). Empty pattern lists
+// match anything.
+type AccessRule struct {
+	// Methods are the patterns of method names the rule applies to
+	Methods []string `json:"methods,omitempty"`
+
+	// Topics are the patterns of topics the rule applies to. If set,
+	// the rule only applies to requests which access topics. An allow rule
+	// applies if every accessed topic matches one of the patterns, a deny
+	// rule if any of them does.
+	Topics []string `json:"topics,omitempty"`
+
+	// Principals are the patterns of principal names the rule applies to
+	Principals []string `json:"principals,omitempty"`
+
+	// Roles limits the rule to principals having at least one of the roles
+	Roles []string `json:"roles,omitempty"`
+
+	// Deny makes the rule reject, instead of allow, the matching requests
+	Deny bool `json:"deny,omitempty"`
+}
+
+// Validate checks all the patterns of the rule
+func (rule *AccessRule) Validate() error {
+	for _, patterns := range [][]string{rule.Methods, rule.Topics, rule.Principals} {
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("invalid pattern %q: %w", pattern, err)
+			}
+		}
+	}
+	return nil
+}
+
+// matches reports if the rule applies to the principal calling the method
+// and accessing the topics
+func (rule *AccessRule) matches(principal *Principal, method string, topics []string) bool {
+	if len(rule.Methods) > 0 && !matchAny(rule.Methods, method) {
+		return false
+	}
+	if len(rule.Topics) > 0 {
+		matched := 0
+		for _, topic := range topics {
+			if matchAny(rule.Topics, topic) {
+				matched++
+			}
+		}
+		if matched == 0 || !rule.Deny && matched < len(topics) {
+			return false
+		}
+	}
+	if len(rule.Principals) > 0 && (principal == nil || !matchAny(rule.Principals, principal.Name)) {
+		return false
+	}
+	if len(rule.Roles) > 0 && !slices.ContainsFunc(rule.Roles, principal.HasRole) {
+		return false
+	}
+	return true
+}
+
+// matchAny reports if the name matches any of the patterns (see
+// matchPattern)
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if matchPattern(pattern, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// AccessPolicy is a method level authorization layer. It decides, by
+// the first matching rule, if the principal of a session may call a
+// method or access a topic.
+type AccessPolicy struct {
+	// Rules are evaluated in order, the first matching rule decides
+	Rules []AccessRule `json:"rules"`
+
+	// DefaultAllow decides requests which match no rule
+	DefaultAllow bool `json:"defaultAllow,omitempty"`
+
+	// TopicsFunc extracts the topics accessed by a request.
+	// TopicsFromParams is used if nil.
+	TopicsFunc func(req *JSONRPCRequest) []string `json:"-"`
+}
+
+// NewAccessPolicy creates an AccessPolicy of the rules, denying
+// requests which match no rule. It returns error if any rule is invalid.
+func NewAccessPolicy(rules ...AccessRule) (*AccessPolicy, error) {
+	policy := &AccessPolicy{Rules: rules}
+	if err := policy.Validate(); err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+
+// Validate checks all the rules of the policy
+func (p *AccessPolicy) Validate() error {
+	for i := range p.Rules {
+		if err := p.Rules[i].Validate(); err != nil {
+			return fmt.Errorf("rule %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// Allow reports whether the principal may call the method accessing the
+// topics. The principal is nil for unauthenticated sessions.
+func (p *AccessPolicy) Allow(principal *Principal, method string, topics []string) bool {
+	for i := range p.Rules {
+		if p.Rules[i].matches(principal, method, topics) {
+			return !p.Rules[i].Deny
+		}
+	}
+	return p.DefaultAllow
+}
+
+// Wrap returns a MethodHandler which only passes the allowed requests
+// to next. Others are responded with ErrCodeForbidden.
+//
+// The principal is looked up from the handler context, then from
+// Session.Context.
+func (p *AccessPolicy) Wrap(next MethodHandler) MethodHandler {
+	return MethodHandlerFunc(func(ctx context.Context, sess *Session, req *JSONRPCRequest) *JSONRPCResponse {
+		principal := sessionPrincipal(ctx, sess)
+		topicsFunc := p.TopicsFunc
+		if topicsFunc == nil {
+			topicsFunc = TopicsFromParams
+		}
+
+		if !p.Allow(principal, req.Method, topicsFunc(req)) {
+			if req.ID == nil {
+				return nil
+			}
+			return NewErrorResponse(req.ID, ErrCodeForbidden, "forbidden", req.Method)
+		}
+		return next.ServeMethod(ctx, sess, req)
+	})
+}
+
+// TopicsFromParams extracts the topics accessed by a request from the
+// "topic" and "topics" fields of its params object.
+func TopicsFromParams(req *JSONRPCRequest) []string {
+	var params struct {
+		Topic  string   `json:"topic"`
+		Topics []string `json:"topics"`
+	}
+	if len(req.Params) == 0 || json.Unmarshal(req.Params, &params) != nil {
+		return nil
+	}
+	topics := params.Topics
+	if params.Topic != "" {
+		topics = append([]string{params.Topic}, topics...)
+	}
+	return topics
+}
@@ -0,0 +1,161 @@
+package jsonrps_test
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/yookoala/jsonrps"
+)
+
+func TestPrincipalFromContext(t *testing.T) {
+	if p := jsonrps.PrincipalFromContext(context.Background()); p != nil {
+		t.Errorf("Expected no principal, got %#v", p)
+	}
+
+	principal := &jsonrps.Principal{Name: "alice", Roles: []string{"admin"}}
+	ctx := jsonrps.ContextWithPrincipal(context.Background(), principal)
+	if p := jsonrps.PrincipalFromContext(ctx); p != principal {
+		t.Errorf("Expected principal %#v, got %#v", principal, p)
+	}
+	if !principal.HasRole("admin") || principal.HasRole("reader") {
+		t.Error("Unexpected HasRole result")
+	}
+}
+
+func TestAccessPolicy_Allow(t *testing.T) {
+	policy, err := jsonrps.NewAccessPolicy(
+		jsonrps.AccessRule{Methods: []string{"admin.*"}, Roles: []string{"admin"}},
+		jsonrps.AccessRule{Methods: []string{"admin.*"}, Deny: true},
+		jsonrps.AccessRule{Methods: []string{"subscribe"}, Topics: []string{"secret/**"}, Deny: true},
+		jsonrps.AccessRule{Methods: []string{"subscribe"}, Roles: []string{"admin"}},
+		jsonrps.AccessRule{Methods: []string{"subscribe"}, Topics: []string{"audit/**"}, Principals: []string{"auditor-*"}},
+		jsonrps.AccessRule{Methods: []string{"subscribe"}, Topics: []string{"public/*"}},
+		jsonrps.AccessRule{Methods: []string{"*.get", "*.list"}},
+	)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	admin := &jsonrps.Principal{Name: "root", Roles: []string{"admin"}}
+	auditor := &jsonrps.Principal{Name: "auditor-1"}
+	user := &jsonrps.Principal{Name: "bob", Roles: []string{"user"}}
+
+	tests := []struct {
+		name      string
+		principal *jsonrps.Principal
+		method    string
+		topics    []string
+		expected  bool
+	}{
+		{"admin calls admin method", admin, "admin.reset", nil, true},
+		{"user calls admin method", user, "admin.reset", nil, false},
+		{"anonymous calls admin method", nil, "admin.reset", nil, false},
+		{"anonymous calls read method", nil, "users.get", nil, true},
+		{"auditor subscribes audit", auditor, "subscribe", []string{"audit/login"}, true},
+		{"auditor subscribes nested audit", auditor, "subscribe", []string{"audit/eu/login"}, true},
+		{"user subscribes audit", user, "subscribe", []string{"audit/login"}, false},
+		{"user subscribes public", user, "subscribe", []string{"public/news"}, true},
+		{"user subscribes mixed", user, "subscribe", []string{"public/news", "audit/login"}, false},
+		{"admin subscribes public", admin, "subscribe", []string{"public/news"}, true},
+		{"admin subscribes secret", admin, "subscribe", []string{"secret/keys"}, false},
+		{"admin subscribes secret with public", admin, "subscribe", []string{"public/news", "secret/keys"}, false},
+		{"subscribe without topic", user, "subscribe", nil, false},
+		{"unmatched method", admin, "users.delete", nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if actual := policy.Allow(tt.principal, tt.method, tt.topics); actual != tt.expected {
+				t.Errorf("Expected Allow() = %v, got %v", tt.expected, actual)
+			}
+		})
+	}
+
+	policy.DefaultAllow = true
+	if !policy.Allow(admin, "users.delete", nil) {
+		t.Error("Expected unmatched request to be allowed by default")
+	}
+}
+
+func TestAccessPolicy_Invalid(t *testing.T) {
+	if _, err := jsonrps.NewAccessPolicy(jsonrps.AccessRule{Methods: []string{"[invalid"}}); err == nil {
+		t.Error("Expected error for invalid pattern")
+	}
+}
+
+func TestAccessPolicy_JSONConfig(t *testing.T) {
+	var policy jsonrps.AccessPolicy
+	config := `{"rules":[{"methods":["admin.*"],"roles":["admin"]},{"methods":["admin.*"],"deny":true}],"defaultAllow":true}`
+	if err := json.Unmarshal([]byte(config), &policy); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := policy.Validate(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if policy.Allow(nil, "admin.reset", nil) {
+		t.Error("Expected admin method to be denied")
+	}
+	if !policy.Allow(nil, "users.get", nil) {
+		t.Error("Expected other methods to be allowed")
+	}
+}
+
+func TestAccessPolicy_Wrap(t *testing.T) {
+	policy, err := jsonrps.NewAccessPolicy(
+		jsonrps.AccessRule{Methods: []string{"admin.*"}, Roles: []string{"admin"}},
+		jsonrps.AccessRule{Methods: []string{"echo"}},
+	)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	handler := policy.Wrap(echoHandler)
+
+	admin := &jsonrps.Principal{Name: "root", Roles: []string{"admin"}}
+	adminSession := &jsonrps.Session{
+		Context: jsonrps.ContextWithPrincipal(context.Background(), admin),
+	}
+	anonymousSession := &jsonrps.Session{Context: context.Background()}
+
+	req := &jsonrps.JSONRPCRequest{Version: "2.0", Method: "admin.reset", ID: 1}
+
+	resp := handler.ServeMethod(adminSession.Context, adminSession, req)
+	if resp == nil || resp.Error != nil {
+		t.Errorf("Expected admin request to pass, got %#v", resp)
+	}
+
+	resp = handler.ServeMethod(anonymousSession.Context, anonymousSession, req)
+	if resp == nil || resp.Error == nil || resp.Error.Code != jsonrps.ErrCodeForbidden {
+		t.Errorf("Expected forbidden error, got %#v", resp)
+	}
+
+	notification := &jsonrps.JSONRPCRequest{Version: "2.0", Method: "admin.reset"}
+	if resp = handler.ServeMethod(anonymousSession.Context, anonymousSession, notification); resp != nil {
+		t.Errorf("Expected no response to forbidden notification, got %#v", resp)
+	}
+
+	resp = handler.ServeMethod(anonymousSession.Context, anonymousSession, &jsonrps.JSONRPCRequest{Version: "2.0", Method: "echo", ID: 2})
+	if resp == nil || resp.Error != nil {
+		t.Errorf("Expected echo request to pass, got %#v", resp)
+	}
+}
+
+func TestTopicsFromParams(t *testing.T) {
+	tests := []struct {
+		params   string
+		expected []string
+	}{
+		{``, nil},
+		{`[1,2]`, nil},
+		{`{"topic":"a"}`, []string{"a"}},
+		{`{"topics":["a","b"]}`, []string{"a", "b"}},
+		{`{"topic":"a","topics":["b"]}`, []string{"a", "b"}},
+	}
+	for _, tt := range tests {
+		req := &jsonrps.JSONRPCRequest{Method: "subscribe", Params: json.RawMessage(tt.params)}
+		if actual := jsonrps.TopicsFromParams(req); !reflect.DeepEqual(actual, tt.expected) {
+			t.Errorf("TopicsFromParams(%q) expected %v, got %v", tt.params, tt.expected, actual)
+		}
+	}
+}
@@ -0,0 +1,695 @@
+package jsonrps
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultBrokerQueueSize is the default number of notifications queued
+// for a slow session before it is unsubscribed
+const DefaultBrokerQueueSize = 64
+
+// errQueueOverflow is returned to the broker when the queue of a session
+// is full
+var errQueueOverflow = errors.New("jsonrps: session notification queue overflow")
+
+// Methods of the subscription protocol served by Broker
+const (
+	// SubscribeMethod subscribes the session to the topics in the params
+	// (e.g. {"topic": "news"} or {"topics": ["news", "weather"]}). With
+	// "since" in the params (e.g. {"topic": "news", "since": 41}), the
+	// notifications retained after the sequence number are replayed first.
+	// With "ack": true, the notifications are delivered at least once (see
+	// AckMethod), to the subscriber named by "subscriber" if set, or else
+	// by the principal of the session. With "group" in the params (e.g.
+	// {"topic": "jobs", "group": "workers"}), the session joins the
+	// consumer group, sharing the notifications with the other members
+	// (see Broker.SubscribeGroup). Members acknowledge the notifications as
+	// subscribers of their own, whose unacknowledged notifications are
+	// delivered to the other members once their session ends. With "filter" in the params (e.g.
+	// {"topic": "news", "filter": {"lang": "en"}}), only the notifications
+	// whose data matches the Filter are delivered.
+	SubscribeMethod = "subscribe"
+
+	// UnsubscribeMethod unsubscribes the session from the topics in the
+	// params, in the same format as SubscribeMethod. The notifications
+	// not acknowledged yet are dropped.
+	UnsubscribeMethod = "unsubscribe"
+
+	// NotificationMethod is the Method of the notifications sent to
+	// subscribers, with a Notification as Params
+	NotificationMethod = "$/notify"
+)
+
+// Notification is the params of a notification sent to subscribers
+type Notification struct {
+	// Topic is the topic the notification was published to
+	Topic string `json:"topic"`
+
+	// Seq is the sequence number of the notification in the topic,
+	// increasing from 1
+	Seq uint64 `json:"seq,omitempty"`
+
+	// Data is the published data
+	Data json.RawMessage `json:"data,omitempty"`
+
+	// DeliveryID identifies the delivery of the notification to a
+	// subscriber with acknowledgement, to be passed to AckMethod. It is
+	// kept by redeliveries.
+	DeliveryID string `json:"deliveryId,omitempty"`
+}
+
+// NotificationSink receives the notifications of subscriptions.
+// Session is a NotificationSink.
+type NotificationSink interface {
+	WriteResponse(response *JSONRPCResponse) error
+}
+
+// Subscription is the subscription of a sink to a topic of a Broker
+type Subscription struct {
+	// Topic is the subscribed topic
+	Topic string
+
+	// Group is the consumer group of the subscriber, if any
+	Group string
+
+	// Seq is the sequence number of the last notification of the topic
+	// published before the live delivery to the subscriber started, or
+	// zero if none is known
+	Seq uint64
+
+	broker *Broker
+	sink   NotificationSink
+	sess   *Session // the subscribed session, if subscribed by Register
+	group  *consumerGroup
+}
+
+// Unsubscribe stops the delivery of notifications to the subscriber.
+// It is safe to call more than once.
+func (sub *Subscription) Unsubscribe() {
+	sub.broker.remove(sub)
+}
+
+// Broker is a publish-subscribe broker delivering notifications published
+// to topics to the subscribed sinks, such as sessions.
+//
+// Notifications are numbered by topic. Subscribers may resume from a
+// sequence number with the notifications retained by Store, so that
+// nothing published while they were away is lost. Subscribers sharing the
+// work of a topic join a consumer group, each notification being delivered
+// to one member of the group.
+//
+// Sessions subscribed by Register receive the notifications through a
+// queue of QueueSize, so that a session not reading does not hold up the
+// publishers; it is unsubscribed once its queue is full. Other sinks are
+// written to while publishing, and must not block.
+//
+// The zero value is ready to use.
+type Broker struct {
+	// Store retains the published notifications for replay. Nothing is
+	// retained if nil.
+	Store NotificationStore
+
+	// QueueSize is the number of notifications queued for a session
+	// subscribed by Register, before the session is unsubscribed from all
+	// its topics for being too slow. DefaultBrokerQueueSize is used if
+	// zero.
+	QueueSize int
+
+	// AckTimeout is the time after which the notifications delivered with
+	// acknowledgement and not acknowledged are redelivered.
+	// DefaultAckTimeout is used if zero.
+	AckTimeout time.Duration
+
+	// MaxRedeliveries is the number of redeliveries of a notification not
+	// acknowledged, after which it is given up and passed to DeadLetter.
+	// DefaultMaxRedeliveries is used if zero.
+	MaxRedeliveries int
+
+	// DeadLetter, if set, is called with the notifications given up, and
+	// the name of their subscriber
+	DeadLetter func(subscriber string, notification Notification)
+
+	// publishMu serializes the publishing and the replays, so that each
+	// subscriber receives the notifications of a topic in order, once
+	publishMu sync.Mutex
+	seqs      map[string]uint64
+
+	mu       sync.RWMutex
+	topics   map[string]map[*Subscription]struct{}
+	sessions map[*Session]map[string]*Subscription
+	queues   map[*Session]*sessionQueue
+	groups   map[string]*consumerGroup
+
+	ackMu          sync.Mutex // protects the fields below
+	subscribers    map[string]*ackSubscriber
+	deliveries     map[string]*delivery
+	lastDeliveryID uint64
+}
+
+// NewBroker creates a new Broker
+func NewBroker() *Broker {
+	return &Broker{}
+}
+
+// Subscribe subscribes the sink to the topic
+func (b *Broker) Subscribe(topic string, sink NotificationSink) *Subscription {
+	b.publishMu.Lock()
+	defer b.publishMu.Unlock()
+	seq, _ := b.lastSeq(topic)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.add(topic, seq, sink)
+}
+
+// SubscribeSince subscribes the sink to the topic, after replaying to the
+// sink the notifications retained by Store with a sequence number greater
+// than since. Notifications published meanwhile are delivered after the
+// replay. It returns the error of Store or of the sink, if any, in which
+// case the sink is not subscribed.
+func (b *Broker) SubscribeSince(topic string, since uint64, sink NotificationSink) (*Subscription, error) {
+	b.publishMu.Lock()
+	defer b.publishMu.Unlock()
+	if err := b.replay(topic, since, sink); err != nil {
+		return nil, err
+	}
+	seq, err := b.lastSeq(topic)
+	if err != nil {
+		return nil, err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.add(topic, seq, sink), nil
+}
+
+// replay writes the notifications of the topic retained after the sequence
+// number to the sink. The caller must hold b.publishMu.
+func (b *Broker) replay(topic string, since uint64, sink NotificationSink) error {
+	if b.Store == nil {
+		return nil
+	}
+	notifications, err := b.Store.Since(topic, since)
+	if err != nil {
+		return err
+	}
+	for i := range notifications {
+		params, err := json.Marshal(&notifications[i])
+		if err != nil {
+			return err
+		}
+		if err := sink.WriteResponse(newNotification(params)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lastSeq returns the sequence number of the last notification published
+// to the topic, looked up from Store if not published since the broker
+// started. The caller must hold b.publishMu.
+func (b *Broker) lastSeq(topic string) (uint64, error) {
+	if seq, ok := b.seqs[topic]; ok || b.Store == nil {
+		return seq, nil
+	}
+	seq, err := b.Store.LastSeq(topic)
+	if err != nil {
+		return 0, err
+	}
+	if b.seqs == nil {
+		b.seqs = make(map[string]uint64)
+	}
+	b.seqs[topic] = seq
+	return seq, nil
+}
+
+// add adds a subscription of the sink to the topic. The caller must
+// hold b.mu.
+func (b *Broker) add(topic string, seq uint64, sink NotificationSink) *Subscription {
+	sub := &Subscription{Topic: topic, Seq: seq, broker: b, sink: sink}
+	if b.topics == nil {
+		b.topics = make(map[string]map[*Subscription]struct{})
+	}
+	if b.topics[topic] == nil {
+		b.topics[topic] = make(map[*Subscription]struct{})
+	}
+	b.topics[topic][sub] = struct{}{}
+	return sub
+}
+
+// remove removes the subscription from the broker
+func (b *Broker) remove(sub *Subscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if sub.group != nil {
+		b.removeMember(sub)
+	} else {
+		b.removeTopic(sub)
+	}
+	if sub.sess != nil && b.sessions[sub.sess][sub.Topic] == sub {
+		delete(b.sessions[sub.sess], sub.Topic)
+	}
+}
+
+// removeTopic removes the subscription from its topic. The caller must
+// hold b.mu.
+func (b *Broker) removeTopic(sub *Subscription) {
+	delete(b.topics[sub.Topic], sub)
+	if len(b.topics[sub.Topic]) == 0 {
+		delete(b.topics, sub.Topic)
+	}
+}
+
+// Topics returns the sorted topics having subscribers
+func (b *Broker) Topics() []string {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	topics := make([]string, 0, len(b.topics))
+	for topic := range b.topics {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	return topics
+}
+
+// Publish sends the JSON encoded data as a notification to all subscribers
+// of the topic, numbered after the last notification of the topic, and
+// appends it to Store. Subscribers failing to receive the notification are
+// unsubscribed. Sinks must not publish while receiving a notification.
+func (b *Broker) Publish(topic string, data any) error {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	b.publishMu.Lock()
+	defer b.publishMu.Unlock()
+	seq, err := b.lastSeq(topic)
+	if err != nil {
+		return err
+	}
+	notification := Notification{Topic: topic, Seq: seq + 1, Data: raw}
+	params, err := json.Marshal(&notification)
+	if err != nil {
+		return err
+	}
+	if b.Store != nil {
+		if err := b.Store.Append(notification); err != nil {
+			return err
+		}
+	}
+	if b.seqs == nil {
+		b.seqs = make(map[string]uint64)
+	}
+	b.seqs[topic] = notification.Seq
+
+	b.mu.RLock()
+	subs := make([]*Subscription, 0, len(b.topics[topic]))
+	for sub := range b.topics[topic] {
+		subs = append(subs, sub)
+	}
+	b.mu.RUnlock()
+
+	for _, sub := range subs {
+		if err := sub.sink.WriteResponse(newNotification(params)); err != nil {
+			sub.Unsubscribe()
+		}
+	}
+	return nil
+}
+
+// newNotification creates the NotificationMethod notification of the
+// encoded Notification
+func newNotification(params json.RawMessage) *JSONRPCResponse {
+	return &JSONRPCResponse{
+		Version: JSONRPCVersion,
+		Method:  NotificationMethod,
+		Params:  params,
+	}
+}
+
+// Register registers the handlers of SubscribeMethod, UnsubscribeMethod and
+// AckMethod to the mux. Subscriptions of a session are removed once its
+// context is done.
+func (b *Broker) Register(mux *MethodMux) {
+	mux.HandleFunc(SubscribeMethod, b.serveSubscribe)
+	mux.HandleFunc(UnsubscribeMethod, b.serveUnsubscribe)
+	mux.HandleFunc(AckMethod, b.serveAck)
+}
+
+// subscribeParams is the params of SubscribeMethod, besides the topics
+type subscribeParams struct {
+	Since      *uint64         `json:"since"`
+	Ack        bool            `json:"ack"`
+	Subscriber string          `json:"subscriber"`
+	Group      string          `json:"group"`
+	Filter     json.RawMessage `json:"filter"`
+
+	filter *Filter
+}
+
+// subscriptionResult is the result of SubscribeMethod and UnsubscribeMethod
+type subscriptionResult struct {
+	Topics []string `json:"topics"`
+
+	// Seqs maps the subscribed topics to the sequence number of their
+	// last notification, from which to resume after reconnecting
+	Seqs map[string]uint64 `json:"seqs,omitempty"`
+}
+
+// serveSubscribe subscribes the session to the topics of the request
+func (b *Broker) serveSubscribe(ctx context.Context, sess *Session, req *JSONRPCRequest) *JSONRPCResponse {
+	topics := TopicsFromParams(req)
+	if len(topics) == 0 {
+		return NewErrorResponse(req.ID, ErrCodeInvalidParams, "invalid params", "topic is required")
+	}
+	var params subscribeParams
+	if err := json.Unmarshal(req.Params, &params); err != nil {
+		return NewErrorResponse(req.ID, ErrCodeInvalidParams, "invalid params", err.Error())
+	}
+	if params.Group != "" && params.Since != nil {
+		// the members of a group have no notification of their own to resume
+		return NewErrorResponse(req.ID, ErrCodeInvalidParams, "invalid params", "since is not supported with group")
+	}
+	if params.Group != "" && params.Subscriber != "" {
+		// members sharing a name would replace each other
+		return NewErrorResponse(req.ID, ErrCodeInvalidParams, "invalid params", "subscriber is not supported with group")
+	}
+	if len(params.Filter) > 0 && string(params.Filter) != "null" {
+		if params.Group != "" {
+			// a member would drop the notifications of the group it does not want
+			return NewErrorResponse(req.ID, ErrCodeInvalidParams, "invalid params", "filter is not supported with group")
+		}
+		filter, err := ParseFilter(params.Filter)
+		if err != nil {
+			return NewErrorResponse(req.ID, ErrCodeInvalidParams, "invalid params", err.Error())
+		}
+		params.filter = filter
+	}
+	if principal := sessionPrincipal(ctx, sess); params.Ack && params.Subscriber == "" && params.Group == "" && principal != nil {
+		params.Subscriber = principal.Name
+	}
+
+	b.publishMu.Lock()
+	result := subscriptionResult{Topics: topics, Seqs: make(map[string]uint64)}
+	for _, topic := range topics {
+		seq, err := b.subscribeSession(sess, topic, &params)
+		if err != nil {
+			b.publishMu.Unlock()
+			return NewErrorResponse(req.ID, ErrCodeInternalError, err.Error(), topic)
+		}
+		result.Seqs[topic] = seq
+	}
+	flushed := b.flushSession(sess)
+	b.publishMu.Unlock()
+
+	// the replayed notifications are written before the result, without
+	// holding up the publishers
+	select {
+	case <-flushed:
+	case <-ctx.Done():
+	}
+	resp, _ := NewResultResponse(req.ID, result)
+	return resp
+}
+
+// serveUnsubscribe unsubscribes the session from the topics of the request
+func (b *Broker) serveUnsubscribe(ctx context.Context, sess *Session, req *JSONRPCRequest) *JSONRPCResponse {
+	topics := TopicsFromParams(req)
+	if len(topics) == 0 {
+		return NewErrorResponse(req.ID, ErrCodeInvalidParams, "invalid params", "topic is required")
+	}
+
+	for _, topic := range topics {
+		b.mu.RLock()
+		sub := b.sessions[sess][topic]
+		b.mu.RUnlock()
+		if sub != nil {
+			sub.Unsubscribe()
+			sink := sub.sink
+			if filtered, ok := sink.(*filterSink); ok {
+				sink = filtered.sink
+			}
+			if subscriber, ok := sink.(*ackSubscriber); ok {
+				b.dropSubscriber(subscriber)
+			}
+		}
+	}
+	resp, _ := NewResultResponse(req.ID, subscriptionResult{Topics: topics})
+	return resp
+}
+
+// subscribeSession subscribes the session to the topic, unless already
+// subscribed. Unacknowledged notifications of the subscriber are
+// redelivered first with Ack set, then the notifications retained after
+// Since are replayed, if set. Notifications not matching the filter are
+// dropped before acknowledgement. It returns the sequence number of the
+// last notification of the topic. The caller must hold b.publishMu.
+func (b *Broker) subscribeSession(sess *Session, topic string, params *subscribeParams) (uint64, error) {
+	queue, subscribed := b.sessionQueue(sess, topic)
+	var sink NotificationSink = queue
+	var subscriber *ackSubscriber
+	if !subscribed {
+		queue.setReplaying(true)
+		defer queue.setReplaying(false)
+	}
+	if !subscribed && params.Ack {
+		subscriber = b.attachSubscriber(sess, queue, topic, params.Subscriber)
+		sink = subscriber
+	}
+	if !subscribed && params.filter != nil {
+		sink = params.filter.Sink(sink)
+	}
+	if !subscribed && params.Since != nil {
+		if err := b.replay(topic, *params.Since, sink); err != nil {
+			return 0, err
+		}
+	}
+	seq, err := b.lastSeq(topic)
+	if err != nil {
+		return 0, err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	// the session may have ended meanwhile
+	if subs := b.sessions[sess]; subs != nil && subs[topic] == nil {
+		var sub *Subscription
+		if params.Group != "" {
+			sub = b.addMember(topic, params.Group, seq, sink)
+		} else {
+			sub = b.add(topic, seq, sink)
+		}
+		sub.sess = sess
+		subs[topic] = sub
+		if subscriber != nil {
+			b.ackMu.Lock()
+			subscriber.sub = sub
+			b.ackMu.Unlock()
+		}
+	}
+	return seq, nil
+}
+
+// sessionQueue returns the notification queue of the session, and whether
+// the session is subscribed to the topic. The subscriptions of a new
+// session are removed once its context is done.
+func (b *Broker) sessionQueue(sess *Session, topic string) (*sessionQueue, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if queue := b.queues[sess]; queue != nil {
+		return queue, b.sessions[sess][topic] != nil
+	}
+
+	if b.sessions == nil {
+		b.sessions = make(map[*Session]map[string]*Subscription)
+		b.queues = make(map[*Session]*sessionQueue)
+	}
+	size := b.QueueSize
+	if size <= 0 {
+		size = DefaultBrokerQueueSize
+	}
+	queue := newSessionQueue(sess, size)
+	b.sessions[sess] = make(map[string]*Subscription)
+	b.queues[sess] = queue
+	go func() {
+		err := queue.run()
+		if errors.Is(err, errQueueOverflow) {
+			sess.logger().Warn("Unsubscribing slow session", "queued", size)
+		} else if err != nil {
+			sess.logger().Debug("Writing notification failed", "error", err)
+		}
+		b.removeSession(sess)
+	}()
+	context.AfterFunc(sess.context(), func() {
+		b.removeSession(sess)
+	})
+	return queue, false
+}
+
+// flushSession returns a channel closed once the notifications queued
+// for the session so far are written
+func (b *Broker) flushSession(sess *Session) <-chan struct{} {
+	b.mu.RLock()
+	queue := b.queues[sess]
+	b.mu.RUnlock()
+	if queue == nil {
+		flushed := make(chan struct{})
+		close(flushed)
+		return flushed
+	}
+	return queue.flush()
+}
+
+// removeSession removes all subscriptions of the session
+func (b *Broker) removeSession(sess *Session) {
+	b.mu.Lock()
+	subs := b.sessions[sess]
+	queue := b.queues[sess]
+	delete(b.sessions, sess)
+	delete(b.queues, sess)
+	b.mu.Unlock()
+	if queue != nil {
+		queue.close(nil)
+	}
+	for _, sub := range subs {
+		sub.Unsubscribe()
+	}
+}
+
+// sessionQueue is the NotificationSink of the subscriptions of a session,
+// which queues the notifications for a goroutine writing them to the
+// session, so that a session not reading does not stall the publishers.
+// The notifications written while replaying are queued without limit, so
+// that a replay is not mistaken for a slow session.
+type sessionQueue struct {
+	sess *Session
+	size int
+	wake chan struct{}
+
+	mu        sync.Mutex // protects the fields below
+	queue     []queuedNotification
+	limited   int // the number of queued notifications counted in size
+	replaying bool
+	closed    bool
+	err       error
+}
+
+// queuedNotification is a notification of a sessionQueue, or a mark
+// closing flushed once reached
+type queuedNotification struct {
+	response *JSONRPCResponse
+	limited  bool
+	flushed  chan struct{}
+}
+
+// newSessionQueue creates a queue of the size for the session
+func newSessionQueue(sess *Session, size int) *sessionQueue {
+	return &sessionQueue{sess: sess, size: size, wake: make(chan struct{}, 1)}
+}
+
+// setReplaying sets whether the notifications are queued without limit
+func (q *sessionQueue) setReplaying(replaying bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.replaying = replaying
+}
+
+// WriteResponse queues the notification. The queue is closed with
+// errQueueOverflow if full.
+func (q *sessionQueue) WriteResponse(response *JSONRPCResponse) error {
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return ErrSessionClosed
+	}
+	limited := !q.replaying
+	if limited && q.limited >= q.size {
+		q.mu.Unlock()
+		q.close(errQueueOverflow)
+		return errQueueOverflow
+	}
+	q.queue = append(q.queue, queuedNotification{response: response, limited: limited})
+	if limited {
+		q.limited++
+	}
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	q.mu.Unlock()
+	return nil
+}
+
+// flush returns a channel closed once the notifications queued so far
+// are written, or the queue is closed
+func (q *sessionQueue) flush() <-chan struct{} {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	flushed := make(chan struct{})
+	if q.closed {
+		close(flushed)
+		return flushed
+	}
+	q.queue = append(q.queue, queuedNotification{flushed: flushed})
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return flushed
+}
+
+// close closes the queue with the error, dropping the queued
+// notifications. It is safe to call more than once.
+func (q *sessionQueue) close(err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return
+	}
+	q.closed, q.err = true, err
+	for _, next := range q.queue {
+		if next.flushed != nil {
+			close(next.flushed)
+		}
+	}
+	q.queue = nil
+	close(q.wake)
+}
+
+// run writes the queued notifications to the session until the queue is
+// closed or a write fails, and returns the error closing the queue
+func (q *sessionQueue) run() error {
+	for {
+		q.mu.Lock()
+		for len(q.queue) == 0 && !q.closed {
+			q.mu.Unlock()
+			<-q.wake
+			q.mu.Lock()
+		}
+		if q.closed {
+			err := q.err
+			q.mu.Unlock()
+			return err
+		}
+		next := q.queue[0]
+		q.queue[0] = queuedNotification{}
+		q.queue = q.queue[1:]
+		if next.limited {
+			q.limited--
+		}
+		q.mu.Unlock()
+
+		if next.flushed != nil {
+			close(next.flushed)
+			continue
+		}
+		if err := q.sess.WriteResponse(next.response); err != nil {
+			q.close(err)
+			return err
+		}
+	}
+}
@@ -0,0 +1,300 @@
+package jsonrps_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/yookoala/jsonrps"
+)
+
+// sinkFunc adapts a function to jsonrps.NotificationSink
+type sinkFunc func(response *jsonrps.JSONRPCResponse) error
+
+func (f sinkFunc) WriteResponse(response *jsonrps.JSONRPCResponse) error {
+	return f(response)
+}
+
+// waitFor polls the condition until it holds or the timeout expires
+func waitFor(t *testing.T, timeout time.Duration, cond func() bool) bool {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return true
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return cond()
+}
+
+func TestBroker_PublishSubscribe(t *testing.T) {
+	broker := jsonrps.NewBroker()
+
+	var received []jsonrps.Notification
+	sub := broker.Subscribe("news", sinkFunc(func(resp *jsonrps.JSONRPCResponse) error {
+		if resp.Method != jsonrps.NotificationMethod || resp.ID != nil {
+			t.Errorf("Unexpected notification %#v", resp)
+		}
+		var n jsonrps.Notification
+		if err := json.Unmarshal(resp.Params, &n); err != nil {
+			t.Fatalf("Unexpected params error: %v", err)
+		}
+		received = append(received, n)
+		return nil
+	}))
+
+	if err := broker.Publish("news", map[string]string{"title": "hello"}); err != nil {
+		t.Fatalf("Unexpected publish error: %v", err)
+	}
+	if err := broker.Publish("weather", "sunny"); err != nil {
+		t.Fatalf("Unexpected publish error: %v", err)
+	}
+	if len(received) != 1 || received[0].Topic != "news" || string(received[0].Data) != `{"title":"hello"}` {
+		t.Errorf("Unexpected notifications %+v", received)
+	}
+	if got := broker.Topics(); !reflect.DeepEqual(got, []string{"news"}) {
+		t.Errorf("Expected topics [news], got %v", got)
+	}
+
+	sub.Unsubscribe()
+	sub.Unsubscribe()
+	broker.Publish("news", "ignored")
+	if len(received) != 1 {
+		t.Errorf("Expected no notification after unsubscribe, got %+v", received)
+	}
+	if got := broker.Topics(); len(got) != 0 {
+		t.Errorf("Expected no topics, got %v", got)
+	}
+}
+
+func TestBroker_FailingSink(t *testing.T) {
+	broker := jsonrps.NewBroker()
+	calls := 0
+	broker.Subscribe("news", sinkFunc(func(resp *jsonrps.JSONRPCResponse) error {
+		calls++
+		return errors.New("broken")
+	}))
+
+	broker.Publish("news", 1)
+	broker.Publish("news", 2)
+	if calls != 1 {
+		t.Errorf("Expected failing sink to be unsubscribed after 1 call, got %d", calls)
+	}
+}
+
+func TestBroker_Register(t *testing.T) {
+	broker := jsonrps.NewBroker()
+	mux := jsonrps.NewMethodMux()
+	broker.Register(mux)
+
+	addr := startTestServer(t, &jsonrps.Server{
+		Handler: &jsonrps.Dispatcher{Handler: mux},
+		Logger:  newTestLogger(t),
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	sess, err := (&jsonrps.Dialer{Logger: newTestLogger(t)}).DialContext(ctx, "tcp", addr, "events")
+	if err != nil {
+		t.Fatalf("Unexpected dial error: %v", err)
+	}
+
+	sess.WriteRequest(&jsonrps.JSONRPCRequest{
+		Version: jsonrps.JSONRPCVersion,
+		Method:  jsonrps.SubscribeMethod,
+		Params:  json.RawMessage(`{"topics":["news","weather"]}`),
+		ID:      1,
+	})
+	resp, err := sess.ReadResponse()
+	if err != nil {
+		t.Fatalf("Unexpected read error: %v", err)
+	}
+	if resp.Error != nil || string(resp.Result) != `{"topics":["news","weather"],"seqs":{"news":0,"weather":0}}` {
+		t.Errorf("Unexpected subscribe response %#v", resp)
+	}
+
+	broker.Publish("weather", "sunny")
+	resp, err = sess.ReadResponse()
+	if err != nil {
+		t.Fatalf("Unexpected read error: %v", err)
+	}
+	if resp.Method != jsonrps.NotificationMethod || string(resp.Params) != `{"topic":"weather","seq":1,"data":"sunny"}` {
+		t.Errorf("Unexpected notification %#v", resp)
+	}
+
+	sess.WriteRequest(&jsonrps.JSONRPCRequest{
+		Version: jsonrps.JSONRPCVersion,
+		Method:  jsonrps.UnsubscribeMethod,
+		Params:  json.RawMessage(`{"topic":"weather"}`),
+		ID:      2,
+	})
+	if resp, err = sess.ReadResponse(); err != nil || resp.Error != nil {
+		t.Fatalf("Unexpected unsubscribe response %#v, error %v", resp, err)
+	}
+	if got := broker.Topics(); !reflect.DeepEqual(got, []string{"news"}) {
+		t.Errorf("Expected topics [news], got %v", got)
+	}
+
+	sess.WriteRequest(&jsonrps.JSONRPCRequest{
+		Version: jsonrps.JSONRPCVersion,
+		Method:  jsonrps.SubscribeMethod,
+		ID:      3,
+	})
+	if resp, err = sess.ReadResponse(); err != nil || resp.Error == nil || resp.Error.Code != jsonrps.ErrCodeInvalidParams {
+		t.Errorf("Expected invalid params error, got %#v, error %v", resp, err)
+	}
+
+	// subscriptions are removed once the session ends
+	sess.Close()
+	if !waitFor(t, time.Second, func() bool { return len(broker.Topics()) == 0 }) {
+		t.Errorf("Expected no topics after session end, got %v", broker.Topics())
+	}
+}
+
+// collectSeqs returns a sink recording the sequence numbers it receives
+func collectSeqs(seqs *[]uint64) jsonrps.NotificationSink {
+	return sinkFunc(func(resp *jsonrps.JSONRPCResponse) error {
+		var n jsonrps.Notification
+		json.Unmarshal(resp.Params, &n)
+		*seqs = append(*seqs, n.Seq)
+		return nil
+	})
+}
+
+func TestBroker_SubscribeSince(t *testing.T) {
+	store := jsonrps.NewMemoryStore(3)
+	broker := &jsonrps.Broker{Store: store}
+	for i := range 5 {
+		broker.Publish("news", i)
+	}
+	broker.Publish("weather", "sunny")
+
+	// replays the retained notifications, then delivers live
+	var seqs []uint64
+	sub, err := broker.SubscribeSince("news", 1, collectSeqs(&seqs))
+	if err != nil {
+		t.Fatalf("Unexpected subscribe error: %v", err)
+	}
+	if sub.Seq != 5 {
+		t.Errorf("Expected subscription after seq 5, got %d", sub.Seq)
+	}
+	broker.Publish("news", 5)
+	if !reflect.DeepEqual(seqs, []uint64{3, 4, 5, 6}) {
+		t.Errorf("Expected seqs [3 4 5 6], got %v", seqs)
+	}
+
+	// numbering resumes from the store
+	broker = &jsonrps.Broker{Store: store}
+	seqs = nil
+	broker.Subscribe("news", collectSeqs(&seqs))
+	broker.Publish("news", 6)
+	if !reflect.DeepEqual(seqs, []uint64{7}) {
+		t.Errorf("Expected seqs [7], got %v", seqs)
+	}
+
+	// the sink failing the replay is not subscribed
+	if _, err := broker.SubscribeSince("news", 0, sinkFunc(func(resp *jsonrps.JSONRPCResponse) error {
+		return errors.New("broken")
+	})); err == nil {
+		t.Error("Expected replay error")
+	}
+}
+
+func TestBroker_Register_Since(t *testing.T) {
+	broker := &jsonrps.Broker{Store: jsonrps.NewMemoryStore(0)}
+	broker.Publish("news", "a")
+	broker.Publish("news", "b")
+	broker.Publish("news", "c")
+	mux := jsonrps.NewMethodMux()
+	broker.Register(mux)
+
+	conn := &mockReadWriteCloser{
+		readData: `{"jsonrpc":"2.0","method":"subscribe","params":{"topic":"news","since":1},"id":1}` + "\n",
+	}
+	session := &jsonrps.Session{Conn: conn, Logger: newTestLogger(t)}
+	(&jsonrps.Dispatcher{Handler: mux}).HandleSession(session)
+
+	responses := decodeResponses(t, conn.writeData.String())
+	if len(responses) != 3 {
+		t.Fatalf("Expected 2 replayed notifications and the result, got %d", len(responses))
+	}
+	for i, expected := range []string{`{"topic":"news","seq":2,"data":"b"}`, `{"topic":"news","seq":3,"data":"c"}`} {
+		if string(responses[i].Params) != expected {
+			t.Errorf("Expected notification %s, got %s", expected, responses[i].Params)
+		}
+	}
+	if string(responses[2].Result) != `{"topics":["news"],"seqs":{"news":3}}` {
+		t.Errorf("Unexpected subscribe result %s", responses[2].Result)
+	}
+}
+
+// stalledConn is a connection of a peer which stopped reading: writes
+// block until closed
+type stalledConn struct {
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (c *stalledConn) Read(p []byte) (int, error) {
+	<-c.closed
+	return 0, io.EOF
+}
+
+func (c *stalledConn) Write(p []byte) (int, error) {
+	<-c.closed
+	return 0, io.ErrClosedPipe
+}
+
+func (c *stalledConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return nil
+}
+
+func TestBroker_Register_SlowSession(t *testing.T) {
+	broker := &jsonrps.Broker{QueueSize: 4}
+	mux := jsonrps.NewMethodMux()
+	broker.Register(mux)
+
+	conn := &stalledConn{closed: make(chan struct{})}
+	defer conn.Close()
+	sess := &jsonrps.Session{Conn: conn, Logger: newTestLogger(t)}
+	resp := mux.ServeMethod(context.Background(), sess, &jsonrps.JSONRPCRequest{
+		Version: jsonrps.JSONRPCVersion,
+		Method:  jsonrps.SubscribeMethod,
+		Params:  json.RawMessage(`{"topic":"news"}`),
+		ID:      1,
+	})
+	if resp == nil || resp.Error != nil {
+		t.Fatalf("Unexpected subscribe response %#v", resp)
+	}
+	var received []uint64
+	sub := broker.Subscribe("news", collectSeqs(&received))
+
+	// the publishers are not held up by the session
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := range 10 {
+			broker.Publish("news", i)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Expected publishing not to wait for a session not reading")
+	}
+	if len(received) != 10 {
+		t.Errorf("Expected 10 notifications to the other subscriber, got %d", len(received))
+	}
+
+	// the session is unsubscribed once its queue is full
+	sub.Unsubscribe()
+	if !waitFor(t, time.Second, func() bool { return len(broker.Topics()) == 0 }) {
+		t.Errorf("Expected the slow session unsubscribed, got topics %v", broker.Topics())
+	}
+}
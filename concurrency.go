@@ -0,0 +1,180 @@
+package jsonrps
+
+import (
+	"context"
+	"encoding/json"
+	"slices"
+	"sync"
+)
+
+// semaphore limits the number of holders of its slots
+type semaphore chan struct{}
+
+// acquire waits for a slot, or returns the cause of the context once done
+func (sem semaphore) acquire(ctx context.Context) error {
+	select {
+	case sem <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return context.Cause(ctx)
+	}
+}
+
+// release frees a slot
+func (sem semaphore) release() {
+	<-sem
+}
+
+// concurrencyLimits are the limits of a Dispatcher shared by its sessions
+type concurrencyLimits struct {
+	global  semaphore
+	methods map[string]semaphore
+}
+
+// concurrencyLimits returns the limits of the dispatcher, created from its
+// settings on first use
+func (d *Dispatcher) concurrencyLimits() *concurrencyLimits {
+	d.limitsOnce.Do(func() {
+		d.limits = &concurrencyLimits{methods: make(map[string]semaphore)}
+		if d.GlobalMaxConcurrent > 0 {
+			d.limits.global = make(semaphore, d.GlobalMaxConcurrent)
+		}
+		for method, limit := range d.MethodMaxConcurrent {
+			if limit > 0 {
+				d.limits.methods[method] = make(semaphore, limit)
+			}
+		}
+	})
+	return d.limits
+}
+
+// acquire waits for the limit of the method, then for the global limit, and
+// returns the function releasing both. The global slot is not held while
+// waiting for the method.
+func (l *concurrencyLimits) acquire(ctx context.Context, method string) (release func(), err error) {
+	if sem, ok := l.methods[method]; ok {
+		if err := sem.acquire(ctx); err != nil {
+			return nil, err
+		}
+		defer func() {
+			if err != nil {
+				sem.release()
+			}
+		}()
+	}
+	if l.global != nil {
+		if err := l.global.acquire(ctx); err != nil {
+			return nil, err
+		}
+	}
+	return func() {
+		if l.global != nil {
+			l.global.release()
+		}
+		if sem, ok := l.methods[method]; ok {
+			sem.release()
+		}
+	}, nil
+}
+
+// isSequential reports if the requests of the method are served in order
+func (d *Dispatcher) isSequential(method string) bool {
+	return slices.Contains(d.Sequential, method)
+}
+
+// sessionDispatch is the state of a session served by a Dispatcher
+type sessionDispatch struct {
+	sess *Session
+	wg   sync.WaitGroup
+
+	// slots limits the requests served at the same time on the session, to
+	// one if the requests are served one after another
+	slots semaphore
+
+	// last maps the ordered chains of requests to a channel closed once
+	// the last request dispatched is served. Notifications are chained
+	// together, and the requests of each sequential method. It is only
+	// used by the read loop.
+	last map[string]chan struct{}
+
+	mu       sync.Mutex // protects inflight
+	inflight map[string]context.CancelCauseFunc
+}
+
+// newSessionDispatch creates the state of the session
+func (d *Dispatcher) newSessionDispatch(sess *Session) *sessionDispatch {
+	s := &sessionDispatch{
+		sess:     sess,
+		last:     make(map[string]chan struct{}),
+		inflight: make(map[string]context.CancelCauseFunc),
+		slots:    make(semaphore, max(d.MaxConcurrent, 1)),
+	}
+	return s
+}
+
+// start runs serve for the request in its own goroutine once a slot of the
+// session is free, after the previous request of its chain, if any. The
+// context passed to serve is cancelled by a CancelRequestMethod
+// notification with the ID of the request. It returns the cause of the
+// context if done before a slot is free, in which case serve is not run.
+func (s *sessionDispatch) start(ctx context.Context, req *JSONRPCRequest, sequential bool, serve func(ctx context.Context)) error {
+	if err := s.slots.acquire(ctx); err != nil {
+		return err
+	}
+
+	var previous, done chan struct{}
+	if sequential || req.ID == nil {
+		chain := ""
+		if sequential {
+			chain = "method:" + req.Method
+		}
+		previous, done = s.last[chain], make(chan struct{})
+		s.last[chain] = done
+	}
+
+	reqCtx, cancel := context.WithCancelCause(ctx)
+	key := ""
+	if req.ID != nil {
+		id, _ := json.Marshal(req.ID)
+		key = idKey(id)
+		s.mu.Lock()
+		s.inflight[key] = cancel
+		s.mu.Unlock()
+	}
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer s.slots.release()
+		defer cancel(nil)
+		if done != nil {
+			defer close(done)
+		}
+		if previous != nil {
+			<-previous
+		}
+
+		serve(reqCtx)
+		if req.ID != nil {
+			s.mu.Lock()
+			delete(s.inflight, key)
+			s.mu.Unlock()
+		}
+	}()
+	return nil
+}
+
+// cancelRequest cancels the context of the request in progress matching
+// the params of a CancelRequestMethod notification, if any
+func (s *sessionDispatch) cancelRequest(params json.RawMessage) {
+	var p cancelParams
+	if err := json.Unmarshal(params, &p); err != nil || len(p.ID) == 0 {
+		return
+	}
+	s.mu.Lock()
+	cancel := s.inflight[idKey(p.ID)]
+	s.mu.Unlock()
+	if cancel != nil {
+		cancel(errRequestCancelled)
+	}
+}
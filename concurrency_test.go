@@ -0,0 +1,201 @@
+package jsonrps_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/yookoala/jsonrps"
+)
+
+// concurrencyProbe records the maximum number of handlers running at once
+type concurrencyProbe struct {
+	current, max atomic.Int32
+}
+
+// handler returns a handler running for the duration
+func (probe *concurrencyProbe) handler(d time.Duration) jsonrps.MethodHandler {
+	return jsonrps.MethodHandlerFunc(func(ctx context.Context, sess *jsonrps.Session, req *jsonrps.JSONRPCRequest) *jsonrps.JSONRPCResponse {
+		n := probe.current.Add(1)
+		defer probe.current.Add(-1)
+		for {
+			max := probe.max.Load()
+			if n <= max || probe.max.CompareAndSwap(max, n) {
+				break
+			}
+		}
+		time.Sleep(d)
+		resp, _ := jsonrps.NewResultResponse(req.ID, "done")
+		return resp
+	})
+}
+
+// callConcurrently makes n calls of the method at the same time
+func callConcurrently(t *testing.T, peer *jsonrps.Peer, method string, n int) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var wg sync.WaitGroup
+	for range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := peer.Call(ctx, method, nil, nil); err != nil {
+				t.Errorf("Unexpected call error: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestDispatcher_MaxConcurrent(t *testing.T) {
+	var probe concurrencyProbe
+	mux := jsonrps.NewMethodMux()
+	mux.Handle("slow", probe.handler(20*time.Millisecond))
+	peer := startTestPeers(t, &jsonrps.Dispatcher{Handler: mux, MaxConcurrent: 4}, nil)
+
+	callConcurrently(t, peer, "slow", 12)
+	if max := probe.max.Load(); max < 2 || max > 4 {
+		t.Errorf("Expected 2 to 4 concurrent requests, got %d", max)
+	}
+}
+
+func TestDispatcher_MethodMaxConcurrent(t *testing.T) {
+	var probe concurrencyProbe
+	release := make(chan struct{})
+	mux := jsonrps.NewMethodMux()
+	mux.Handle("slow", probe.handler(20*time.Millisecond))
+	mux.HandleFunc("block", func(ctx context.Context, sess *jsonrps.Session, req *jsonrps.JSONRPCRequest) *jsonrps.JSONRPCResponse {
+		<-release
+		return nil
+	})
+	mux.Handle("echo", echoHandler)
+	dispatcher := &jsonrps.Dispatcher{
+		Handler:             mux,
+		MaxConcurrent:       8,
+		MethodMaxConcurrent: map[string]int{"slow": 2, "block": 1},
+	}
+	peer := startTestPeers(t, dispatcher, nil)
+
+	callConcurrently(t, peer, "slow", 8)
+	if max := probe.max.Load(); max != 2 {
+		t.Errorf("Expected 2 concurrent requests, got %d", max)
+	}
+
+	// other methods are served while a limited method waits
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	go peer.Notify("block", nil)
+	go peer.Notify("block", nil)
+	var result string
+	if err := peer.Call(ctx, "echo", "not blocked", &result); err != nil || result != "not blocked" {
+		t.Errorf("Unexpected call result %q, error %v", result, err)
+	}
+	close(release)
+}
+
+func TestDispatcher_GlobalMaxConcurrent(t *testing.T) {
+	var probe concurrencyProbe
+	mux := jsonrps.NewMethodMux()
+	mux.Handle("slow", probe.handler(10*time.Millisecond))
+	dispatcher := &jsonrps.Dispatcher{Handler: mux, MaxConcurrent: 4, GlobalMaxConcurrent: 2}
+
+	// the limit is shared by the sessions
+	var wg sync.WaitGroup
+	for range 3 {
+		peer := startTestPeers(t, dispatcher, nil)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			callConcurrently(t, peer, "slow", 4)
+		}()
+	}
+	wg.Wait()
+	if max := probe.max.Load(); max != 2 {
+		t.Errorf("Expected 2 concurrent requests, got %d", max)
+	}
+}
+
+func TestDispatcher_Sequential(t *testing.T) {
+	var mu sync.Mutex
+	var order []string
+	mux := jsonrps.NewMethodMux()
+	mux.HandleFunc("append", func(ctx context.Context, sess *jsonrps.Session, req *jsonrps.JSONRPCRequest) *jsonrps.JSONRPCResponse {
+		var n int
+		if err := json.Unmarshal(req.Params, &n); err != nil {
+			return jsonrps.NewErrorResponse(req.ID, jsonrps.ErrCodeInvalidParams, err.Error(), nil)
+		}
+		// earlier requests take longer
+		time.Sleep(time.Duration(10-n) * 2 * time.Millisecond)
+		mu.Lock()
+		order = append(order, strconv.Itoa(n))
+		mu.Unlock()
+		resp, _ := jsonrps.NewResultResponse(req.ID, n)
+		return resp
+	})
+
+	client, server := jsonrps.NewSessionPair(&jsonrps.SessionPairConfig{Method: "append", Logger: newTestLogger(t)})
+	defer client.Close()
+	dispatcher := &jsonrps.Dispatcher{Handler: mux, MaxConcurrent: 8, Sequential: []string{"append"}}
+	go dispatcher.HandleSession(server)
+	if err := client.ReadResponseHeader(); err != nil {
+		t.Fatalf("Unexpected response header error: %v", err)
+	}
+
+	for i := range 10 {
+		req := &jsonrps.JSONRPCRequest{Version: jsonrps.JSONRPCVersion, Method: "append", Params: []byte(strconv.Itoa(i)), ID: i}
+		if err := client.WriteRequest(req); err != nil {
+			t.Fatalf("Unexpected write error: %v", err)
+		}
+	}
+	for i := range 10 {
+		resp, err := client.ReadResponse()
+		if err != nil {
+			t.Fatalf("Unexpected read error: %v", err)
+		}
+		if string(resp.Result) != strconv.Itoa(i) {
+			t.Errorf("Expected response %d, got %s", i, resp.Result)
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	for i, n := range order {
+		if n != strconv.Itoa(i) {
+			t.Fatalf("Expected requests served in order, got %v", order)
+		}
+	}
+}
+
+func TestDispatcher_CancelRequest(t *testing.T) {
+	for name, maxConcurrent := range map[string]int{"serial": 0, "concurrent": 2} {
+		t.Run(name, func(t *testing.T) {
+			cancelled := make(chan error, 1)
+			mux := jsonrps.NewMethodMux()
+			mux.HandleFunc("wait", func(ctx context.Context, sess *jsonrps.Session, req *jsonrps.JSONRPCRequest) *jsonrps.JSONRPCResponse {
+				<-ctx.Done()
+				cancelled <- ctx.Err()
+				return nil
+			})
+			peer := startTestPeers(t, &jsonrps.Dispatcher{Handler: mux, MaxConcurrent: maxConcurrent}, nil)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			time.AfterFunc(20*time.Millisecond, cancel)
+			if err := peer.Call(ctx, "wait", nil, nil); !errors.Is(err, context.Canceled) {
+				t.Errorf("Expected cancelled call, got %v", err)
+			}
+			select {
+			case err := <-cancelled:
+				if !errors.Is(err, context.Canceled) {
+					t.Errorf("Expected handler context cancelled, got %v", err)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("Expected the handler context to be cancelled")
+			}
+		})
+	}
+}
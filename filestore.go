@@ -0,0 +1,457 @@
+package jsonrps
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultFileStoreSegmentSize is the default size in bytes of the segment
+// files of a FileStore
+const DefaultFileStoreSegmentSize = 16 << 20
+
+// Constants of the segment files of a FileStore
+const (
+	// segmentExt is the extension of the segment files, named by the
+	// sequence number of their first notification
+	segmentExt = ".log"
+
+	// recordHeaderSize is the size of the header of a record: the length
+	// then the CRC-32 of the payload, both big-endian uint32
+	recordHeaderSize = 8
+
+	// maxRecordSize is the maximum size of the payload of a record, above
+	// which the length of a record is considered corrupt
+	maxRecordSize = 64 << 20
+
+	// maxSweepInterval is the maximum interval between the deletions of
+	// the segments older than MaxAge
+	maxSweepInterval = time.Minute
+)
+
+// ErrStoreClosed is returned by the methods of a closed FileStore
+var ErrStoreClosed = errors.New("jsonrps: store closed")
+
+// errCorruptRecord is returned when reading an incomplete or damaged
+// record of a segment file
+var errCorruptRecord = errors.New("jsonrps: corrupt log record")
+
+// FileStoreConfig contains options of a FileStore
+type FileStoreConfig struct {
+	// SegmentSize is the size in bytes above which the notifications of
+	// a topic are appended to a new segment file.
+	// DefaultFileStoreSegmentSize is used if zero.
+	SegmentSize int64
+
+	// MaxSize is the size in bytes of the segments of a topic above which
+	// the oldest segments are deleted. Zero means no limit.
+	MaxSize int64
+
+	// MaxAge is the age of the last notification of a segment after which
+	// the segment is deleted, even if nothing is appended to its topic
+	// anymore. Zero means no limit.
+	MaxAge time.Duration
+
+	// Sync makes every append durable with fsync before returning
+	Sync bool
+
+	// Logger is used to report recovered segments. The default logger is
+	// used if nil.
+	Logger *slog.Logger
+}
+
+// FileStore is a NotificationStore retaining the notifications in local
+// files, so that persistent topics survive server restarts.
+//
+// Each topic is a directory of segment files, which are sequences of
+// records holding a JSON encoded Notification with its length and
+// checksum. Notifications are appended to the last segment, and the oldest
+// segments are deleted by MaxSize and MaxAge. The last segment is never
+// deleted. On open, a last segment left incomplete by a crash is truncated
+// after its last valid record.
+type FileStore struct {
+	dir    string
+	config FileStoreConfig
+	logger *slog.Logger
+
+	mu      sync.Mutex
+	topics  map[string]*topicLog
+	sweeper *time.Timer // deletes the segments older than MaxAge
+	closed  bool
+}
+
+// topicLog is the segments of a topic of a FileStore
+type topicLog struct {
+	dir      string
+	segments []*logSegment
+	file     *os.File // the last segment, opened for appending
+	lastSeq  uint64
+}
+
+// logSegment is a segment file of a topicLog
+type logSegment struct {
+	path     string
+	firstSeq uint64
+	size     int64
+	modTime  time.Time
+}
+
+// OpenFileStore opens the FileStore in the directory, which is created if
+// needed, recovering the segments of all its topics. The config may be nil.
+func OpenFileStore(dir string, config *FileStoreConfig) (*FileStore, error) {
+	s := &FileStore{dir: dir, topics: make(map[string]*topicLog)}
+	if config != nil {
+		s.config = *config
+	}
+	if s.config.SegmentSize <= 0 {
+		s.config.SegmentSize = DefaultFileStoreSegmentSize
+	}
+	s.logger = s.config.Logger
+	if s.logger == nil {
+		s.logger = slog.Default()
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		topic, err := url.PathUnescape(entry.Name())
+		if err != nil {
+			continue
+		}
+		log, err := s.openTopic(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			s.Close()
+			return nil, fmt.Errorf("topic %q: %w", topic, err)
+		}
+		s.topics[topic] = log
+	}
+	if s.config.MaxAge > 0 {
+		s.mu.Lock()
+		s.sweeper = time.AfterFunc(s.sweepInterval(), s.sweep)
+		s.mu.Unlock()
+	}
+	return s, nil
+}
+
+// topicDir returns the name of the directory of the topic
+func topicDir(topic string) string {
+	return strings.ReplaceAll(url.PathEscape(topic), ".", "%2E")
+}
+
+// openTopic opens the segments of the topic in the directory, truncating
+// the last segment after its last valid record
+func (s *FileStore) openTopic(dir string) (*topicLog, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	log := &topicLog{dir: dir}
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), segmentExt)
+		if !ok || entry.IsDir() {
+			continue
+		}
+		firstSeq, err := strconv.ParseUint(name, 10, 64)
+		if err != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		log.segments = append(log.segments, &logSegment{
+			path:     filepath.Join(dir, entry.Name()),
+			firstSeq: firstSeq,
+			size:     info.Size(),
+			modTime:  info.ModTime(),
+		})
+	}
+	if len(log.segments) == 0 {
+		return log, nil
+	}
+	sort.Slice(log.segments, func(i, j int) bool {
+		return log.segments[i].firstSeq < log.segments[j].firstSeq
+	})
+
+	last := log.segments[len(log.segments)-1]
+	log.lastSeq = last.firstSeq - 1
+	end, err := readSegment(last.path, last.size, func(n *Notification) {
+		log.lastSeq = n.Seq
+	})
+	if errors.Is(err, errCorruptRecord) {
+		s.logger.Warn("Truncating corrupt segment", "path", last.path, "size", last.size, "valid", end)
+		if err := os.Truncate(last.path, end); err != nil {
+			return nil, err
+		}
+		last.size = end
+	} else if err != nil {
+		return nil, err
+	}
+	if log.file, err = os.OpenFile(last.path, os.O_WRONLY|os.O_APPEND, 0); err != nil {
+		return nil, err
+	}
+	s.retain(log)
+	return log, nil
+}
+
+// readSegment passes the records of the first size bytes of the segment
+// file to fn. It returns the offset after the last valid record, with
+// errCorruptRecord if a record is incomplete or damaged.
+func readSegment(path string, size int64, fn func(n *Notification)) (int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	r := bufio.NewReader(io.LimitReader(file, size))
+	var end int64
+	header := make([]byte, recordHeaderSize)
+	for {
+		if _, err := io.ReadFull(r, header); err == io.EOF {
+			return end, nil
+		} else if err == io.ErrUnexpectedEOF {
+			return end, errCorruptRecord
+		} else if err != nil {
+			return end, err
+		}
+		length := binary.BigEndian.Uint32(header)
+		if length > maxRecordSize {
+			return end, errCorruptRecord
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(r, payload); err == io.EOF || err == io.ErrUnexpectedEOF {
+			return end, errCorruptRecord
+		} else if err != nil {
+			return end, err
+		}
+		var n Notification
+		if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:]) || json.Unmarshal(payload, &n) != nil {
+			return end, errCorruptRecord
+		}
+		end += recordHeaderSize + int64(length)
+		fn(&n)
+	}
+}
+
+// topic returns the log of the topic, created if create is set, or nil.
+// The caller must hold s.mu.
+func (s *FileStore) topic(topic string, create bool) (*topicLog, error) {
+	if s.closed {
+		return nil, ErrStoreClosed
+	}
+	if log := s.topics[topic]; log != nil || !create {
+		return log, nil
+	}
+	if topic == "" {
+		return nil, errors.New("jsonrps: empty topic")
+	}
+	dir := filepath.Join(s.dir, topicDir(topic))
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	log := &topicLog{dir: dir}
+	s.topics[topic] = log
+	return log, nil
+}
+
+// Append appends the notification to the last segment of its topic,
+// starting a new segment if the last one is full, then deletes the
+// segments out of retention
+func (s *FileStore) Append(notification Notification) error {
+	payload, err := json.Marshal(&notification)
+	if err != nil {
+		return err
+	}
+	record := make([]byte, recordHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(record, uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:], crc32.ChecksumIEEE(payload))
+	copy(record[recordHeaderSize:], payload)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	log, err := s.topic(notification.Topic, true)
+	if err != nil {
+		return err
+	}
+	if log.file == nil || log.segments[len(log.segments)-1].size+int64(len(record)) > s.config.SegmentSize {
+		if err := log.roll(notification.Seq); err != nil {
+			return err
+		}
+	}
+
+	last := log.segments[len(log.segments)-1]
+	if n, err := log.file.Write(record); err != nil {
+		// a partial record would hide the next ones
+		if n > 0 {
+			log.file.Truncate(last.size)
+		}
+		return err
+	}
+	last.size += int64(len(record))
+	if s.config.Sync {
+		if err := log.file.Sync(); err != nil {
+			return err
+		}
+	}
+	last.modTime = time.Now()
+	log.lastSeq = notification.Seq
+	s.retain(log)
+	return nil
+}
+
+// roll starts a new segment with the notification of the sequence number,
+// unless the last segment is empty
+func (log *topicLog) roll(firstSeq uint64) error {
+	if log.file != nil && log.segments[len(log.segments)-1].size == 0 {
+		return nil
+	}
+	path := filepath.Join(log.dir, fmt.Sprintf("%020d%s", firstSeq, segmentExt))
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	if log.file != nil {
+		log.file.Close()
+	}
+	log.file = file
+	log.segments = append(log.segments, &logSegment{path: path, firstSeq: firstSeq, modTime: time.Now()})
+	return nil
+}
+
+// retain deletes the oldest segments of the topic beyond MaxSize or
+// MaxAge, except the last one. The caller must hold s.mu.
+func (s *FileStore) retain(log *topicLog) {
+	var total int64
+	for _, segment := range log.segments {
+		total += segment.size
+	}
+	for len(log.segments) > 1 {
+		oldest := log.segments[0]
+		if (s.config.MaxSize <= 0 || total <= s.config.MaxSize) &&
+			(s.config.MaxAge <= 0 || time.Since(oldest.modTime) <= s.config.MaxAge) {
+			return
+		}
+		if err := os.Remove(oldest.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			s.logger.Warn("Deleting segment failed", "path", oldest.path, "error", err)
+			return
+		}
+		total -= oldest.size
+		log.segments = log.segments[1:]
+	}
+}
+
+// sweepInterval returns the interval between the sweeps of the segments
+// older than MaxAge
+func (s *FileStore) sweepInterval() time.Duration {
+	return min(s.config.MaxAge/2, maxSweepInterval)
+}
+
+// sweep deletes the segments of all the topics out of retention, so that
+// the topics not appended to anymore expire too, then schedules the next
+// sweep
+func (s *FileStore) sweep() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	for _, log := range s.topics {
+		s.retain(log)
+	}
+	s.sweeper.Reset(s.sweepInterval())
+}
+
+// Since returns the retained notifications of the topic with a sequence
+// number greater than seq, read from the segment files. The files are read
+// without holding up the appends.
+func (s *FileStore) Since(topic string, seq uint64) ([]Notification, error) {
+	s.mu.Lock()
+	log, err := s.topic(topic, false)
+	if err != nil || log == nil {
+		s.mu.Unlock()
+		return nil, err
+	}
+	s.retain(log)
+
+	// the segment holding the next notification, or the oldest one
+	start := sort.Search(len(log.segments), func(i int) bool {
+		return log.segments[i].firstSeq > seq+1
+	})
+	start = max(start-1, 0)
+
+	// the records appended meanwhile are not read
+	segments := make([]logSegment, 0, len(log.segments)-start)
+	for _, segment := range log.segments[start:] {
+		segments = append(segments, *segment)
+	}
+	s.mu.Unlock()
+
+	var notifications []Notification
+	for _, segment := range segments {
+		_, err := readSegment(segment.path, segment.size, func(n *Notification) {
+			if n.Seq > seq {
+				notifications = append(notifications, *n)
+			}
+		})
+		if errors.Is(err, os.ErrNotExist) {
+			// deleted out of retention meanwhile
+			continue
+		} else if errors.Is(err, errCorruptRecord) {
+			s.logger.Warn("Skipping the rest of a corrupt segment", "path", segment.path)
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	return notifications, nil
+}
+
+// LastSeq returns the sequence number of the last notification of the topic
+func (s *FileStore) LastSeq(topic string) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	log, err := s.topic(topic, false)
+	if err != nil || log == nil {
+		return 0, err
+	}
+	return log.lastSeq, nil
+}
+
+// Close closes the segment files. The store cannot be used afterwards.
+func (s *FileStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	if s.sweeper != nil {
+		s.sweeper.Stop()
+	}
+	var errs []error
+	for _, log := range s.topics {
+		if log.file != nil {
+			errs = append(errs, log.file.Close())
+			log.file = nil
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,173 @@
+package jsonrps_test
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/yookoala/jsonrps"
+)
+
+// openTestFileStore opens a FileStore in the directory, closed with the test
+func openTestFileStore(t *testing.T, dir string, config *jsonrps.FileStoreConfig) *jsonrps.FileStore {
+	t.Helper()
+	store, err := jsonrps.OpenFileStore(dir, config)
+	if err != nil {
+		t.Fatalf("Unexpected open error: %v", err)
+	}
+	t.Cleanup(func() {
+		store.Close()
+	})
+	return store
+}
+
+// storedSeqs returns the sequence numbers of the notifications of the
+// topic retained after seq
+func storedSeqs(t *testing.T, store jsonrps.NotificationStore, topic string, seq uint64) []uint64 {
+	t.Helper()
+	notifications, err := store.Since(topic, seq)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var seqs []uint64
+	for _, n := range notifications {
+		seqs = append(seqs, n.Seq)
+	}
+	return seqs
+}
+
+// segmentFiles returns the segment files of the topic directory
+func segmentFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(dir, "*.log"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	return files
+}
+
+func TestFileStore(t *testing.T) {
+	dir := t.TempDir()
+	config := &jsonrps.FileStoreConfig{SegmentSize: 128, Logger: newTestLogger(t)}
+	store := openTestFileStore(t, dir, config)
+
+	broker := &jsonrps.Broker{Store: store}
+	for i := range 10 {
+		if err := broker.Publish("audit/login", map[string]int{"attempt": i}); err != nil {
+			t.Fatalf("Unexpected publish error: %v", err)
+		}
+	}
+	if files := segmentFiles(t, filepath.Join(dir, "audit%2Flogin")); len(files) < 2 {
+		t.Errorf("Expected several segments, got %v", files)
+	}
+	if seqs := storedSeqs(t, store, "audit/login", 7); !reflect.DeepEqual(seqs, []uint64{8, 9, 10}) {
+		t.Errorf("Expected seqs [8 9 10], got %v", seqs)
+	}
+	if seqs := storedSeqs(t, store, "unknown", 0); seqs != nil {
+		t.Errorf("Expected no notification, got %v", seqs)
+	}
+
+	// the notifications survive a restart
+	store.Close()
+	if _, err := store.LastSeq("audit/login"); err != jsonrps.ErrStoreClosed {
+		t.Errorf("Expected ErrStoreClosed, got %v", err)
+	}
+	store = openTestFileStore(t, dir, config)
+	if seq, err := store.LastSeq("audit/login"); err != nil || seq != 10 {
+		t.Errorf("Expected last seq 10, got %d, error %v", seq, err)
+	}
+	notifications, err := store.Since("audit/login", 0)
+	if err != nil || len(notifications) != 10 {
+		t.Fatalf("Expected 10 notifications, got %d, error %v", len(notifications), err)
+	}
+	if string(notifications[3].Data) != `{"attempt":3}` || notifications[3].Topic != "audit/login" {
+		t.Errorf("Unexpected notification %+v", notifications[3])
+	}
+
+	broker = &jsonrps.Broker{Store: store}
+	broker.Publish("audit/login", "after restart")
+	if seq, _ := store.LastSeq("audit/login"); seq != 11 {
+		t.Errorf("Expected numbering to resume at 11, got %d", seq)
+	}
+}
+
+func TestFileStore_Retention(t *testing.T) {
+	dir := t.TempDir()
+	topicDir := filepath.Join(dir, "news")
+	store := openTestFileStore(t, dir, &jsonrps.FileStoreConfig{SegmentSize: 100, MaxSize: 250})
+	for seq := uint64(1); seq <= 20; seq++ {
+		store.Append(jsonrps.Notification{Topic: "news", Seq: seq, Data: []byte(`"0123456789"`)})
+	}
+	seqs := storedSeqs(t, store, "news", 0)
+	if len(seqs) == 0 || len(seqs) >= 20 || seqs[len(seqs)-1] != 20 {
+		t.Errorf("Expected the oldest notifications deleted by size, got %v", seqs)
+	}
+	var total int64
+	for _, file := range segmentFiles(t, topicDir) {
+		info, _ := os.Stat(file)
+		total += info.Size()
+	}
+	if total > 250 {
+		t.Errorf("Expected at most 250 bytes retained, got %d", total)
+	}
+
+	// segments older than MaxAge are deleted on open
+	store.Close()
+	old := time.Now().Add(-2 * time.Hour)
+	files := segmentFiles(t, topicDir)
+	for _, file := range files[:len(files)-1] {
+		os.Chtimes(file, old, old)
+	}
+	store = openTestFileStore(t, dir, &jsonrps.FileStoreConfig{MaxAge: time.Hour})
+	if files := segmentFiles(t, topicDir); len(files) != 1 {
+		t.Errorf("Expected only the last segment, got %v", files)
+	}
+	if seq, _ := store.LastSeq("news"); seq != 20 {
+		t.Errorf("Expected last seq 20, got %d", seq)
+	}
+	// segments older than MaxAge are deleted without appends to the topic
+	store.Close()
+	store = openTestFileStore(t, dir, &jsonrps.FileStoreConfig{SegmentSize: 100, MaxAge: 100 * time.Millisecond})
+	for seq := uint64(21); seq <= 30; seq++ {
+		store.Append(jsonrps.Notification{Topic: "news", Seq: seq, Data: []byte(`"0123456789"`)})
+	}
+	if files := segmentFiles(t, topicDir); len(files) < 2 {
+		t.Fatalf("Expected several segments, got %v", files)
+	}
+	if !waitFor(t, time.Second, func() bool { return len(segmentFiles(t, topicDir)) == 1 }) {
+		t.Errorf("Expected only the last segment of the idle topic, got %v", segmentFiles(t, topicDir))
+	}
+}
+
+func TestFileStore_Recovery(t *testing.T) {
+	dir := t.TempDir()
+	store := openTestFileStore(t, dir, nil)
+	for seq := uint64(1); seq <= 3; seq++ {
+		store.Append(jsonrps.Notification{Topic: "audit", Seq: seq, Data: []byte(`"entry"`)})
+	}
+	store.Close()
+
+	// a crash while appending leaves a partial record
+	files := segmentFiles(t, filepath.Join(dir, "audit"))
+	info, _ := os.Stat(files[0])
+	if err := os.Truncate(files[0], info.Size()-3); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	store = openTestFileStore(t, dir, &jsonrps.FileStoreConfig{Logger: newTestLogger(t)})
+	if seq, _ := store.LastSeq("audit"); seq != 2 {
+		t.Errorf("Expected last seq 2 after recovery, got %d", seq)
+	}
+	if err := store.Append(jsonrps.Notification{Topic: "audit", Seq: 3, Data: []byte(`"again"`)}); err != nil {
+		t.Fatalf("Unexpected append error: %v", err)
+	}
+	store.Close()
+
+	store = openTestFileStore(t, dir, nil)
+	notifications, err := store.Since("audit", 0)
+	if err != nil || len(notifications) != 3 || string(notifications[2].Data) != `"again"` {
+		t.Errorf("Unexpected notifications after recovery %+v, error %v", notifications, err)
+	}
+}
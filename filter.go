@@ -0,0 +1,275 @@
+package jsonrps
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// Filter is a filter expression over the data of notifications, so that
+// subscribers receive only the notifications they are interested in.
+//
+// A filter is a JSON object whose members must all match. A member maps a
+// field of the data, with dots for nested fields (e.g. "user.id"), to the
+// value to equal, or to an object of operators:
+//
+//	$eq, $ne              equal or not to the value
+//	$gt, $gte, $lt, $lte  compare to the number or string
+//	$in, $nin             equal or not to one of the values of the array
+//	$exists               whether the field is present, with true or false
+//
+// The members "$and" and "$or" combine an array of filters, and "$not"
+// negates a filter, e.g.
+//
+//	{"type": "alert", "level": {"$gte": 3}, "$or": [{"region": "eu"}, {"urgent": true}]}
+type Filter struct {
+	match func(data any) bool
+}
+
+// ParseFilter parses the JSON filter expression
+func ParseFilter(expr []byte) (*Filter, error) {
+	var raw any
+	if err := json.Unmarshal(expr, &raw); err != nil {
+		return nil, err
+	}
+	match, err := parseFilter(raw)
+	if err != nil {
+		return nil, err
+	}
+	return &Filter{match: match}, nil
+}
+
+// parseFilter compiles the decoded filter object
+func parseFilter(raw any) (func(data any) bool, error) {
+	members, ok := raw.(map[string]any)
+	if !ok {
+		return nil, errors.New("jsonrps: filter must be an object")
+	}
+	var matches []func(data any) bool
+	for key, value := range members {
+		var match func(data any) bool
+		var err error
+		switch key {
+		case "$and", "$or":
+			match, err = parseCombinator(key, value)
+		case "$not":
+			var negated func(data any) bool
+			if negated, err = parseFilter(value); err == nil {
+				match = func(data any) bool { return !negated(data) }
+			}
+		default:
+			if strings.HasPrefix(key, "$") {
+				return nil, fmt.Errorf("jsonrps: unknown filter operator %q", key)
+			}
+			match, err = parseField(key, value)
+		}
+		if err != nil {
+			return nil, err
+		}
+		matches = append(matches, match)
+	}
+	return func(data any) bool {
+		for _, match := range matches {
+			if !match(data) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+// parseCombinator compiles the array of filters of $and or $or
+func parseCombinator(op string, value any) (func(data any) bool, error) {
+	filters, ok := value.([]any)
+	if !ok || len(filters) == 0 {
+		return nil, fmt.Errorf("jsonrps: %s requires an array of filters", op)
+	}
+	matches := make([]func(data any) bool, len(filters))
+	for i, filter := range filters {
+		var err error
+		if matches[i], err = parseFilter(filter); err != nil {
+			return nil, err
+		}
+	}
+	// $and matches unless a filter does not, $or matches if a filter does
+	stop := op == "$or"
+	return func(data any) bool {
+		for _, match := range matches {
+			if match(data) == stop {
+				return stop
+			}
+		}
+		return !stop
+	}, nil
+}
+
+// parseField compiles the condition of the field: the value to equal, or
+// an object of operators
+func parseField(path string, value any) (func(data any) bool, error) {
+	fields := strings.Split(path, ".")
+	ops, ok := value.(map[string]any)
+	if !ok || !isOperators(ops) {
+		return func(data any) bool {
+			v, ok := lookupField(data, fields)
+			return ok && reflect.DeepEqual(v, value)
+		}, nil
+	}
+
+	var conds []func(v any, ok bool) bool
+	for op, operand := range ops {
+		cond, err := parseOperator(op, operand)
+		if err != nil {
+			return nil, fmt.Errorf("%w of field %q", err, path)
+		}
+		conds = append(conds, cond)
+	}
+	return func(data any) bool {
+		v, ok := lookupField(data, fields)
+		for _, cond := range conds {
+			if !cond(v, ok) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+// isOperators tells if the object is an object of operators rather than a
+// value to equal
+func isOperators(obj map[string]any) bool {
+	for key := range obj {
+		if !strings.HasPrefix(key, "$") {
+			return false
+		}
+	}
+	return len(obj) > 0
+}
+
+// parseOperator compiles the operator with its operand into a condition
+// on the value of a field, and whether the field is present
+func parseOperator(op string, operand any) (func(v any, ok bool) bool, error) {
+	switch op {
+	case "$eq":
+		return func(v any, ok bool) bool { return ok && reflect.DeepEqual(v, operand) }, nil
+	case "$ne":
+		return func(v any, ok bool) bool { return !ok || !reflect.DeepEqual(v, operand) }, nil
+	case "$gt", "$gte", "$lt", "$lte":
+		switch operand.(type) {
+		case float64, string:
+		default:
+			return nil, fmt.Errorf("jsonrps: %s requires a number or a string", op)
+		}
+		return func(v any, ok bool) bool {
+			c, valid := compareValues(v, operand)
+			if !ok || !valid {
+				return false
+			}
+			switch op {
+			case "$gt":
+				return c > 0
+			case "$gte":
+				return c >= 0
+			case "$lt":
+				return c < 0
+			default:
+				return c <= 0
+			}
+		}, nil
+	case "$in", "$nin":
+		values, isArray := operand.([]any)
+		if !isArray {
+			return nil, fmt.Errorf("jsonrps: %s requires an array", op)
+		}
+		in := op == "$in"
+		return func(v any, ok bool) bool {
+			if ok {
+				for _, value := range values {
+					if reflect.DeepEqual(v, value) {
+						return in
+					}
+				}
+			}
+			return !in
+		}, nil
+	case "$exists":
+		exists, isBool := operand.(bool)
+		if !isBool {
+			return nil, errors.New("jsonrps: $exists requires a boolean")
+		}
+		return func(v any, ok bool) bool { return ok == exists }, nil
+	}
+	return nil, fmt.Errorf("jsonrps: unknown filter operator %q", op)
+}
+
+// compareValues compares two numbers or two strings, and tells whether
+// they are comparable
+func compareValues(a, b any) (int, bool) {
+	switch a := a.(type) {
+	case float64:
+		if b, ok := b.(float64); ok {
+			switch {
+			case a < b:
+				return -1, true
+			case a > b:
+				return 1, true
+			}
+			return 0, true
+		}
+	case string:
+		if b, ok := b.(string); ok {
+			return strings.Compare(a, b), true
+		}
+	}
+	return 0, false
+}
+
+// lookupField returns the value of the nested field of the data, and
+// whether it is present
+func lookupField(data any, fields []string) (any, bool) {
+	for _, field := range fields {
+		obj, ok := data.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		if data, ok = obj[field]; !ok {
+			return nil, false
+		}
+	}
+	return data, true
+}
+
+// Match tells if the JSON data matches the filter. Invalid data does not
+// match.
+func (f *Filter) Match(data json.RawMessage) bool {
+	var v any
+	if len(data) > 0 && json.Unmarshal(data, &v) != nil {
+		return false
+	}
+	return f.match(v)
+}
+
+// Sink returns a NotificationSink writing to the sink the notifications
+// whose data matches the filter, and dropping the others
+func (f *Filter) Sink(sink NotificationSink) NotificationSink {
+	return &filterSink{filter: f, sink: sink}
+}
+
+// filterSink is the NotificationSink of Filter.Sink
+type filterSink struct {
+	filter *Filter
+	sink   NotificationSink
+}
+
+// WriteResponse writes the notification if it matches the filter
+func (s *filterSink) WriteResponse(response *JSONRPCResponse) error {
+	var notification Notification
+	if err := json.Unmarshal(response.Params, &notification); err != nil {
+		return err
+	}
+	if !s.filter.Match(notification.Data) {
+		return nil
+	}
+	return s.sink.WriteResponse(response)
+}
@@ -0,0 +1,87 @@
+package jsonrps_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/yookoala/jsonrps"
+)
+
+func TestFilter_Match(t *testing.T) {
+	data := json.RawMessage(`{"type":"alert","level":3,"region":"eu","user":{"id":"u1","tags":["a"]},"urgent":false}`)
+
+	tests := []struct {
+		name     string
+		filter   string
+		expected bool
+	}{
+		{"empty filter", `{}`, true},
+		{"equal field", `{"type":"alert"}`, true},
+		{"different field", `{"type":"info"}`, false},
+		{"several fields", `{"type":"alert","region":"us"}`, false},
+		{"nested field", `{"user.id":"u1"}`, true},
+		{"equal object", `{"user":{"id":"u1","tags":["a"]}}`, true},
+		{"missing field", `{"user.name":"bob"}`, false},
+		{"greater than", `{"level":{"$gt":2}}`, true},
+		{"range", `{"level":{"$gte":1,"$lt":3}}`, false},
+		{"string range", `{"region":{"$lte":"fr"}}`, true},
+		{"mismatched range types", `{"region":{"$gt":1}}`, false},
+		{"not equal", `{"level":{"$ne":3}}`, false},
+		{"not equal missing", `{"missing":{"$ne":3}}`, true},
+		{"in set", `{"region":{"$in":["eu","us"]}}`, true},
+		{"not in set", `{"region":{"$nin":["eu","us"]}}`, false},
+		{"exists", `{"urgent":{"$exists":true},"missing":{"$exists":false}}`, true},
+		{"or", `{"$or":[{"region":"us"},{"level":3}]}`, true},
+		{"and", `{"$and":[{"region":"eu"},{"urgent":true}]}`, false},
+		{"not", `{"$not":{"urgent":true}}`, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filter, err := jsonrps.ParseFilter([]byte(tt.filter))
+			if err != nil {
+				t.Fatalf("Unexpected parse error: %v", err)
+			}
+			if actual := filter.Match(data); actual != tt.expected {
+				t.Errorf("Expected Match() = %v, got %v", tt.expected, actual)
+			}
+		})
+	}
+}
+
+func TestParseFilter_Invalid(t *testing.T) {
+	for _, expr := range []string{
+		`[]`,
+		`{"$xor":[]}`,
+		`{"$or":{}}`,
+		`{"level":{"$gt":[1]}}`,
+		`{"level":{"$in":1}}`,
+		`{"level":{"$exists":"yes"}}`,
+		`{"level":{"$regex":"a"}}`,
+		`{"$not":[{"level":1}]}`,
+	} {
+		if _, err := jsonrps.ParseFilter([]byte(expr)); err == nil {
+			t.Errorf("Expected an error parsing %s", expr)
+		}
+	}
+}
+
+func TestBroker_Register_Filter(t *testing.T) {
+	broker := jsonrps.NewBroker()
+	client, messages, _ := startBrokerSession(t, broker)
+	sendRequest(t, client, jsonrps.SubscribeMethod, `{"topic":"alerts","filter":{"level":{"$gte":3}}}`, 1)
+	if resp := nextMessage(t, messages); resp.Error != nil {
+		t.Fatalf("Unexpected subscribe error: %v", resp.Error)
+	}
+
+	broker.Publish("alerts", map[string]int{"level": 1})
+	broker.Publish("alerts", map[string]int{"level": 5})
+	if n := nextDelivery(t, messages); n.Seq != 2 {
+		t.Errorf("Expected only the matching notification 2, got %+v", n)
+	}
+
+	sendRequest(t, client, jsonrps.SubscribeMethod, `{"topic":"news","filter":{"$bad":1}}`, 2)
+	if resp := nextMessage(t, messages); resp.Error == nil || resp.Error.Code != jsonrps.ErrCodeInvalidParams {
+		t.Errorf("Expected invalid params with a bad filter, got %#v", resp)
+	}
+}
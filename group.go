@@ -0,0 +1,105 @@
+package jsonrps
+
+// consumerGroup is the members of a consumer group subscribed to a topic,
+// which share the notifications of the topic: each notification is
+// delivered to one member only, in turn.
+//
+// The group is subscribed to the topic as a NotificationSink while it has
+// members. The fields are protected by broker.mu.
+type consumerGroup struct {
+	broker  *Broker
+	name    string
+	topic   string
+	sub     *Subscription // the subscription of the group to the topic
+	members []*Subscription
+	next    int // the index of the member to receive the next notification
+}
+
+// groupKey returns the key of the consumer group of the topic
+func groupKey(topic, group string) string {
+	return topic + "\x00" + group
+}
+
+// SubscribeGroup subscribes the sink to the topic as a member of the
+// consumer group. Each notification of the topic is delivered to one
+// member of the group only, the members taking turns. Members join and
+// leave the group by subscribing and unsubscribing.
+func (b *Broker) SubscribeGroup(topic, group string, sink NotificationSink) *Subscription {
+	b.publishMu.Lock()
+	defer b.publishMu.Unlock()
+	seq, _ := b.lastSeq(topic)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.addMember(topic, group, seq, sink)
+}
+
+// addMember adds a subscription of the sink to the topic as a member of
+// the consumer group, subscribing the group to the topic if new. The
+// caller must hold b.mu.
+func (b *Broker) addMember(topic, group string, seq uint64, sink NotificationSink) *Subscription {
+	g := b.groups[groupKey(topic, group)]
+	if g == nil {
+		g = &consumerGroup{broker: b, name: group, topic: topic}
+		g.sub = b.add(topic, seq, g)
+		if b.groups == nil {
+			b.groups = make(map[string]*consumerGroup)
+		}
+		b.groups[groupKey(topic, group)] = g
+	}
+	sub := &Subscription{Topic: topic, Group: group, Seq: seq, broker: b, sink: sink, group: g}
+	g.members = append(g.members, sub)
+	return sub
+}
+
+// removeMember removes the member from its consumer group, and the group
+// from the topic once it has no member left. The caller must hold b.mu.
+func (b *Broker) removeMember(sub *Subscription) {
+	g := sub.group
+	for i, member := range g.members {
+		if member != sub {
+			continue
+		}
+		g.members = append(g.members[:i], g.members[i+1:]...)
+		if i < g.next {
+			g.next--
+		}
+		break
+	}
+	if len(g.members) == 0 && b.groups[groupKey(g.topic, g.name)] == g {
+		delete(b.groups, groupKey(g.topic, g.name))
+		b.removeTopic(g.sub)
+	}
+}
+
+// pick returns the next live member to receive a notification, or nil if
+// the group has no live member. Members whose session context is done are
+// skipped, as they are about to be removed.
+func (g *consumerGroup) pick() *Subscription {
+	g.broker.mu.Lock()
+	defer g.broker.mu.Unlock()
+	for range g.members {
+		if g.next >= len(g.members) {
+			g.next = 0
+		}
+		member := g.members[g.next]
+		g.next++
+		if member.sess == nil || member.sess.context().Err() == nil {
+			return member
+		}
+	}
+	return nil
+}
+
+// WriteResponse delivers the notification to the next live member of the
+// group. Members failing to receive it are unsubscribed, and the
+// notification is passed to the next one.
+func (g *consumerGroup) WriteResponse(response *JSONRPCResponse) error {
+	var err error
+	for member := g.pick(); member != nil; member = g.pick() {
+		if err = member.sink.WriteResponse(response); err == nil {
+			return nil
+		}
+		member.Unsubscribe()
+	}
+	return err
+}
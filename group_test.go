@@ -0,0 +1,153 @@
+package jsonrps_test
+
+import (
+	"errors"
+	"reflect"
+	"slices"
+	"testing"
+
+	"github.com/yookoala/jsonrps"
+)
+
+func TestBroker_SubscribeGroup(t *testing.T) {
+	broker := jsonrps.NewBroker()
+	received := make([][]uint64, 3)
+	members := make([]*jsonrps.Subscription, 3)
+	for i := range members {
+		members[i] = broker.SubscribeGroup("jobs", "workers", collectSeqs(&received[i]))
+	}
+	var all []uint64
+	broker.Subscribe("jobs", collectSeqs(&all))
+
+	for i := range 6 {
+		broker.Publish("jobs", i)
+	}
+	expected := [][]uint64{{1, 4}, {2, 5}, {3, 6}}
+	if !reflect.DeepEqual(received, expected) {
+		t.Errorf("Expected the notifications shared by the members %v, got %v", expected, received)
+	}
+	if len(all) != 6 {
+		t.Errorf("Expected all notifications to the subscriber out of the group, got %v", all)
+	}
+
+	// the rest of the group takes over the members leaving or failing
+	members[0].Unsubscribe()
+	failing := broker.SubscribeGroup("jobs", "workers", sinkFunc(func(resp *jsonrps.JSONRPCResponse) error {
+		return errors.New("gone")
+	}))
+	for i := range received {
+		received[i] = nil
+	}
+	for i := range 4 {
+		broker.Publish("jobs", i)
+	}
+	if n := len(received[1]) + len(received[2]); n != 4 || len(received[0]) != 0 {
+		t.Errorf("Expected 4 notifications to the remaining members, got %v", received)
+	}
+	if failing.Group != "workers" {
+		t.Errorf("Expected group workers, got %q", failing.Group)
+	}
+
+	// the group is unsubscribed with its last member
+	members[1].Unsubscribe()
+	members[2].Unsubscribe()
+	failing.Unsubscribe()
+	broker.Publish("jobs", "unseen")
+	if len(received[1])+len(received[2]) != 4 {
+		t.Errorf("Expected no notification after leaving, got %v", received)
+	}
+	if topics := broker.Topics(); !reflect.DeepEqual(topics, []string{"jobs"}) {
+		t.Errorf("Expected topics [jobs], got %v", topics)
+	}
+}
+
+func TestBroker_Register_Group(t *testing.T) {
+	broker := jsonrps.NewBroker()
+	client1, messages1, end1 := startBrokerSession(t, broker)
+	client2, messages2, _ := startBrokerSession(t, broker)
+	for _, client := range []*jsonrps.Session{client1, client2} {
+		sendRequest(t, client, jsonrps.SubscribeMethod, `{"topic":"jobs","group":"workers"}`, 1)
+	}
+	if resp := nextMessage(t, messages1); resp.Error != nil {
+		t.Fatalf("Unexpected subscribe error: %v", resp.Error)
+	}
+	if resp := nextMessage(t, messages2); resp.Error != nil {
+		t.Fatalf("Unexpected subscribe error: %v", resp.Error)
+	}
+
+	for i := range 4 {
+		broker.Publish("jobs", i)
+	}
+	seqs := map[uint64]bool{}
+	for range 2 {
+		seqs[nextDelivery(t, messages1).Seq] = true
+		seqs[nextDelivery(t, messages2).Seq] = true
+	}
+	if len(seqs) != 4 {
+		t.Errorf("Expected each notification delivered once, got %v", seqs)
+	}
+
+	// the group is rebalanced once the context of a member is done
+	end1()
+	broker.Publish("jobs", 4)
+	broker.Publish("jobs", 5)
+	if n := nextDelivery(t, messages2); n.Seq != 5 {
+		t.Errorf("Expected seq 5, got %d", n.Seq)
+	}
+	if n := nextDelivery(t, messages2); n.Seq != 6 {
+		t.Errorf("Expected seq 6, got %d", n.Seq)
+	}
+
+	sendRequest(t, client2, jsonrps.SubscribeMethod, `{"topic":"news","group":"workers","since":0}`, 2)
+	if resp := nextMessage(t, messages2); resp.Error == nil || resp.Error.Code != jsonrps.ErrCodeInvalidParams {
+		t.Errorf("Expected invalid params with since, got %#v", resp)
+	}
+}
+
+func TestBroker_Register_GroupAck(t *testing.T) {
+	broker := jsonrps.NewBroker()
+	worker := &jsonrps.Principal{Name: "worker"}
+	client1, messages1, end1 := startBrokerSessionAs(t, broker, worker)
+	client2, messages2, _ := startBrokerSessionAs(t, broker, worker)
+
+	// members of the same principal do not replace each other
+	for _, client := range []*jsonrps.Session{client1, client2} {
+		sendRequest(t, client, jsonrps.SubscribeMethod, `{"topic":"jobs","group":"workers","ack":true}`, 1)
+	}
+	if resp := nextMessage(t, messages1); resp.Error != nil {
+		t.Fatalf("Unexpected subscribe error: %v", resp.Error)
+	}
+	if resp := nextMessage(t, messages2); resp.Error != nil {
+		t.Fatalf("Unexpected subscribe error: %v", resp.Error)
+	}
+	for i := range 10 {
+		broker.Publish("jobs", i)
+	}
+	var seqs1, seqs2 []uint64
+	for range 5 {
+		seqs1 = append(seqs1, nextDelivery(t, messages1).Seq)
+		seqs2 = append(seqs2, nextDelivery(t, messages2).Seq)
+	}
+	if all := slices.Sorted(slices.Values(append(slices.Clone(seqs1), seqs2...))); !reflect.DeepEqual(all, []uint64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}) {
+		t.Errorf("Expected the notifications shared by the members, got %v and %v", seqs1, seqs2)
+	}
+
+	// the notifications not acknowledged by a member leaving go to the others
+	end1()
+	var handedOver []uint64
+	for range 5 {
+		n := nextDelivery(t, messages2)
+		if n.DeliveryID == "" {
+			t.Errorf("Expected a delivery ID, got %+v", n)
+		}
+		handedOver = append(handedOver, n.Seq)
+	}
+	if !reflect.DeepEqual(handedOver, seqs1) {
+		t.Errorf("Expected the notifications of the member left %v, got %v", seqs1, handedOver)
+	}
+
+	sendRequest(t, client2, jsonrps.SubscribeMethod, `{"topic":"news","group":"workers","ack":true,"subscriber":"w1"}`, 2)
+	if resp := nextMessage(t, messages2); resp.Error == nil || resp.Error.Code != jsonrps.ErrCodeInvalidParams {
+		t.Errorf("Expected invalid params with subscriber, got %#v", resp)
+	}
+}
@@ -0,0 +1,160 @@
+package jsonrps
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+)
+
+// DefaultHTTPBodySize is the default limit of the size of a request body
+// accepted by HTTPHandler
+const DefaultHTTPBodySize = 1 << 20
+
+// errStatelessSession is returned by the reads and writes of the sessions
+// of HTTPHandler, which have no connection to stream over
+var errStatelessSession = errors.New("jsonrps: stateless session has no connection")
+
+// HTTPHandler is an http.Handler which serves one-shot JSON-RPC calls
+// sent in the body of POST requests, for clients which cannot hold a
+// session open. A body may contain a single request or a batch of them.
+//
+// Each call is dispatched to the same MethodHandler used on RPS sessions,
+// with a stateless Session built from the HTTP request: the request
+// headers become RemoteHeaders, the request path becomes Method and the
+// request context becomes Context. LocalHeaders set by the handlers are
+// sent as the response headers. Reading from or writing to the session
+// connection fails.
+//
+// JSON-RPC errors are responded with HTTP status 200 OK. Requests which
+// need no response (only notifications) are responded with 204 No Content.
+type HTTPHandler struct {
+	// Handler handles every call
+	Handler MethodHandler
+
+	// MaxBodySize limits the size of the request body.
+	// DefaultHTTPBodySize is used if zero.
+	MaxBodySize int64
+
+	// Logger is used for all sessions. The default logger is used if nil.
+	Logger *slog.Logger
+}
+
+// ServeHTTP decodes the calls in the request body, dispatches them, and
+// writes the responses
+func (h *HTTPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	limit := h.MaxBodySize
+	if limit <= 0 {
+		limit = DefaultHTTPBodySize
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, limit))
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	sess := h.newSession(r)
+	body = bytes.TrimSpace(body)
+
+	var result any
+	if len(body) > 0 && body[0] == '[' {
+		var batch []json.RawMessage
+		if err := json.Unmarshal(body, &batch); err != nil {
+			result = NewErrorResponse(nil, ErrCodeParseError, "parse error", nil)
+		} else if len(batch) == 0 {
+			result = NewErrorResponse(nil, ErrCodeInvalidRequest, "invalid request", nil)
+		} else {
+			responses := make([]*JSONRPCResponse, 0, len(batch))
+			for _, raw := range batch {
+				if resp := h.serve(sess, raw); resp != nil {
+					responses = append(responses, resp)
+				}
+			}
+			if len(responses) > 0 {
+				result = responses
+			}
+		}
+	} else if resp := h.serve(sess, body); resp != nil {
+		result = resp
+	}
+
+	for key, values := range sess.LocalHeaders {
+		w.Header()[key] = values
+	}
+	if result == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		sess.logger().Debug("Writing response failed", "error", err)
+	}
+}
+
+// serve decodes and dispatches a single call
+func (h *HTTPHandler) serve(sess *Session, raw []byte) *JSONRPCResponse {
+	var req JSONRPCRequest
+	if err := json.Unmarshal(raw, &req); err != nil {
+		var syntaxErr *json.SyntaxError
+		if errors.As(err, &syntaxErr) {
+			return NewErrorResponse(nil, ErrCodeParseError, "parse error", nil)
+		}
+		return NewErrorResponse(nil, ErrCodeInvalidRequest, "invalid request", nil)
+	}
+	ctx, cancel := withRequestTimeout(sess.context(), &req)
+	defer cancel()
+	return serveRequest(ctx, h.Handler, sess, &req)
+}
+
+// newSession creates the stateless session of the HTTP request
+func (h *HTTPHandler) newSession(r *http.Request) *Session {
+	logger := h.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	sess := &Session{
+		ID:                newSessionID(),
+		ProtocolSignature: DefaultProtocolSignature,
+		Method:            r.URL.Path,
+		LocalHeaders:      make(http.Header),
+		RemoteHeaders:     r.Header,
+		Context:           r.Context(),
+		Conn:              statelessConn{},
+		TLS:               r.TLS,
+		headerSent:        true,
+	}
+	sess.Logger = logger.With("session", sess.ID)
+	return sess
+}
+
+// statelessConn is the connection of stateless sessions, which fails
+// every read and write
+type statelessConn struct{}
+
+// Read returns errStatelessSession
+func (statelessConn) Read(p []byte) (int, error) {
+	return 0, errStatelessSession
+}
+
+// Write returns errStatelessSession
+func (statelessConn) Write(p []byte) (int, error) {
+	return 0, errStatelessSession
+}
+
+// Close does nothing
+func (statelessConn) Close() error {
+	return nil
+}
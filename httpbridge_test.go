@@ -0,0 +1,159 @@
+package jsonrps_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/yookoala/jsonrps"
+)
+
+// postTestHTTP posts the body to the handler and returns the recorded response
+func postTestHTTP(t *testing.T, handler http.Handler, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/rpc", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestHTTPHandler_SingleCall(t *testing.T) {
+	mux := jsonrps.NewMethodMux()
+	mux.Handle("echo", echoHandler)
+	handler := &jsonrps.HTTPHandler{Handler: mux, Logger: newTestLogger(t)}
+
+	rec := postTestHTTP(t, handler, `{"jsonrpc":"2.0","method":"echo","params":[1,2],"id":1}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", rec.Code)
+	}
+	if rec.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("Unexpected content type %q", rec.Header().Get("Content-Type"))
+	}
+	var resp jsonrps.JSONRPCResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if string(resp.Result) != `[1,2]` || resp.ID != float64(1) || resp.Version != "2.0" {
+		t.Errorf("Unexpected response %#v", resp)
+	}
+}
+
+func TestHTTPHandler_Batch(t *testing.T) {
+	mux := jsonrps.NewMethodMux()
+	mux.Handle("echo", echoHandler)
+	handler := &jsonrps.HTTPHandler{Handler: mux, Logger: newTestLogger(t)}
+
+	rec := postTestHTTP(t, handler, `[
+		{"jsonrpc":"2.0","method":"echo","params":"a","id":1},
+		{"jsonrpc":"2.0","method":"echo","params":"notification"},
+		{"jsonrpc":"2.0","method":"missing","id":2},
+		{"jsonrpc":"2.0","id":3},
+		1
+	]`)
+	var responses []jsonrps.JSONRPCResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &responses); err != nil {
+		t.Fatalf("Failed to decode responses %q: %v", rec.Body.String(), err)
+	}
+	if len(responses) != 4 {
+		t.Fatalf("Expected 4 responses, got %d", len(responses))
+	}
+	if string(responses[0].Result) != `"a"` {
+		t.Errorf("Unexpected first response %#v", responses[0])
+	}
+	expectedCodes := []int{jsonrps.ErrCodeMethodNotFound, jsonrps.ErrCodeInvalidRequest, jsonrps.ErrCodeInvalidRequest}
+	for i, code := range expectedCodes {
+		if responses[i+1].Error == nil || responses[i+1].Error.Code != code {
+			t.Errorf("Expected response %d error code %d, got %#v", i+1, code, responses[i+1])
+		}
+	}
+}
+
+func TestHTTPHandler_Errors(t *testing.T) {
+	handler := &jsonrps.HTTPHandler{Handler: echoHandler, MaxBodySize: 128, Logger: newTestLogger(t)}
+
+	tests := []struct {
+		name     string
+		body     string
+		code     int
+		rpcError int
+	}{
+		{"parse error", `{"jsonrpc":`, http.StatusOK, jsonrps.ErrCodeParseError},
+		{"batch parse error", `[{"jsonrpc":"2.0"`, http.StatusOK, jsonrps.ErrCodeParseError},
+		{"empty batch", `[]`, http.StatusOK, jsonrps.ErrCodeInvalidRequest},
+		{"notifications only", `[{"jsonrpc":"2.0","method":"a"},{"jsonrpc":"2.0","method":"b"}]`, http.StatusNoContent, 0},
+		{"too large", `{"jsonrpc":"2.0","method":"echo","params":"` + strings.Repeat("x", 200) + `","id":1}`, http.StatusRequestEntityTooLarge, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := postTestHTTP(t, handler, tt.body)
+			if rec.Code != tt.code {
+				t.Fatalf("Expected status %d, got %d", tt.code, rec.Code)
+			}
+			if tt.rpcError == 0 {
+				return
+			}
+			var resp jsonrps.JSONRPCResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("Failed to decode response: %v", err)
+			}
+			if resp.Error == nil || resp.Error.Code != tt.rpcError {
+				t.Errorf("Expected error code %d, got %#v", tt.rpcError, resp)
+			}
+		})
+	}
+}
+
+func TestHTTPHandler_MethodNotAllowed(t *testing.T) {
+	handler := &jsonrps.HTTPHandler{Handler: echoHandler}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/rpc", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected status 405, got %d", rec.Code)
+	}
+}
+
+func TestHTTPHandler_SharedRegistry(t *testing.T) {
+	// the same method registry, with middlewares, serves both transports
+	mux := jsonrps.NewMethodMux()
+	mux.HandleFunc("whoami", func(ctx context.Context, sess *jsonrps.Session, req *jsonrps.JSONRPCRequest) *jsonrps.JSONRPCResponse {
+		sess.LocalHeaders.Set("X-Handled-By", "whoami")
+		resp, _ := jsonrps.NewResultResponse(req.ID, sess.RemoteHeaders.Get("X-User"))
+		return resp
+	})
+	methods := jsonrps.Chain(mux, jsonrps.RecoverMiddleware)
+
+	srv := httptest.NewServer(&jsonrps.HTTPHandler{Handler: methods})
+	defer srv.Close()
+
+	req, _ := http.NewRequest(http.MethodPost, srv.URL, strings.NewReader(`{"jsonrpc":"2.0","method":"whoami","id":"1"}`))
+	req.Header.Set("X-User", "alice")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if strings.TrimSpace(string(body)) != `{"jsonrpc":"2.0","id":"1","result":"alice"}` {
+		t.Errorf("Unexpected body %s", body)
+	}
+	if resp.Header.Get("X-Handled-By") != "whoami" {
+		t.Errorf("Expected header set by handler, got %v", resp.Header)
+	}
+
+	conn := &mockReadWriteCloser{readData: `{"jsonrpc":"2.0","method":"whoami","id":"1"}` + "\n"}
+	sess := &jsonrps.Session{
+		LocalHeaders:  http.Header{},
+		RemoteHeaders: http.Header{"X-User": {"bob"}},
+		Conn:          conn,
+		Logger:        newTestLogger(t),
+	}
+	(&jsonrps.Dispatcher{Handler: methods}).HandleSession(sess)
+	if !strings.HasSuffix(conn.writeData.String(), `{"jsonrpc":"2.0","id":"1","result":"bob"}`+"\n") {
+		t.Errorf("Unexpected session output %q", conn.writeData.String())
+	}
+}
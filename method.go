@@ -0,0 +1,278 @@
+package jsonrps
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// errRequestTimeout is the cause of the context of a request whose
+// timeout is exceeded
+var errRequestTimeout = errors.New("jsonrps: request timeout")
+
+// MethodHandler responds to a single JSON-RPC request received on a session.
+//
+// The returned response is written back to the session by the caller.
+// Handlers may return nil for notifications (requests without ID) as
+// there is nothing to respond to.
+type MethodHandler interface {
+	ServeMethod(ctx context.Context, sess *Session, req *JSONRPCRequest) *JSONRPCResponse
+}
+
+// MethodHandlerFunc is an adapter to allow the use of ordinary functions
+// as MethodHandler.
+type MethodHandlerFunc func(ctx context.Context, sess *Session, req *JSONRPCRequest) *JSONRPCResponse
+
+// ServeMethod calls f(ctx, sess, req)
+func (f MethodHandlerFunc) ServeMethod(ctx context.Context, sess *Session, req *JSONRPCRequest) *JSONRPCResponse {
+	return f(ctx, sess, req)
+}
+
+// MethodMux is a registry of method handlers. It routes each request
+// to the handler registered with the exact method name.
+//
+// The zero value is ready to use.
+type MethodMux struct {
+	mu       sync.RWMutex
+	handlers map[string]MethodHandler
+}
+
+// NewMethodMux creates a new, empty, MethodMux
+func NewMethodMux() *MethodMux {
+	return &MethodMux{}
+}
+
+// Handle registers the handler for the given method name. Registering
+// a method twice replaces the previous handler.
+func (mux *MethodMux) Handle(method string, handler MethodHandler) {
+	mux.mu.Lock()
+	defer mux.mu.Unlock()
+	if mux.handlers == nil {
+		mux.handlers = make(map[string]MethodHandler)
+	}
+	mux.handlers[method] = handler
+}
+
+// HandleFunc registers the handler function for the given method name
+func (mux *MethodMux) HandleFunc(method string, handler func(ctx context.Context, sess *Session, req *JSONRPCRequest) *JSONRPCResponse) {
+	mux.Handle(method, MethodHandlerFunc(handler))
+}
+
+// Handler returns the handler registered for the given method name, if any
+func (mux *MethodMux) Handler(method string) (handler MethodHandler, ok bool) {
+	mux.mu.RLock()
+	defer mux.mu.RUnlock()
+	handler, ok = mux.handlers[method]
+	return
+}
+
+// Methods returns the sorted names of all registered methods
+func (mux *MethodMux) Methods() []string {
+	mux.mu.RLock()
+	defer mux.mu.RUnlock()
+	methods := make([]string, 0, len(mux.handlers))
+	for method := range mux.handlers {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+	return methods
+}
+
+// ServeMethod dispatches the request to the handler registered for
+// the request method, or responds with ErrCodeMethodNotFound.
+func (mux *MethodMux) ServeMethod(ctx context.Context, sess *Session, req *JSONRPCRequest) *JSONRPCResponse {
+	handler, ok := mux.Handler(req.Method)
+	if !ok {
+		if req.ID == nil {
+			return nil
+		}
+		return NewErrorResponse(req.ID, ErrCodeMethodNotFound, "method not found", req.Method)
+	}
+	return handler.ServeMethod(ctx, sess, req)
+}
+
+// Dispatcher is a SessionHandler which reads JSON-RPC requests from
+// a session line by line, and dispatches each of them to Handler.
+//
+// Requests are served one after another unless MaxConcurrent is set. The
+// number of requests served at the same time may further be limited
+// across all the sessions of the dispatcher, in total and by method.
+// Requests waiting for a limit are cancelled with their session.
+//
+// Requests are served apart from the read loop of the session, so that a
+// CancelRequestMethod notification is read meanwhile. It cancels the
+// context of the matching request waiting or in progress, which is then
+// responded with ErrCodeCancelled.
+type Dispatcher struct {
+	// Handler handles every request read from the session
+	Handler MethodHandler
+
+	// MaxConcurrent is the maximum number of requests served at the same
+	// time on a session, each in its own goroutine. Reading the session
+	// pauses once reached and another request is read. Zero serves the
+	// requests one after another.
+	MaxConcurrent int
+
+	// GlobalMaxConcurrent is the maximum number of requests served at the
+	// same time across all the sessions. Zero means no limit.
+	GlobalMaxConcurrent int
+
+	// MethodMaxConcurrent maps method names to the maximum number of their
+	// requests served at the same time across all the sessions.
+	MethodMaxConcurrent map[string]int
+
+	// Sequential lists the methods whose requests are served one after
+	// another, in the order received on a session, despite MaxConcurrent
+	Sequential []string
+
+	limitsOnce sync.Once
+	limits     *concurrencyLimits
+}
+
+// HandleSession writes the response header, if not already written, then
+// serves requests on the session until the connection is closed or the
+// session context is done. Requests in progress are completed before it
+// returns.
+func (d *Dispatcher) HandleSession(sess *Session) {
+	if !sess.headerSent {
+		sess.WriteResponseHeader(http.StatusOK)
+	}
+
+	ctx := sess.context()
+	s := d.newSessionDispatch(sess)
+	defer s.wg.Wait()
+	for ctx.Err() == nil {
+		line, err := sess.readLine()
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			d.dispatch(ctx, s, line)
+		}
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				sess.logger().Debug("Reading request failed", "error", err)
+			}
+			if ctx.Err() != nil {
+				err = context.Cause(ctx)
+			}
+			sess.terminate(err)
+			return
+		}
+	}
+	sess.terminate(context.Cause(ctx))
+}
+
+// dispatch decodes a single request line and serves it in its own
+// goroutine
+func (d *Dispatcher) dispatch(ctx context.Context, s *sessionDispatch, line []byte) {
+	sess := s.sess
+	var req JSONRPCRequest
+	if err := json.Unmarshal(line, &req); err != nil {
+		sess.logger().Debug("Decoding request failed", "error", err)
+		// responded in turn, after the requests served one after another
+		if s.slots.acquire(ctx) == nil {
+			d.respond(sess, NewErrorResponse(nil, ErrCodeParseError, "parse error", nil))
+			s.slots.release()
+		}
+		return
+	}
+	if req.Method == "" && isResponseLine(line) {
+		sess.logger().Debug("Discarding response", "line", string(line))
+		return
+	}
+	if req.Method == CancelRequestMethod && req.ID == nil {
+		s.cancelRequest(req.Params)
+		return
+	}
+	// the timeout counts the time waiting for the limits
+	ctx, cancel := withRequestTimeout(ctx, &req)
+	err := s.start(ctx, &req, d.isSequential(req.Method), func(ctx context.Context) {
+		defer cancel()
+		d.serve(ctx, sess, &req)
+	})
+	if err != nil {
+		cancel()
+		d.giveUp(sess, &req, err)
+	}
+}
+
+// serve serves the request within the limits of the dispatcher and writes
+// the handler response back to the session
+func (d *Dispatcher) serve(ctx context.Context, sess *Session, req *JSONRPCRequest) {
+	release, err := d.concurrencyLimits().acquire(ctx, req.Method)
+	if err != nil {
+		d.giveUp(sess, req, err)
+		return
+	}
+	defer release()
+
+	resp := serveRequest(ctx, d.Handler, sess, req)
+	if req.ID != nil && errors.Is(context.Cause(ctx), errRequestCancelled) {
+		resp = NewErrorResponse(req.ID, ErrCodeCancelled, "request cancelled", nil)
+	}
+	if resp != nil {
+		d.respond(sess, resp)
+	}
+}
+
+// giveUp responds to the request given up while waiting for a limit,
+// unless its session ended
+func (d *Dispatcher) giveUp(sess *Session, req *JSONRPCRequest, err error) {
+	sess.logger().Debug("Waiting for concurrency limit failed", "method", req.Method, "error", err)
+	switch {
+	case req.ID == nil:
+	case errors.Is(err, errRequestCancelled):
+		d.respond(sess, NewErrorResponse(req.ID, ErrCodeCancelled, "request cancelled", nil))
+	case errors.Is(err, errRequestTimeout):
+		d.respond(sess, NewErrorResponse(req.ID, ErrCodeTimeout, "request timeout", nil))
+	}
+}
+
+// respond writes the response to the session, logging any failure
+func (d *Dispatcher) respond(sess *Session, resp *JSONRPCResponse) {
+	if err := sess.WriteResponse(resp); err != nil {
+		sess.logger().Debug("Writing response failed", "error", err)
+	}
+}
+
+// withRequestTimeout returns a copy of the context expiring after the
+// timeout of the request, if any, with errRequestTimeout as cause
+func withRequestTimeout(ctx context.Context, req *JSONRPCRequest) (context.Context, context.CancelFunc) {
+	if req.Timeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeoutCause(ctx, time.Duration(req.Timeout)*time.Millisecond, errRequestTimeout)
+}
+
+// serveRequest passes a decoded request to the handler and completes the
+// response with the request ID and the protocol version. The request is
+// responded with ErrCodeTimeout if the context expired for the timeout of
+// the request (see withRequestTimeout). It returns nil if there is nothing
+// to respond.
+func serveRequest(ctx context.Context, handler MethodHandler, sess *Session, req *JSONRPCRequest) *JSONRPCResponse {
+	if req.Method == "" {
+		return NewErrorResponse(req.ID, ErrCodeInvalidRequest, "invalid request", nil)
+	}
+
+	resp := handler.ServeMethod(contextWithProgress(ctx, sess, req), sess, req)
+	if req.ID == nil {
+		return nil
+	}
+	if errors.Is(context.Cause(ctx), errRequestTimeout) {
+		return NewErrorResponse(req.ID, ErrCodeTimeout, "request timeout", nil)
+	}
+	if resp == nil {
+		return nil
+	}
+	if resp.ID == nil {
+		resp.ID = req.ID
+	}
+	if resp.Version == "" {
+		resp.Version = JSONRPCVersion
+	}
+	return resp
+}
@@ -0,0 +1,254 @@
+package jsonrps_test
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/yookoala/jsonrps"
+)
+
+// echoHandler responds with the request params as result
+var echoHandler = jsonrps.MethodHandlerFunc(func(ctx context.Context, sess *jsonrps.Session, req *jsonrps.JSONRPCRequest) *jsonrps.JSONRPCResponse {
+	return &jsonrps.JSONRPCResponse{
+		Version: jsonrps.JSONRPCVersion,
+		ID:      req.ID,
+		Result:  req.Params,
+	}
+})
+
+// decodeResponses decodes the JSON lines written after the response header
+func decodeResponses(t *testing.T, written string) []*jsonrps.JSONRPCResponse {
+	t.Helper()
+	_, body, found := strings.Cut(written, "\r\n\r\n")
+	if !found {
+		t.Fatalf("Expected response header in output %q", written)
+	}
+	var responses []*jsonrps.JSONRPCResponse
+	for _, line := range strings.Split(strings.TrimSpace(body), "\n") {
+		if line == "" {
+			continue
+		}
+		var resp jsonrps.JSONRPCResponse
+		if err := json.Unmarshal([]byte(line), &resp); err != nil {
+			t.Fatalf("Failed to decode response line %q: %v", line, err)
+		}
+		responses = append(responses, &resp)
+	}
+	return responses
+}
+
+func TestMethodMux_ServeMethod(t *testing.T) {
+	mux := jsonrps.NewMethodMux()
+	mux.Handle("echo", echoHandler)
+
+	resp := mux.ServeMethod(context.Background(), nil, &jsonrps.JSONRPCRequest{
+		Version: "2.0",
+		Method:  "echo",
+		Params:  json.RawMessage(`[1,2]`),
+		ID:      1,
+	})
+	if resp == nil || string(resp.Result) != `[1,2]` {
+		t.Errorf("Expected echoed params, got %#v", resp)
+	}
+
+	resp = mux.ServeMethod(context.Background(), nil, &jsonrps.JSONRPCRequest{
+		Version: "2.0",
+		Method:  "missing",
+		ID:      2,
+	})
+	if resp == nil || resp.Error == nil || resp.Error.Code != jsonrps.ErrCodeMethodNotFound {
+		t.Errorf("Expected method not found error, got %#v", resp)
+	}
+
+	resp = mux.ServeMethod(context.Background(), nil, &jsonrps.JSONRPCRequest{
+		Version: "2.0",
+		Method:  "missing",
+	})
+	if resp != nil {
+		t.Errorf("Expected no response to notification, got %#v", resp)
+	}
+}
+
+func TestMethodMux_Methods(t *testing.T) {
+	var mux jsonrps.MethodMux
+	mux.Handle("b.method", echoHandler)
+	mux.Handle("a.method", echoHandler)
+	mux.Handle("a.method", echoHandler)
+
+	expected := []string{"a.method", "b.method"}
+	if methods := mux.Methods(); !reflect.DeepEqual(methods, expected) {
+		t.Errorf("Expected methods %v, got %v", expected, methods)
+	}
+}
+
+func TestDispatcher_HandleSession(t *testing.T) {
+	mux := jsonrps.NewMethodMux()
+	mux.Handle("echo", echoHandler)
+
+	conn := &mockReadWriteCloser{
+		readData: `{"jsonrpc":"2.0","method":"echo","params":"a","id":1}` + "\n" +
+			"\n" +
+			`{"jsonrpc":"2.0","method":"echo","params":"notified"}` + "\n" +
+			`{"jsonrpc":"2.0","method":"unknown","id":"x"}` + "\n" +
+			`{invalid json}` + "\n" +
+			`{"jsonrpc":"2.0","method":"echo","params":"b","id":2}` + "\n",
+	}
+	session := &jsonrps.Session{
+		Conn:   conn,
+		Logger: newTestLogger(t),
+	}
+
+	dispatcher := &jsonrps.Dispatcher{Handler: mux}
+	dispatcher.HandleSession(session)
+
+	written := conn.writeData.String()
+	if !strings.HasPrefix(written, "RPS/1.0 200 OK\r\n") {
+		t.Errorf("Expected response header, got %q", written)
+	}
+
+	responses := decodeResponses(t, written)
+	if len(responses) != 4 {
+		t.Fatalf("Expected 4 responses, got %d: %q", len(responses), written)
+	}
+	if string(responses[0].Result) != `"a"` {
+		t.Errorf("Expected first result %q, got %s", "a", responses[0].Result)
+	}
+	if responses[1].Error == nil || responses[1].Error.Code != jsonrps.ErrCodeMethodNotFound {
+		t.Errorf("Expected method not found error, got %#v", responses[1])
+	}
+	if responses[2].Error == nil || responses[2].Error.Code != jsonrps.ErrCodeParseError {
+		t.Errorf("Expected parse error, got %#v", responses[2])
+	}
+	if string(responses[3].Result) != `"b"` {
+		t.Errorf("Expected last result %q, got %s", "b", responses[3].Result)
+	}
+}
+
+func TestDispatcher_HandleSession_FillsResponse(t *testing.T) {
+	handler := jsonrps.MethodHandlerFunc(func(ctx context.Context, sess *jsonrps.Session, req *jsonrps.JSONRPCRequest) *jsonrps.JSONRPCResponse {
+		return &jsonrps.JSONRPCResponse{Result: json.RawMessage(`true`)}
+	})
+
+	conn := &mockReadWriteCloser{
+		readData: `{"jsonrpc":"2.0","method":"anything","id":"abc"}` + "\n",
+	}
+	session := &jsonrps.Session{
+		Conn:   conn,
+		Logger: newTestLogger(t),
+	}
+	(&jsonrps.Dispatcher{Handler: handler}).HandleSession(session)
+
+	responses := decodeResponses(t, conn.writeData.String())
+	if len(responses) != 1 {
+		t.Fatalf("Expected 1 response, got %d", len(responses))
+	}
+	if responses[0].Version != jsonrps.JSONRPCVersion {
+		t.Errorf("Expected version %q, got %q", jsonrps.JSONRPCVersion, responses[0].Version)
+	}
+	if responses[0].ID != "abc" {
+		t.Errorf("Expected ID %q, got %v", "abc", responses[0].ID)
+	}
+}
+
+func TestNewResultResponse(t *testing.T) {
+	resp, err := jsonrps.NewResultResponse(7, map[string]int{"sum": 3})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if string(resp.Result) != `{"sum":3}` {
+		t.Errorf("Unexpected result %s", resp.Result)
+	}
+
+	if _, err = jsonrps.NewResultResponse(7, func() {}); err == nil {
+		t.Error("Expected error for unmarshalable result")
+	}
+}
+
+func TestJSONRPCError_Error(t *testing.T) {
+	resp := jsonrps.NewErrorResponse(1, jsonrps.ErrCodeInvalidParams, "invalid params", nil)
+	if resp.Error.Error() != "jsonrpc error -32602: invalid params" {
+		t.Errorf("Unexpected error string %q", resp.Error.Error())
+	}
+}
+
+func TestDispatcher_HandleSession_Timeout(t *testing.T) {
+	mux := jsonrps.NewMethodMux()
+	mux.HandleFunc("wait", func(ctx context.Context, sess *jsonrps.Session, req *jsonrps.JSONRPCRequest) *jsonrps.JSONRPCResponse {
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Second):
+		}
+		resp, _ := jsonrps.NewResultResponse(req.ID, "finished")
+		return resp
+	})
+	mux.HandleFunc("deadline", func(ctx context.Context, sess *jsonrps.Session, req *jsonrps.JSONRPCRequest) *jsonrps.JSONRPCResponse {
+		_, ok := ctx.Deadline()
+		resp, _ := jsonrps.NewResultResponse(req.ID, ok)
+		return resp
+	})
+
+	conn := &mockReadWriteCloser{
+		readData: `{"jsonrpc":"2.0","method":"wait","id":1,"timeout":20}` + "\n" +
+			`{"jsonrpc":"2.0","method":"deadline","id":2,"timeout":1000}` + "\n" +
+			`{"jsonrpc":"2.0","method":"deadline","id":3}` + "\n",
+	}
+	session := &jsonrps.Session{Conn: conn, Logger: newTestLogger(t)}
+
+	start := time.Now()
+	(&jsonrps.Dispatcher{Handler: mux}).HandleSession(session)
+	if elapsed := time.Since(start); elapsed >= time.Second {
+		t.Errorf("Expected handler context to expire after the timeout, took %v", elapsed)
+	}
+
+	responses := decodeResponses(t, conn.writeData.String())
+	if len(responses) != 3 {
+		t.Fatalf("Expected 3 responses, got %d", len(responses))
+	}
+	if responses[0].Error == nil || responses[0].Error.Code != jsonrps.ErrCodeTimeout {
+		t.Errorf("Expected timeout error, got %#v", responses[0])
+	}
+	if string(responses[1].Result) != "true" || string(responses[2].Result) != "false" {
+		t.Errorf("Expected deadline only with timeout, got %s and %s", responses[1].Result, responses[2].Result)
+	}
+}
+
+func TestDispatcher_HandleSession_QueuedTimeout(t *testing.T) {
+	var served atomic.Int32
+	mux := jsonrps.NewMethodMux()
+	mux.HandleFunc("slow", func(ctx context.Context, sess *jsonrps.Session, req *jsonrps.JSONRPCRequest) *jsonrps.JSONRPCResponse {
+		time.Sleep(100 * time.Millisecond)
+		resp, _ := jsonrps.NewResultResponse(req.ID, "finished")
+		return resp
+	})
+	mux.HandleFunc("count", func(ctx context.Context, sess *jsonrps.Session, req *jsonrps.JSONRPCRequest) *jsonrps.JSONRPCResponse {
+		served.Add(1)
+		resp, _ := jsonrps.NewResultResponse(req.ID, "counted")
+		return resp
+	})
+
+	// the timeout of the second request expires while the first is served
+	conn := &mockReadWriteCloser{
+		readData: `{"jsonrpc":"2.0","method":"slow","id":1}` + "\n" +
+			`{"jsonrpc":"2.0","method":"count","id":2,"timeout":20}` + "\n",
+	}
+	session := &jsonrps.Session{Conn: conn, Logger: newTestLogger(t)}
+	(&jsonrps.Dispatcher{Handler: mux}).HandleSession(session)
+
+	responses := decodeResponses(t, conn.writeData.String())
+	if len(responses) != 2 {
+		t.Fatalf("Expected 2 responses, got %d", len(responses))
+	}
+	for _, resp := range responses {
+		if resp.ID == float64(2) && (resp.Error == nil || resp.Error.Code != jsonrps.ErrCodeTimeout) {
+			t.Errorf("Expected timeout error, got %#v", resp)
+		}
+	}
+	if n := served.Load(); n != 0 {
+		t.Errorf("Expected the timed out request not to be served, served %d", n)
+	}
+}
@@ -0,0 +1,143 @@
+package jsonrps
+
+import (
+	"context"
+	"log/slog"
+	"runtime/debug"
+	"time"
+)
+
+// Middleware wraps a MethodHandler with cross-cutting logic (e.g. logging,
+// recovery, timing or authorization) around method dispatch.
+//
+// [AccessPolicy.Wrap] is a Middleware.
+type Middleware func(next MethodHandler) MethodHandler
+
+// Chain wraps the handler with the middlewares. The first middleware
+// is the outermost one, which sees the request first and the response
+// last.
+func Chain(handler MethodHandler, middlewares ...Middleware) MethodHandler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+	return handler
+}
+
+// RecoverMiddleware recovers panics in the handlers it wraps. The panic
+// is logged to Session.Logger with the stack trace, and the request is
+// responded with ErrCodeInternalError.
+func RecoverMiddleware(next MethodHandler) MethodHandler {
+	return MethodHandlerFunc(func(ctx context.Context, sess *Session, req *JSONRPCRequest) (resp *JSONRPCResponse) {
+		defer func() {
+			if r := recover(); r != nil {
+				sessionLogger(sess).Error("Method handler panic",
+					"method", req.Method,
+					"id", req.ID,
+					"panic", r,
+					"stack", string(debug.Stack()))
+				resp = nil
+				if req.ID != nil {
+					resp = NewErrorResponse(req.ID, ErrCodeInternalError, "internal error", nil)
+				}
+			}
+		}()
+		return next.ServeMethod(ctx, sess, req)
+	})
+}
+
+// LogMiddleware logs every method call to Session.Logger, with the method,
+// the request ID, the time taken and the error code of the response, if any.
+func LogMiddleware(next MethodHandler) MethodHandler {
+	return MethodHandlerFunc(func(ctx context.Context, sess *Session, req *JSONRPCRequest) *JSONRPCResponse {
+		start := time.Now()
+		resp := next.ServeMethod(ctx, sess, req)
+
+		attrs := []slog.Attr{
+			slog.String("method", req.Method),
+			slog.Any("id", req.ID),
+			slog.Duration("duration", time.Since(start)),
+		}
+		level := slog.LevelInfo
+		if resp != nil && resp.Error != nil {
+			attrs = append(attrs, slog.Int("error", resp.Error.Code))
+			level = slog.LevelWarn
+		}
+		sessionLogger(sess).LogAttrs(ctx, level, "Method call", attrs...)
+		return resp
+	})
+}
+
+// sessionLogger returns the logger of the session, which might be nil
+func sessionLogger(sess *Session) *slog.Logger {
+	if sess == nil {
+		return slog.Default()
+	}
+	return sess.logger()
+}
+
+// SessionHandlerFunc is an adapter to allow the use of ordinary functions
+// as SessionHandler.
+type SessionHandlerFunc func(session *Session)
+
+// HandleSession calls f(session)
+func (f SessionHandlerFunc) HandleSession(session *Session) {
+	f(session)
+}
+
+// SessionMiddleware wraps a SessionHandler with code running before and
+// after the whole session is handled.
+//
+// Code before the next handler may modify Session.LocalHeaders, which are
+// sent with the response header by the next handler. Code after the next
+// handler may inspect the termination reason with [Session.Err].
+type SessionMiddleware func(next SessionHandler) SessionHandler
+
+// ChainSession wraps the session handler with the middlewares. The first
+// middleware is the outermost one.
+func ChainSession(handler SessionHandler, middlewares ...SessionMiddleware) SessionHandler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+	return handler
+}
+
+// SessionLogMiddleware logs the start and the end of every session to
+// Session.Logger, with the session duration and termination reason.
+func SessionLogMiddleware(next SessionHandler) SessionHandler {
+	return SessionHandlerFunc(func(sess *Session) {
+		start := time.Now()
+		sess.logger().Info("Session started", "method", sess.Method)
+		next.HandleSession(sess)
+
+		reason := "returned"
+		if err := sess.Err(); err != nil {
+			reason = err.Error()
+		}
+		sess.logger().Info("Session ended",
+			"method", sess.Method,
+			"duration", time.Since(start),
+			"reason", reason)
+	})
+}
+
+// sessionMiddlewareHandler is a ServerSessionHandler which wraps the
+// handling, but not the matching, of sessions with middlewares
+type sessionMiddlewareHandler struct {
+	ServerSessionHandler
+	handler SessionHandler
+}
+
+// HandleSession handles the session with the middleware chain
+func (h *sessionMiddlewareHandler) HandleSession(session *Session) {
+	h.handler.HandleSession(session)
+}
+
+// WithMiddlewares returns a ServerSessionHandler which routes sessions
+// like the router, wrapping the handling of every routed session with
+// the middlewares. The first middleware is the outermost one.
+func (r ServerSessionRouter) WithMiddlewares(middlewares ...SessionMiddleware) ServerSessionHandler {
+	return &sessionMiddlewareHandler{
+		ServerSessionHandler: r,
+		handler:              ChainSession(r, middlewares...),
+	}
+}
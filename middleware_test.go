@@ -0,0 +1,274 @@
+package jsonrps_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/yookoala/jsonrps"
+)
+
+// recordingMiddleware appends its name to the log before and after
+// calling the next handler
+func recordingMiddleware(name string, log *[]string) jsonrps.Middleware {
+	return func(next jsonrps.MethodHandler) jsonrps.MethodHandler {
+		return jsonrps.MethodHandlerFunc(func(ctx context.Context, sess *jsonrps.Session, req *jsonrps.JSONRPCRequest) *jsonrps.JSONRPCResponse {
+			*log = append(*log, "before "+name)
+			resp := next.ServeMethod(ctx, sess, req)
+			*log = append(*log, "after "+name)
+			return resp
+		})
+	}
+}
+
+func TestChain_Order(t *testing.T) {
+	var log []string
+	handler := jsonrps.Chain(
+		jsonrps.MethodHandlerFunc(func(ctx context.Context, sess *jsonrps.Session, req *jsonrps.JSONRPCRequest) *jsonrps.JSONRPCResponse {
+			log = append(log, "handler")
+			return nil
+		}),
+		recordingMiddleware("a", &log),
+		recordingMiddleware("b", &log),
+	)
+	handler.ServeMethod(context.Background(), nil, &jsonrps.JSONRPCRequest{Method: "test"})
+
+	expected := []string{"before a", "before b", "handler", "after b", "after a"}
+	if !reflect.DeepEqual(log, expected) {
+		t.Errorf("Expected call order %v, got %v", expected, log)
+	}
+}
+
+func TestChain_NoMiddleware(t *testing.T) {
+	handler := jsonrps.Chain(echoHandler)
+	resp := handler.ServeMethod(context.Background(), nil, &jsonrps.JSONRPCRequest{Method: "test", Params: []byte(`1`), ID: 1})
+	if resp == nil || string(resp.Result) != "1" {
+		t.Errorf("Expected handler to be called directly, got %#v", resp)
+	}
+}
+
+func TestRecoverMiddleware(t *testing.T) {
+	var buf bytes.Buffer
+	sess := &jsonrps.Session{Logger: slog.New(slog.NewTextHandler(&buf, nil))}
+
+	handler := jsonrps.Chain(
+		jsonrps.MethodHandlerFunc(func(ctx context.Context, sess *jsonrps.Session, req *jsonrps.JSONRPCRequest) *jsonrps.JSONRPCResponse {
+			panic("boom")
+		}),
+		jsonrps.RecoverMiddleware,
+	)
+
+	resp := handler.ServeMethod(context.Background(), sess, &jsonrps.JSONRPCRequest{Method: "explode", ID: 1})
+	if resp == nil || resp.Error == nil || resp.Error.Code != jsonrps.ErrCodeInternalError {
+		t.Fatalf("Expected internal error response, got %#v", resp)
+	}
+	if resp.ID != 1 {
+		t.Errorf("Expected response ID 1, got %v", resp.ID)
+	}
+	if !strings.Contains(buf.String(), "boom") || !strings.Contains(buf.String(), "method=explode") {
+		t.Errorf("Expected panic to be logged, got %q", buf.String())
+	}
+
+	resp = handler.ServeMethod(context.Background(), sess, &jsonrps.JSONRPCRequest{Method: "explode"})
+	if resp != nil {
+		t.Errorf("Expected no response to notification, got %#v", resp)
+	}
+}
+
+func TestLogMiddleware(t *testing.T) {
+	var buf bytes.Buffer
+	sess := &jsonrps.Session{Logger: slog.New(slog.NewTextHandler(&buf, nil))}
+
+	mux := jsonrps.NewMethodMux()
+	mux.Handle("echo", echoHandler)
+	handler := jsonrps.Chain(mux, jsonrps.LogMiddleware)
+
+	handler.ServeMethod(context.Background(), sess, &jsonrps.JSONRPCRequest{Method: "echo", ID: 1})
+	if line := buf.String(); !strings.Contains(line, "level=INFO") ||
+		!strings.Contains(line, "method=echo") ||
+		!strings.Contains(line, "id=1") ||
+		!strings.Contains(line, "duration=") {
+		t.Errorf("Unexpected log output %q", line)
+	}
+
+	buf.Reset()
+	handler.ServeMethod(context.Background(), sess, &jsonrps.JSONRPCRequest{Method: "missing", ID: 2})
+	if line := buf.String(); !strings.Contains(line, "level=WARN") || !strings.Contains(line, "error=-32601") {
+		t.Errorf("Unexpected log output %q", line)
+	}
+}
+
+func TestAccessPolicy_AsMiddleware(t *testing.T) {
+	policy, err := jsonrps.NewAccessPolicy(jsonrps.AccessRule{Methods: []string{"public.*"}})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	handler := jsonrps.Chain(echoHandler, jsonrps.RecoverMiddleware, policy.Wrap)
+
+	resp := handler.ServeMethod(context.Background(), nil, &jsonrps.JSONRPCRequest{Method: "private.get", ID: 1})
+	if resp == nil || resp.Error == nil || resp.Error.Code != jsonrps.ErrCodeForbidden {
+		t.Errorf("Expected forbidden error, got %#v", resp)
+	}
+}
+
+func TestChainSession_Order(t *testing.T) {
+	var log []string
+	middleware := func(name string) jsonrps.SessionMiddleware {
+		return func(next jsonrps.SessionHandler) jsonrps.SessionHandler {
+			return jsonrps.SessionHandlerFunc(func(sess *jsonrps.Session) {
+				log = append(log, "before "+name)
+				next.HandleSession(sess)
+				log = append(log, "after "+name)
+			})
+		}
+	}
+	handler := jsonrps.ChainSession(
+		jsonrps.SessionHandlerFunc(func(sess *jsonrps.Session) {
+			log = append(log, "handler")
+		}),
+		middleware("a"),
+		middleware("b"),
+	)
+	handler.HandleSession(&jsonrps.Session{})
+
+	expected := []string{"before a", "before b", "handler", "after b", "after a"}
+	if !reflect.DeepEqual(log, expected) {
+		t.Errorf("Expected call order %v, got %v", expected, log)
+	}
+}
+
+func TestSessionMiddleware_HeadersAndTermination(t *testing.T) {
+	var reason error
+	middleware := func(next jsonrps.SessionHandler) jsonrps.SessionHandler {
+		return jsonrps.SessionHandlerFunc(func(sess *jsonrps.Session) {
+			sess.LocalHeaders.Set("X-Session-ID", "abc")
+			next.HandleSession(sess)
+			reason = sess.Err()
+		})
+	}
+
+	conn := &mockReadWriteCloser{
+		readData: `{"jsonrpc":"2.0","method":"echo","params":1,"id":1}` + "\n",
+	}
+	sess := &jsonrps.Session{
+		LocalHeaders: http.Header{},
+		Conn:         conn,
+		Logger:       newTestLogger(t),
+	}
+	mux := jsonrps.NewMethodMux()
+	mux.Handle("echo", echoHandler)
+
+	jsonrps.ChainSession(&jsonrps.Dispatcher{Handler: mux}, middleware).HandleSession(sess)
+
+	if !strings.HasPrefix(conn.writeData.String(), "RPS/1.0 200 OK\r\nX-Session-Id: abc\r\n\r\n") {
+		t.Errorf("Expected header set by middleware, got %q", conn.writeData.String())
+	}
+	if !errors.Is(reason, io.EOF) {
+		t.Errorf("Expected termination reason io.EOF, got %v", reason)
+	}
+}
+
+func TestSession_Err(t *testing.T) {
+	sess := &jsonrps.Session{Conn: &mockReadWriteCloser{}}
+	if err := sess.Err(); err != nil {
+		t.Errorf("Expected no error for active session, got %v", err)
+	}
+	sess.Close()
+	if err := sess.Err(); !errors.Is(err, jsonrps.ErrSessionClosed) {
+		t.Errorf("Expected ErrSessionClosed, got %v", err)
+	}
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+	cause := errors.New("shutting down")
+	cancel(cause)
+	sess = &jsonrps.Session{
+		Context: ctx,
+		Conn:    &mockReadWriteCloser{},
+		Logger:  newTestLogger(t),
+	}
+	(&jsonrps.Dispatcher{Handler: echoHandler}).HandleSession(sess)
+	if err := sess.Err(); !errors.Is(err, cause) {
+		t.Errorf("Expected context cause, got %v", err)
+	}
+}
+
+func TestSessionLogMiddleware(t *testing.T) {
+	var buf bytes.Buffer
+	sess := &jsonrps.Session{
+		Method: "GET",
+		Conn:   &mockReadWriteCloser{},
+		Logger: slog.New(slog.NewTextHandler(&buf, nil)),
+	}
+	jsonrps.ChainSession(&jsonrps.Dispatcher{Handler: echoHandler}, jsonrps.SessionLogMiddleware).HandleSession(sess)
+
+	output := buf.String()
+	if !strings.Contains(output, `msg="Session started" method=GET`) {
+		t.Errorf("Expected session start log, got %q", output)
+	}
+	if !strings.Contains(output, `msg="Session ended" method=GET duration=`) || !strings.Contains(output, "reason=EOF") {
+		t.Errorf("Expected session end log, got %q", output)
+	}
+}
+
+func TestServerSessionRouter_WithMiddlewares(t *testing.T) {
+	var called bool
+	middleware := func(next jsonrps.SessionHandler) jsonrps.SessionHandler {
+		return jsonrps.SessionHandlerFunc(func(sess *jsonrps.Session) {
+			called = true
+			next.HandleSession(sess)
+		})
+	}
+
+	handler := &mockServerSessionHandler{canHandle: true}
+	router := jsonrps.ServerSessionRouter{handler}.WithMiddlewares(middleware)
+
+	sess := &jsonrps.Session{}
+	if !router.CanHandleSession(sess) {
+		t.Error("Expected router to handle session")
+	}
+	router.HandleSession(sess)
+	if !called || !handler.handleSessionCalled {
+		t.Errorf("Expected middleware (%v) and handler (%v) to be called", called, handler.handleSessionCalled)
+	}
+
+	handler.canHandle = false
+	if router.CanHandleSession(sess) {
+		t.Error("Expected router not to handle session")
+	}
+}
+
+func TestServer_SessionMiddlewares(t *testing.T) {
+	reasons := make(chan error, 1)
+	middleware := func(next jsonrps.SessionHandler) jsonrps.SessionHandler {
+		return jsonrps.SessionHandlerFunc(func(sess *jsonrps.Session) {
+			sess.LocalHeaders.Set("X-Served-By", "test")
+			next.HandleSession(sess)
+			reasons <- sess.Err()
+		})
+	}
+
+	addr := startTestServer(t, &jsonrps.Server{
+		Handler:            &jsonrps.Dispatcher{Handler: echoHandler},
+		SessionMiddlewares: []jsonrps.SessionMiddleware{middleware},
+		Logger:             newTestLogger(t),
+	})
+
+	sess, err := jsonrps.Dial("tcp", addr, "GET")
+	if err != nil {
+		t.Fatalf("Unexpected dial error: %v", err)
+	}
+	if sess.RemoteHeaders.Get("X-Served-By") != "test" {
+		t.Errorf("Expected header set by middleware, got %v", sess.RemoteHeaders)
+	}
+	sess.Close()
+
+	if reason := <-reasons; !errors.Is(reason, io.EOF) {
+		t.Errorf("Expected termination reason io.EOF, got %v", reason)
+	}
+}
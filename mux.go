@@ -0,0 +1,552 @@
+package jsonrps
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+)
+
+// DefaultMuxWindowSize is the default number of bytes a stream of a
+// multiplexed connection may receive before the reader consumes them
+const DefaultMuxWindowSize = 256 << 10
+
+const (
+	// muxHeaderSize is the size of a frame header: the frame type (1 byte),
+	// the stream ID (4 bytes) and the payload length (4 bytes)
+	muxHeaderSize = 9
+
+	// muxMaxPayloadSize is the maximum payload length of a frame
+	muxMaxPayloadSize = 16 << 10
+)
+
+// Frame types of multiplexed connections
+const (
+	// muxFrameOpen opens a stream. The payload is the receive window of
+	// the opener.
+	muxFrameOpen byte = iota + 1
+
+	// muxFrameData carries stream data
+	muxFrameData
+
+	// muxFrameWindow grants the sender more bytes of the stream window. The
+	// payload is the increment.
+	muxFrameWindow
+
+	// muxFrameClose closes the stream. The receiver reads io.EOF once the
+	// received data are read.
+	muxFrameClose
+)
+
+// ErrMuxClosed is the error of the streams of a closed multiplexed connection
+var ErrMuxClosed = errors.New("jsonrps: multiplexed connection closed")
+
+// errMuxProtocol is the error of a multiplexed connection on which an
+// invalid frame was received
+var errMuxProtocol = errors.New("jsonrps: multiplexing protocol error")
+
+// MuxConfig contains options for the both sides of multiplexed connections
+type MuxConfig struct {
+	// WindowSize is the number of bytes each stream may receive before
+	// its reader consumes them, which limits the memory used by slow
+	// sessions. DefaultMuxWindowSize is used if zero.
+	WindowSize int
+
+	// Logger is used for the multiplexed sessions. The default logger is
+	// used if nil.
+	Logger *slog.Logger
+}
+
+// MuxServer serves multiple logical sessions multiplexed over a single
+// connection by a MuxClient. Each session is carried by a stream of the
+// connection with its own request header and flow control, and is served
+// as an ordinary Session with its own ID, headers and Context.
+type MuxServer struct {
+	// Handler handles every session. If it implements ServerSessionHandler,
+	// sessions it cannot handle are responded with 404 Not Found.
+	Handler SessionHandler
+
+	// SessionMiddlewares wrap Handler for every session it can handle.
+	// The first middleware is the outermost one.
+	SessionMiddlewares []SessionMiddleware
+
+	MuxConfig
+}
+
+// ServeConn serves the sessions multiplexed over the connection until the
+// connection is closed or the context is done. It closes the connection,
+// and returns once all the sessions are handled.
+//
+// It returns nil on a clean end: the context being done, or reading the
+// connection failing with io.EOF, or with io.ErrClosedPipe as the
+// in-memory connections of NewSessionPair do once closed. Any other read
+// error is returned, including the ones of a connection closed locally
+// (e.g. net.ErrClosed), which the caller may check for with errors.Is.
+func (srv *MuxServer) ServeConn(ctx context.Context, conn io.ReadWriteCloser) error {
+	m := newMuxConn(conn, &srv.MuxConfig)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stop := context.AfterFunc(ctx, func() {
+		m.fail(ErrMuxClosed)
+	})
+	defer stop()
+
+	var wg sync.WaitGroup
+	m.accept = func(stream *muxStream) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			srv.serveStream(ctx, m, stream)
+		}()
+	}
+	err := m.readLoop()
+	cancel()
+	wg.Wait()
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrClosedPipe) || errors.Is(err, ErrMuxClosed) {
+		return nil
+	}
+	return err
+}
+
+// HandleSession responds to the session and serves the sessions
+// multiplexed over its connection, so that a MuxServer can be routed by
+// a Server. The transport of the session must carry bytes as is, which
+// excludes WebSocket.
+func (srv *MuxServer) HandleSession(sess *Session) {
+	sess.WriteResponseHeader(http.StatusOK)
+	if err := srv.ServeConn(sess.context(), sessionConn{sess}); err != nil {
+		sess.logger().Debug("Serving multiplexed sessions failed", "error", err)
+		sess.terminate(err)
+	}
+}
+
+// serveStream reads the request header of the stream and serves its session
+func (srv *MuxServer) serveStream(ctx context.Context, m *muxConn, stream *muxStream) {
+	defer stream.Close()
+	sess := &Session{
+		ID:           newSessionID(),
+		LocalHeaders: make(http.Header),
+		Conn:         stream,
+		Logger:       m.logger,
+	}
+	if err := sess.ReadRequestHeader(); err != nil {
+		m.logger.Debug("Reading request header failed", "stream", stream.id, "error", err)
+		return
+	}
+	serveSession(ctx, srv.Handler, srv.SessionMiddlewares, sess, m.logger)
+}
+
+// MuxClient opens multiple logical sessions to a MuxServer over a single
+// connection
+type MuxClient struct {
+	mux    *muxConn
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+}
+
+// NewMuxClient creates a client multiplexing sessions over the connection.
+// The connection may be the Conn of an established session handled by a
+// MuxServer. A nil config uses the defaults.
+func NewMuxClient(conn io.ReadWriteCloser, config *MuxConfig) *MuxClient {
+	if config == nil {
+		config = &MuxConfig{}
+	}
+	c := &MuxClient{mux: newMuxConn(conn, config)}
+	c.ctx, c.cancel = context.WithCancelCause(context.Background())
+	go func() {
+		c.cancel(c.mux.readLoop())
+	}()
+	return c
+}
+
+// DialContext opens a stream, requests the method with the headers and
+// returns the established session. The context only limits the header
+// exchange. The Context of the session is cancelled once the multiplexed
+// connection is closed.
+func (c *MuxClient) DialContext(ctx context.Context, method string, headers http.Header) (*Session, error) {
+	stream, err := c.mux.open()
+	if err != nil {
+		return nil, err
+	}
+	sess := &Session{
+		ID:           newSessionID(),
+		LocalHeaders: headers.Clone(),
+		Context:      c.ctx,
+		Conn:         stream,
+	}
+	if sess.LocalHeaders == nil {
+		sess.LocalHeaders = make(http.Header)
+	}
+	sess.Logger = c.mux.logger.With("session", sess.ID)
+
+	stop := context.AfterFunc(ctx, func() {
+		stream.Close()
+	})
+	defer stop()
+
+	sess.WriteRequestHeader(method)
+	if err = sess.ReadResponseHeader(); err != nil {
+		stream.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	if !stop() {
+		return nil, ctx.Err()
+	}
+
+	if sess.StatusCode != http.StatusOK {
+		stream.Close()
+		return nil, fmt.Errorf("jsonrps: server responded %d %s", sess.StatusCode, http.StatusText(sess.StatusCode))
+	}
+	return sess, nil
+}
+
+// Close closes the multiplexed connection and all its sessions
+func (c *MuxClient) Close() error {
+	return c.mux.fail(ErrMuxClosed)
+}
+
+// muxConn is a connection carrying multiple streams
+type muxConn struct {
+	conn   io.ReadWriteCloser
+	window uint32
+	logger *slog.Logger
+
+	// accept, if set, is called with the streams opened by the other side
+	accept func(stream *muxStream)
+
+	writeMu sync.Mutex // serializes frame writes
+
+	mu      sync.Mutex // protects the fields below
+	streams map[uint32]*muxStream
+	nextID  uint32
+	err     error
+}
+
+// newMuxConn creates a multiplexed connection with the config
+func newMuxConn(conn io.ReadWriteCloser, config *MuxConfig) *muxConn {
+	window := config.WindowSize
+	if window <= 0 {
+		window = DefaultMuxWindowSize
+	}
+	logger := config.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return &muxConn{
+		conn:    conn,
+		window:  uint32(window),
+		logger:  logger,
+		streams: make(map[uint32]*muxStream),
+	}
+}
+
+// writeFrame writes a frame to the connection
+func (m *muxConn) writeFrame(frameType byte, id uint32, payload []byte) error {
+	frame := make([]byte, muxHeaderSize+len(payload))
+	frame[0] = frameType
+	binary.BigEndian.PutUint32(frame[1:5], id)
+	binary.BigEndian.PutUint32(frame[5:9], uint32(len(payload)))
+	copy(frame[muxHeaderSize:], payload)
+
+	m.writeMu.Lock()
+	defer m.writeMu.Unlock()
+	if _, err := m.conn.Write(frame); err != nil {
+		return m.fail(err)
+	}
+	return nil
+}
+
+// writeUint32 writes a frame with the number as payload
+func (m *muxConn) writeUint32(frameType byte, id uint32, n uint32) error {
+	return m.writeFrame(frameType, id, binary.BigEndian.AppendUint32(nil, n))
+}
+
+// open opens a new stream to the other side
+func (m *muxConn) open() (*muxStream, error) {
+	m.mu.Lock()
+	if m.err != nil {
+		m.mu.Unlock()
+		return nil, m.err
+	}
+	m.nextID++
+	stream := newMuxStream(m, m.nextID, 0)
+	m.streams[stream.id] = stream
+	m.mu.Unlock()
+
+	if err := m.writeUint32(muxFrameOpen, stream.id, m.window); err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
+
+// stream returns the open stream of the ID, if any
+func (m *muxConn) stream(id uint32) *muxStream {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.streams[id]
+}
+
+// remove removes the stream from the connection
+func (m *muxConn) remove(stream *muxStream) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.streams, stream.id)
+}
+
+// readLoop reads and dispatches the frames until the connection fails
+func (m *muxConn) readLoop() error {
+	header := make([]byte, muxHeaderSize)
+	for {
+		if _, err := io.ReadFull(m.conn, header); err != nil {
+			return m.fail(err)
+		}
+		frameType := header[0]
+		id := binary.BigEndian.Uint32(header[1:5])
+		length := binary.BigEndian.Uint32(header[5:9])
+		if length > muxMaxPayloadSize {
+			return m.fail(errMuxProtocol)
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(m.conn, payload); err != nil {
+			return m.fail(err)
+		}
+
+		switch frameType {
+		case muxFrameOpen:
+			if m.accept == nil || len(payload) != 4 {
+				return m.fail(errMuxProtocol)
+			}
+			m.mu.Lock()
+			if m.streams[id] != nil || m.err != nil {
+				m.mu.Unlock()
+				return m.fail(errMuxProtocol)
+			}
+			stream := newMuxStream(m, id, binary.BigEndian.Uint32(payload))
+			m.streams[id] = stream
+			m.mu.Unlock()
+			if err := m.writeUint32(muxFrameWindow, id, m.window); err != nil {
+				return err
+			}
+			m.accept(stream)
+		case muxFrameData:
+			if stream := m.stream(id); stream != nil && !stream.receive(payload) {
+				return m.fail(errMuxProtocol)
+			}
+		case muxFrameWindow:
+			if len(payload) != 4 {
+				return m.fail(errMuxProtocol)
+			}
+			if stream := m.stream(id); stream != nil {
+				stream.grant(binary.BigEndian.Uint32(payload))
+			}
+		case muxFrameClose:
+			if stream := m.stream(id); stream != nil {
+				stream.remoteClose()
+			}
+		default:
+			return m.fail(errMuxProtocol)
+		}
+	}
+}
+
+// fail closes the connection and all its streams with the error. It
+// returns the first error the connection failed with.
+func (m *muxConn) fail(err error) error {
+	m.mu.Lock()
+	if m.err != nil {
+		err = m.err
+		m.mu.Unlock()
+		return err
+	}
+	m.err = err
+	streams := m.streams
+	m.streams = make(map[uint32]*muxStream)
+	m.mu.Unlock()
+
+	m.conn.Close()
+	for _, stream := range streams {
+		stream.fail(err)
+	}
+	return err
+}
+
+// muxStream is a stream of a multiplexed connection, carrying a session
+type muxStream struct {
+	mux *muxConn
+	id  uint32
+
+	mu           sync.Mutex
+	cond         *sync.Cond
+	buf          bytes.Buffer
+	sendWindow   uint32 // bytes the other side can receive
+	consumed     uint32 // bytes read since the last window update
+	localClosed  bool
+	remoteClosed bool
+	err          error
+}
+
+// newMuxStream creates a stream which may send the window bytes
+func newMuxStream(m *muxConn, id uint32, window uint32) *muxStream {
+	stream := &muxStream{mux: m, id: id, sendWindow: window}
+	stream.cond = sync.NewCond(&stream.mu)
+	return stream
+}
+
+// receive buffers the received data. It returns false if the data exceed
+// the receive window.
+func (s *muxStream) receive(p []byte) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.localClosed {
+		return true
+	}
+	if s.buf.Len()+len(p) > int(s.mux.window) {
+		return false
+	}
+	s.buf.Write(p)
+	s.cond.Broadcast()
+	return true
+}
+
+// grant adds the increment to the send window
+func (s *muxStream) grant(increment uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sendWindow += increment
+	s.cond.Broadcast()
+}
+
+// remoteClose marks the stream closed by the other side
+func (s *muxStream) remoteClose() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.remoteClosed = true
+	s.cond.Broadcast()
+}
+
+// fail fails the pending and future reads and writes with the error
+func (s *muxStream) fail(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = err
+	s.cond.Broadcast()
+}
+
+// Read reads the received data. The consumed bytes are granted back to
+// the other side once they reach half of the window.
+func (s *muxStream) Read(p []byte) (int, error) {
+	s.mu.Lock()
+	for s.buf.Len() == 0 && !s.localClosed && !s.remoteClosed && s.err == nil {
+		s.cond.Wait()
+	}
+	switch {
+	case s.localClosed:
+		s.mu.Unlock()
+		return 0, io.ErrClosedPipe
+	case s.buf.Len() > 0:
+	case s.remoteClosed:
+		s.mu.Unlock()
+		return 0, io.EOF
+	default:
+		err := s.err
+		s.mu.Unlock()
+		return 0, err
+	}
+
+	n, _ := s.buf.Read(p)
+	s.consumed += uint32(n)
+	var increment uint32
+	if s.consumed >= s.mux.window/2 {
+		increment, s.consumed = s.consumed, 0
+	}
+	s.mu.Unlock()
+
+	if increment > 0 {
+		s.mux.writeUint32(muxFrameWindow, s.id, increment)
+	}
+	return n, nil
+}
+
+// Write sends the data as frames, waiting for the other side to grant
+// window as needed
+func (s *muxStream) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		s.mu.Lock()
+		for s.sendWindow == 0 && !s.localClosed && !s.remoteClosed && s.err == nil {
+			s.cond.Wait()
+		}
+		if s.localClosed || s.remoteClosed {
+			s.mu.Unlock()
+			return written, io.ErrClosedPipe
+		}
+		if s.err != nil {
+			err := s.err
+			s.mu.Unlock()
+			return written, err
+		}
+		n := min(len(p), int(s.sendWindow), muxMaxPayloadSize)
+		s.sendWindow -= uint32(n)
+		s.mu.Unlock()
+
+		if err := s.mux.writeFrame(muxFrameData, s.id, p[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Close closes the stream on both sides
+func (s *muxStream) Close() error {
+	s.mu.Lock()
+	if s.localClosed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.localClosed = true
+	s.buf.Reset()
+	failed := s.err != nil
+	s.cond.Broadcast()
+	s.mu.Unlock()
+
+	s.mux.remove(s)
+	if failed {
+		return nil
+	}
+	s.mux.writeFrame(muxFrameClose, s.id, nil)
+	return nil
+}
+
+// sessionConn is the connection of a session, read through the buffer
+// of the session so that no data read with the header are lost
+type sessionConn struct {
+	sess *Session
+}
+
+// Read reads from the session connection
+func (c sessionConn) Read(p []byte) (int, error) {
+	if c.sess.reader != nil {
+		return c.sess.reader.Read(p)
+	}
+	return c.sess.Conn.Read(p)
+}
+
+// Write writes to the session connection
+func (c sessionConn) Write(p []byte) (int, error) {
+	return c.sess.Conn.Write(p)
+}
+
+// Close closes the session connection
+func (c sessionConn) Close() error {
+	return c.sess.Conn.Close()
+}
@@ -0,0 +1,198 @@
+package jsonrps_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yookoala/jsonrps"
+)
+
+// tenantHandler responds with the tenant header of the session
+var tenantHandler = jsonrps.MethodHandlerFunc(func(ctx context.Context, sess *jsonrps.Session, req *jsonrps.JSONRPCRequest) *jsonrps.JSONRPCResponse {
+	resp, _ := jsonrps.NewResultResponse(req.ID, sess.RemoteHeaders.Get("X-Tenant")+"@"+sess.Method)
+	return resp
+})
+
+// startTestMux serves a MuxServer over an in-memory pipe until the test ends
+func startTestMux(t *testing.T, srv *jsonrps.MuxServer, config *jsonrps.MuxConfig) *jsonrps.MuxClient {
+	t.Helper()
+	clientConn, serverConn := jsonrps.Pipe(nil, nil)
+	done := make(chan error, 1)
+	go func() {
+		done <- srv.ServeConn(context.Background(), serverConn)
+	}()
+	client := jsonrps.NewMuxClient(clientConn, config)
+	t.Cleanup(func() {
+		client.Close()
+		if err := <-done; err != nil {
+			t.Errorf("Unexpected serve error: %v", err)
+		}
+	})
+	return client
+}
+
+// callTest sends a call on the session and returns the response
+func callTest(t *testing.T, sess *jsonrps.Session, method string, id int) *jsonrps.JSONRPCResponse {
+	t.Helper()
+	err := sess.WriteRequest(&jsonrps.JSONRPCRequest{Version: jsonrps.JSONRPCVersion, Method: method, ID: id})
+	if err != nil {
+		t.Fatalf("Unexpected write error: %v", err)
+	}
+	resp, err := sess.ReadResponse()
+	if err != nil {
+		t.Fatalf("Unexpected read error: %v", err)
+	}
+	return resp
+}
+
+func TestMux_Sessions(t *testing.T) {
+	router := jsonrps.NewSessionRouter(nil)
+	router.HandleMethod("/tenant", &jsonrps.Dispatcher{Handler: tenantHandler})
+	client := startTestMux(t, &jsonrps.MuxServer{
+		Handler:   router,
+		MuxConfig: jsonrps.MuxConfig{Logger: newTestLogger(t)},
+	}, &jsonrps.MuxConfig{Logger: newTestLogger(t)})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	var sessions []*jsonrps.Session
+	for i := 0; i < 3; i++ {
+		sess, err := client.DialContext(ctx, "/tenant", http.Header{"X-Tenant": {fmt.Sprintf("t%d", i)}})
+		if err != nil {
+			t.Fatalf("Unexpected dial error: %v", err)
+		}
+		sessions = append(sessions, sess)
+	}
+	// calls are answered on their own sessions, in any order
+	for i := len(sessions) - 1; i >= 0; i-- {
+		resp := callTest(t, sessions[i], "tenant", i)
+		if want := fmt.Sprintf(`"t%d@/tenant"`, i); string(resp.Result) != want {
+			t.Errorf("Expected result %s, got %s", want, resp.Result)
+		}
+	}
+
+	if _, err := client.DialContext(ctx, "/unknown", nil); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("Expected 404 error, got %v", err)
+	}
+
+	// closing a session leaves the others open
+	sessions[0].Close()
+	if resp := callTest(t, sessions[1], "tenant", 1); resp.Error != nil {
+		t.Errorf("Unexpected error %v", resp.Error)
+	}
+
+	client.Close()
+	select {
+	case <-sessions[1].Context.Done():
+	case <-time.After(time.Second):
+		t.Error("Expected session context to be done once the connection closed")
+	}
+}
+
+func TestMux_FlowControl(t *testing.T) {
+	payload := strings.Repeat("x", 1000)
+	mux := jsonrps.NewMethodMux()
+	mux.HandleFunc("flood", func(ctx context.Context, sess *jsonrps.Session, req *jsonrps.JSONRPCRequest) *jsonrps.JSONRPCResponse {
+		for i := 0; i < 50; i++ {
+			params, _ := json.Marshal(payload)
+			if err := sess.WriteResponse(&jsonrps.JSONRPCResponse{Version: jsonrps.JSONRPCVersion, Method: "data", Params: params}); err != nil {
+				return nil
+			}
+		}
+		return &jsonrps.JSONRPCResponse{ID: req.ID, Result: json.RawMessage(`"done"`)}
+	})
+	mux.Handle("echo", echoHandler)
+
+	config := jsonrps.MuxConfig{WindowSize: 4096, Logger: newTestLogger(t)}
+	client := startTestMux(t, &jsonrps.MuxServer{
+		Handler:   &jsonrps.Dispatcher{Handler: mux},
+		MuxConfig: config,
+	}, &config)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	slow, err := client.DialContext(ctx, "flood", nil)
+	if err != nil {
+		t.Fatalf("Unexpected dial error: %v", err)
+	}
+	fast, err := client.DialContext(ctx, "echo", nil)
+	if err != nil {
+		t.Fatalf("Unexpected dial error: %v", err)
+	}
+
+	// the flood exceeds the window of the slow session, which does not
+	// block the other session
+	slow.WriteRequest(&jsonrps.JSONRPCRequest{Version: jsonrps.JSONRPCVersion, Method: "flood", ID: 1})
+	time.Sleep(50 * time.Millisecond)
+	if resp := callTest(t, fast, "echo", 2); resp.Error != nil {
+		t.Errorf("Unexpected error %v", resp.Error)
+	}
+
+	for i := 0; ; i++ {
+		resp, err := slow.ReadResponse()
+		if err != nil {
+			t.Fatalf("Unexpected read error after %d responses: %v", i, err)
+		}
+		if resp.ID != nil {
+			if i != 50 || string(resp.Result) != `"done"` {
+				t.Errorf("Unexpected final response %#v after %d notifications", resp, i)
+			}
+			break
+		}
+	}
+}
+
+func TestMux_OverServer(t *testing.T) {
+	router := jsonrps.NewSessionRouter(nil)
+	router.HandleMethod("mux", &jsonrps.MuxServer{
+		Handler:   &jsonrps.Dispatcher{Handler: tenantHandler},
+		MuxConfig: jsonrps.MuxConfig{Logger: newTestLogger(t)},
+	})
+	addr := startTestServer(t, &jsonrps.Server{Handler: router, Logger: newTestLogger(t)})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	conn, err := (&jsonrps.Dialer{Logger: newTestLogger(t)}).DialContext(ctx, "tcp", addr, "mux")
+	if err != nil {
+		t.Fatalf("Unexpected dial error: %v", err)
+	}
+	client := jsonrps.NewMuxClient(conn.Conn, &jsonrps.MuxConfig{Logger: newTestLogger(t)})
+	defer client.Close()
+
+	for _, tenant := range []string{"a", "b"} {
+		sess, err := client.DialContext(ctx, "tenant", http.Header{"X-Tenant": {tenant}})
+		if err != nil {
+			t.Fatalf("Unexpected dial error: %v", err)
+		}
+		if resp := callTest(t, sess, "tenant", 1); string(resp.Result) != `"`+tenant+`@tenant"` {
+			t.Errorf("Unexpected result %s", resp.Result)
+		}
+	}
+}
+
+func TestMuxServer_ServeConn_Closed(t *testing.T) {
+	clientConn, serverConn := jsonrps.Pipe(nil, nil)
+	defer clientConn.Close()
+	done := make(chan error, 1)
+	go func() {
+		done <- (&jsonrps.MuxServer{MuxConfig: jsonrps.MuxConfig{Logger: newTestLogger(t)}}).ServeConn(context.Background(), serverConn)
+	}()
+
+	// closing the connection on the server side ends the read loop with
+	// a closed pipe rather than io.EOF
+	serverConn.Close()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Expected nil error on close, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected ServeConn to return once the connection closed")
+	}
+}
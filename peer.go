@@ -0,0 +1,467 @@
+package jsonrps
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CancelRequestMethod is the method of the notification cancelling a
+// request in progress. Its params hold the ID of the request
+// (e.g. {"id": 1}). It is honoured by Peer and Dispatcher.
+const CancelRequestMethod = "$/cancelRequest"
+
+// ErrPeerClosed is returned by the calls of a peer whose session ended
+var ErrPeerClosed = errors.New("jsonrps: peer closed")
+
+// errRequestCancelled is the cause of the context of a request cancelled
+// with CancelRequestMethod
+var errRequestCancelled = errors.New("jsonrps: request cancelled")
+
+// peerContextKey is the context key of the Peer serving a request
+type peerContextKey struct{}
+
+// PeerFromContext returns the Peer serving the request of the context, if
+// any, so that method handlers can call the other side of the session
+func PeerFromContext(ctx context.Context) *Peer {
+	peer, _ := ctx.Value(peerContextKey{}).(*Peer)
+	return peer
+}
+
+// Peer is an end of a session which both serves the calls of the other
+// side and calls the methods of the other side. Either the client or the
+// server side of a session may be a peer, or both.
+//
+// A single read loop, run by Serve, demultiplexes the incoming lines by
+// their shape: lines with a method are requests or notifications for the
+// Handler, and lines with an ID but no method are responses to Call.
+// Each request is served in its own goroutine, so that handlers can call
+// the other side while serving. Notifications are served one after
+// another, in the order received.
+//
+// A CancelRequestMethod notification cancels the context of the matching
+// request in progress, which is then responded with ErrCodeCancelled.
+// Call sends it when its context is done before the response.
+//
+// A Peer must be created with NewPeer. Its fields may be changed before
+// Serve is called.
+type Peer struct {
+	// Session is the session of the peer
+	Session *Session
+
+	// Handler serves the calls from the other side. Calls are responded
+	// with method not found if nil.
+	Handler MethodHandler
+
+	// StreamBufferSize is the number of items of a stream of Stream
+	// buffered for the consumer, beyond which the stream is cancelled.
+	// DefaultStreamBufferSize is used if zero.
+	StreamBufferSize int
+
+	nextID atomic.Int64
+
+	// lastNotification is closed once the last notification dispatched
+	// is served. It is only used by the read loop.
+	lastNotification chan struct{}
+
+	mu       sync.Mutex // protects the fields below
+	pending  map[string]chan *JSONRPCResponse
+	progress map[string]func(value json.RawMessage)
+	streams  map[string]*peerStream
+	uploads  map[string]*Upload
+	credits  map[string]*credit // credits of the streamed results served
+	sending  map[string]*credit // credits of the uploads of calls
+	inflight map[string]context.CancelCauseFunc
+	done     chan struct{}
+	err      error
+}
+
+// NewPeer creates a peer on the session, serving calls with the handler
+func NewPeer(sess *Session, handler MethodHandler) *Peer {
+	return &Peer{
+		Session:  sess,
+		Handler:  handler,
+		pending:  make(map[string]chan *JSONRPCResponse),
+		progress: make(map[string]func(value json.RawMessage)),
+		streams:  make(map[string]*peerStream),
+		uploads:  make(map[string]*Upload),
+		credits:  make(map[string]*credit),
+		sending:  make(map[string]*credit),
+		inflight: make(map[string]context.CancelCauseFunc),
+		done:     make(chan struct{}),
+	}
+}
+
+// Serve writes the response header, if not already written, then reads
+// and dispatches incoming lines until the connection is closed or the
+// session context is done. It returns the termination reason of the
+// session once all served requests are handled. Pending calls fail with
+// ErrPeerClosed.
+func (p *Peer) Serve() error {
+	sess := p.Session
+	if !sess.headerSent {
+		sess.WriteResponseHeader(http.StatusOK)
+	}
+
+	ctx, cancel := context.WithCancel(context.WithValue(sess.context(), peerContextKey{}, p))
+	var wg sync.WaitGroup
+	for ctx.Err() == nil {
+		line, err := sess.readLine()
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			p.dispatch(ctx, &wg, line)
+		}
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				sess.logger().Debug("Reading message failed", "error", err)
+			}
+			if ctx.Err() != nil {
+				err = context.Cause(ctx)
+			}
+			sess.terminate(err)
+			break
+		}
+	}
+	sess.terminate(context.Cause(ctx))
+	cancel()
+	wg.Wait()
+
+	p.mu.Lock()
+	p.err = fmt.Errorf("%w: %w", ErrPeerClosed, sess.Err())
+	close(p.done)
+	p.mu.Unlock()
+	return sess.Err()
+}
+
+// Done returns a channel closed once the peer stopped serving
+func (p *Peer) Done() <-chan struct{} {
+	return p.done
+}
+
+// peerMessage is an incoming line of any shape
+type peerMessage struct {
+	ID     json.RawMessage `json:"id"`
+	Method string          `json:"method"`
+}
+
+// dispatch demultiplexes an incoming line by its shape
+func (p *Peer) dispatch(ctx context.Context, wg *sync.WaitGroup, line []byte) {
+	sess := p.Session
+	var msg peerMessage
+	if err := json.Unmarshal(line, &msg); err != nil {
+		sess.logger().Debug("Decoding message failed", "error", err)
+		p.respond(NewErrorResponse(nil, ErrCodeParseError, "parse error", nil))
+		return
+	}
+
+	hasID := len(msg.ID) > 0 && !bytes.Equal(msg.ID, []byte("null"))
+	switch {
+	case msg.Method == CancelRequestMethod && !hasID:
+		p.cancelRequest(line)
+	case msg.Method == ProgressMethod && !hasID && p.reportProgress(line):
+	case msg.Method == StreamItemMethod && !hasID && p.receiveStreamItem(line):
+	case msg.Method == StreamCreditMethod && !hasID && p.grantStreamCredit(line):
+	case msg.Method == UploadChunkMethod && !hasID && p.receiveUploadChunk(line):
+	case msg.Method == UploadEndMethod && !hasID && p.endUpload(line):
+	case msg.Method == UploadCreditMethod && !hasID && p.grantUploadCredit(line):
+	case msg.Method != "":
+		var req JSONRPCRequest
+		if err := json.Unmarshal(line, &req); err != nil {
+			p.respond(NewErrorResponse(nil, ErrCodeInvalidRequest, "invalid request", nil))
+			return
+		}
+		var previous, done chan struct{}
+		reqCtx, cancel := context.WithCancelCause(ctx)
+		reqCtx, cancelTimeout := withRequestTimeout(reqCtx, &req)
+		key := idKey(msg.ID)
+		var upload *Upload
+		var streamCredit *credit
+		if hasID {
+			// the upload is registered before its chunks are read
+			if req.Upload {
+				upload = newUpload(p, msg.ID)
+				reqCtx = context.WithValue(reqCtx, uploadContextKey{}, upload)
+			}
+			if req.StreamCredits > 0 {
+				streamCredit = newCredit(req.StreamCredits)
+				reqCtx = context.WithValue(reqCtx, streamCreditContextKey{}, streamCredit)
+			}
+			p.mu.Lock()
+			p.inflight[key] = cancel
+			if upload != nil {
+				p.uploads[key] = upload
+			}
+			if streamCredit != nil {
+				p.credits[key] = streamCredit
+			}
+			p.mu.Unlock()
+		} else {
+			previous, done = p.lastNotification, make(chan struct{})
+			p.lastNotification = done
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer cancel(nil)
+			defer cancelTimeout()
+			if done != nil {
+				defer close(done)
+			}
+			if previous != nil {
+				<-previous
+			}
+
+			resp := serveRequest(reqCtx, p.handler(), sess, &req)
+			if hasID {
+				p.mu.Lock()
+				delete(p.inflight, key)
+				delete(p.uploads, key)
+				delete(p.credits, key)
+				p.mu.Unlock()
+				switch cause := context.Cause(reqCtx); {
+				case errors.Is(cause, errRequestCancelled):
+					resp = NewErrorResponse(req.ID, ErrCodeCancelled, "request cancelled", nil)
+				case errors.Is(cause, ErrUploadOverflow):
+					resp = NewErrorResponse(req.ID, ErrCodeInvalidRequest, "upload overflow", nil)
+				}
+			}
+			if resp != nil {
+				p.respond(resp)
+			}
+		}()
+	case hasID:
+		var resp JSONRPCResponse
+		if err := json.Unmarshal(line, &resp); err != nil {
+			sess.logger().Debug("Decoding response failed", "error", err)
+			return
+		}
+		key := idKey(msg.ID)
+		p.mu.Lock()
+		ch := p.pending[key]
+		delete(p.pending, key)
+		p.mu.Unlock()
+		if ch == nil {
+			sess.logger().Debug("Discarding response to unknown call", "id", string(msg.ID))
+			return
+		}
+		ch <- &resp
+	case isResponseLine(line):
+		sess.logger().Debug("Discarding response without ID", "line", string(line))
+	default:
+		p.respond(NewErrorResponse(nil, ErrCodeInvalidRequest, "invalid request", nil))
+	}
+}
+
+// cancelParams is the params of CancelRequestMethod
+type cancelParams struct {
+	ID json.RawMessage `json:"id"`
+}
+
+// cancelRequest cancels the context of the request in progress matching
+// the CancelRequestMethod notification, if any
+func (p *Peer) cancelRequest(line []byte) {
+	var notification struct {
+		Params cancelParams `json:"params"`
+	}
+	if err := json.Unmarshal(line, &notification); err != nil || len(notification.Params.ID) == 0 {
+		p.Session.logger().Debug("Decoding cancel request failed", "error", err)
+		return
+	}
+	p.mu.Lock()
+	cancel := p.inflight[idKey(notification.Params.ID)]
+	p.mu.Unlock()
+	if cancel != nil {
+		cancel(errRequestCancelled)
+	}
+}
+
+// reportProgress passes the value of the ProgressMethod notification to
+// the progress callback of the matching call, if any. It reports if the
+// notification matched a call.
+func (p *Peer) reportProgress(line []byte) bool {
+	var notification struct {
+		Params struct {
+			Token json.RawMessage `json:"token"`
+			Value json.RawMessage `json:"value"`
+		} `json:"params"`
+	}
+	if err := json.Unmarshal(line, &notification); err != nil || len(notification.Params.Token) == 0 {
+		return false
+	}
+	p.mu.Lock()
+	onProgress := p.progress[idKey(notification.Params.Token)]
+	p.mu.Unlock()
+	if onProgress == nil {
+		return false
+	}
+	onProgress(notification.Params.Value)
+	return true
+}
+
+// idKey returns the key of the raw JSON request ID for matching requests
+// and responses
+func idKey(id json.RawMessage) string {
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, id); err != nil {
+		return string(id)
+	}
+	return buf.String()
+}
+
+// handler returns the handler of the peer, or an empty MethodMux if none
+func (p *Peer) handler() MethodHandler {
+	if p.Handler == nil {
+		return &MethodMux{}
+	}
+	return p.Handler
+}
+
+// respond writes the response to the session, logging any failure
+func (p *Peer) respond(resp *JSONRPCResponse) {
+	if err := p.Session.WriteResponse(resp); err != nil {
+		p.Session.logger().Debug("Writing response failed", "error", err)
+	}
+}
+
+// Call calls the method of the other side with the JSON encoded params,
+// which may be nil, and decodes the result into result, unless nil. It
+// returns the *JSONRPCError responded by the other side, if any.
+//
+// The deadline of the context, if any, is sent as the timeout of the
+// request. If the context is done before the response, the request is
+// cancelled with a CancelRequestMethod notification and the context error
+// is returned without waiting for the response.
+func (p *Peer) Call(ctx context.Context, method string, params, result any) error {
+	return p.call(ctx, method, params, result, nil)
+}
+
+// CallWithProgress calls the method like Call, requesting the progress of
+// the call. The values reported by the handler with ReportProgress are
+// passed to onProgress, in order, before Call returns. onProgress is
+// called by the read loop, and should not block.
+func (p *Peer) CallWithProgress(ctx context.Context, method string, params, result any, onProgress func(value json.RawMessage)) error {
+	return p.call(ctx, method, params, result, onProgress)
+}
+
+// call sends the request and waits for its response, passing the progress
+// of the call to onProgress, if set
+func (p *Peer) call(ctx context.Context, method string, params, result any, onProgress func(value json.RawMessage)) error {
+	raw, err := marshalParams(params)
+	if err != nil {
+		return err
+	}
+
+	id := p.nextID.Add(1)
+	key := strconv.FormatInt(id, 10)
+	ch := make(chan *JSONRPCResponse, 1)
+	p.mu.Lock()
+	if p.err != nil {
+		p.mu.Unlock()
+		return p.err
+	}
+	p.pending[key] = ch
+	if onProgress != nil {
+		p.progress[key] = onProgress
+	}
+	p.mu.Unlock()
+	defer func() {
+		p.mu.Lock()
+		delete(p.pending, key)
+		delete(p.progress, key)
+		p.mu.Unlock()
+	}()
+
+	req := newCallRequest(ctx, method, raw, id)
+	if onProgress != nil {
+		req.ProgressToken = id
+	}
+	if err = p.Session.WriteRequest(req); err != nil {
+		return err
+	}
+
+	select {
+	case resp := <-ch:
+		if resp.Error != nil {
+			return resp.Error
+		}
+		if result != nil && len(resp.Result) > 0 {
+			return json.Unmarshal(resp.Result, result)
+		}
+		return nil
+	case <-ctx.Done():
+		if err := p.Notify(CancelRequestMethod, cancelParams{ID: json.RawMessage(key)}); err != nil {
+			p.Session.logger().Debug("Cancelling request failed", "id", key, "error", err)
+		}
+		return ctx.Err()
+	case <-p.done:
+		return p.err
+	}
+}
+
+// newCallRequest creates the request of a call, with the deadline of the
+// context, if any, as timeout
+func newCallRequest(ctx context.Context, method string, params json.RawMessage, id int64) *JSONRPCRequest {
+	req := &JSONRPCRequest{
+		Version: JSONRPCVersion,
+		Method:  method,
+		Params:  params,
+		ID:      id,
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		req.Timeout = max(time.Until(deadline).Milliseconds(), 1)
+	}
+	return req
+}
+
+// Notify sends a notification of the method with the JSON encoded params,
+// which may be nil, to the other side
+func (p *Peer) Notify(method string, params any) error {
+	raw, err := marshalParams(params)
+	if err != nil {
+		return err
+	}
+	return p.Session.WriteRequest(&JSONRPCRequest{
+		Version: JSONRPCVersion,
+		Method:  method,
+		Params:  raw,
+	})
+}
+
+// marshalParams JSON encodes the params, unless nil
+func marshalParams(params any) (json.RawMessage, error) {
+	if params == nil {
+		return nil, nil
+	}
+	return json.Marshal(params)
+}
+
+// PeerHandler is a SessionHandler serving each session as a Peer, so that
+// the server side can call the methods of its clients
+type PeerHandler struct {
+	// Handler serves the calls from the clients
+	Handler MethodHandler
+
+	// Connected, if set, is called in its own goroutine with the peer of
+	// each session once the response header is written
+	Connected func(peer *Peer)
+}
+
+// HandleSession writes the response header, if not already written, and
+// serves the session as a Peer
+func (h *PeerHandler) HandleSession(sess *Session) {
+	if !sess.headerSent {
+		sess.WriteResponseHeader(http.StatusOK)
+	}
+	peer := NewPeer(sess, h.Handler)
+	if h.Connected != nil {
+		go h.Connected(peer)
+	}
+	peer.Serve()
+}
@@ -0,0 +1,237 @@
+package jsonrps_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/yookoala/jsonrps"
+)
+
+// startTestPeers serves the server handler and a client peer over an
+// in-memory session pair until the test ends
+func startTestPeers(t *testing.T, server jsonrps.SessionHandler, clientHandler jsonrps.MethodHandler) *jsonrps.Peer {
+	t.Helper()
+	client, serverSess := jsonrps.NewSessionPair(&jsonrps.SessionPairConfig{Method: "agent", Logger: newTestLogger(t)})
+	go server.HandleSession(serverSess)
+	if err := client.ReadResponseHeader(); err != nil {
+		t.Fatalf("Unexpected response header error: %v", err)
+	}
+	peer := jsonrps.NewPeer(client, clientHandler)
+	go peer.Serve()
+	t.Cleanup(func() {
+		client.Close()
+		<-peer.Done()
+	})
+	return peer
+}
+
+func TestPeer_ServerCallsClient(t *testing.T) {
+	agent := jsonrps.NewMethodMux()
+	agent.HandleFunc("agent.info", func(ctx context.Context, sess *jsonrps.Session, req *jsonrps.JSONRPCRequest) *jsonrps.JSONRPCResponse {
+		resp, _ := jsonrps.NewResultResponse(req.ID, map[string]string{"hostname": "agent-1"})
+		return resp
+	})
+
+	// the server asks the connected agent while serving a call of the agent
+	server := jsonrps.NewMethodMux()
+	server.HandleFunc("register", func(ctx context.Context, sess *jsonrps.Session, req *jsonrps.JSONRPCRequest) *jsonrps.JSONRPCResponse {
+		var info struct {
+			Hostname string `json:"hostname"`
+		}
+		if err := jsonrps.PeerFromContext(ctx).Call(ctx, "agent.info", nil, &info); err != nil {
+			return jsonrps.NewErrorResponse(req.ID, jsonrps.ErrCodeInternalError, err.Error(), nil)
+		}
+		resp, _ := jsonrps.NewResultResponse(req.ID, "registered "+info.Hostname)
+		return resp
+	})
+
+	peer := startTestPeers(t, &jsonrps.PeerHandler{Handler: server}, agent)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	var result string
+	if err := peer.Call(ctx, "register", nil, &result); err != nil {
+		t.Fatalf("Unexpected call error: %v", err)
+	}
+	if result != "registered agent-1" {
+		t.Errorf("Unexpected result %q", result)
+	}
+
+	var rpcErr *jsonrps.JSONRPCError
+	if err := peer.Call(ctx, "unknown", nil, nil); !errors.As(err, &rpcErr) || rpcErr.Code != jsonrps.ErrCodeMethodNotFound {
+		t.Errorf("Expected method not found error, got %v", err)
+	}
+}
+
+func TestPeerHandler_Connected(t *testing.T) {
+	agent := jsonrps.NewMethodMux()
+	notified := make(chan string, 10)
+	agent.HandleFunc("greet", func(ctx context.Context, sess *jsonrps.Session, req *jsonrps.JSONRPCRequest) *jsonrps.JSONRPCResponse {
+		notified <- string(req.Params)
+		return nil
+	})
+	agent.Handle("echo", echoHandler)
+
+	results := make(chan error, 1)
+	startTestPeers(t, &jsonrps.PeerHandler{
+		Connected: func(peer *jsonrps.Peer) {
+			for i := 0; i < 10; i++ {
+				peer.Notify("greet", i)
+			}
+			results <- peer.Call(context.Background(), "echo", nil, nil)
+		},
+	}, agent)
+
+	// notifications are served in order
+	for i := 0; i < 10; i++ {
+		select {
+		case params := <-notified:
+			if params != strconv.Itoa(i) {
+				t.Errorf("Expected notification %d, got %s", i, params)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Expected notification from the server")
+		}
+	}
+	select {
+	case err := <-results:
+		if err != nil {
+			t.Errorf("Unexpected call error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected call result")
+	}
+}
+
+func TestPeer_CallAfterClose(t *testing.T) {
+	peer := startTestPeers(t, &jsonrps.PeerHandler{}, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	peer.Session.Close()
+	<-peer.Done()
+	if err := peer.Call(ctx, "anything", nil, nil); !errors.Is(err, jsonrps.ErrPeerClosed) {
+		t.Errorf("Expected ErrPeerClosed, got %v", err)
+	}
+}
+
+func TestPeer_CancelRequest(t *testing.T) {
+	cancelled := make(chan error, 1)
+	server := jsonrps.NewMethodMux()
+	server.HandleFunc("slow", func(ctx context.Context, sess *jsonrps.Session, req *jsonrps.JSONRPCRequest) *jsonrps.JSONRPCResponse {
+		<-ctx.Done()
+		cancelled <- ctx.Err()
+		resp, _ := jsonrps.NewResultResponse(req.ID, "too late")
+		return resp
+	})
+
+	// the client cancels the call once its context is done
+	peer := startTestPeers(t, &jsonrps.PeerHandler{Handler: server}, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	if err := peer.Call(ctx, "slow", nil, nil); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context canceled, got %v", err)
+	}
+	select {
+	case err := <-cancelled:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Expected handler context cancelled, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected handler context to be cancelled")
+	}
+
+	// the cancelled request is responded with ErrCodeCancelled
+	client, serverSess := jsonrps.NewSessionPair(&jsonrps.SessionPairConfig{Logger: newTestLogger(t)})
+	defer client.Close()
+	go (&jsonrps.PeerHandler{Handler: server}).HandleSession(serverSess)
+	client.ReadResponseHeader()
+	client.WriteRequest(&jsonrps.JSONRPCRequest{Version: jsonrps.JSONRPCVersion, Method: "slow", ID: "req-1"})
+	client.WriteRequest(&jsonrps.JSONRPCRequest{
+		Version: jsonrps.JSONRPCVersion,
+		Method:  jsonrps.CancelRequestMethod,
+		Params:  json.RawMessage(`{"id": "req-1"}`),
+	})
+	resp, err := client.ReadResponse()
+	if err != nil {
+		t.Fatalf("Unexpected read error: %v", err)
+	}
+	if resp.ID != "req-1" || resp.Error == nil || resp.Error.Code != jsonrps.ErrCodeCancelled {
+		t.Errorf("Expected cancelled error, got %#v", resp)
+	}
+	<-cancelled
+}
+
+func TestPeer_CallTimeout(t *testing.T) {
+	server := jsonrps.NewMethodMux()
+	server.HandleFunc("deadline", func(ctx context.Context, sess *jsonrps.Session, req *jsonrps.JSONRPCRequest) *jsonrps.JSONRPCResponse {
+		deadline, ok := ctx.Deadline()
+		resp, _ := jsonrps.NewResultResponse(req.ID, ok && time.Until(deadline) <= time.Second)
+		return resp
+	})
+	peer := startTestPeers(t, &jsonrps.PeerHandler{Handler: server}, nil)
+
+	// the deadline of the call context is sent with the request
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	var ok bool
+	if err := peer.Call(ctx, "deadline", nil, &ok); err != nil {
+		t.Fatalf("Unexpected call error: %v", err)
+	}
+	if !ok {
+		t.Error("Expected the handler context to have the deadline of the call")
+	}
+}
+
+func TestPeer_MalformedLine(t *testing.T) {
+	for name, server := range map[string]jsonrps.SessionHandler{
+		"peer":       &jsonrps.PeerHandler{Handler: echoHandler},
+		"dispatcher": &jsonrps.Dispatcher{Handler: echoHandler},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var writes atomic.Int64
+			count := &jsonrps.PipeConfig{Fault: func(p []byte) jsonrps.PipeFault {
+				writes.Add(1)
+				return jsonrps.PipeFaultNone
+			}}
+			client, serverSess := jsonrps.NewSessionPair(&jsonrps.SessionPairConfig{
+				Method:         "agent",
+				ClientToServer: count,
+				ServerToClient: count,
+				Logger:         newTestLogger(t),
+			})
+			go server.HandleSession(serverSess)
+			if err := client.ReadResponseHeader(); err != nil {
+				t.Fatalf("Unexpected response header error: %v", err)
+			}
+			peer := jsonrps.NewPeer(client, echoHandler)
+			go peer.Serve()
+			defer func() {
+				client.Close()
+				<-peer.Done()
+			}()
+
+			// the parse error responded to the line is not responded back
+			before := writes.Load()
+			if _, err := client.Write([]byte("garbage\n")); err != nil {
+				t.Fatalf("Unexpected write error: %v", err)
+			}
+			time.Sleep(100 * time.Millisecond)
+			if n := writes.Load() - before; n != 2 {
+				t.Errorf("Expected the line and its parse error only, got %d writes", n)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			var result []string
+			if err := peer.Call(ctx, "echo", []string{"still working"}, &result); err != nil {
+				t.Errorf("Unexpected call error: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,315 @@
+package jsonrps
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// PipeFault is a fault injected into a write to an in-memory pipe
+type PipeFault int
+
+const (
+	// PipeFaultNone delivers the written data intact
+	PipeFaultNone PipeFault = iota
+
+	// PipeFaultDrop discards the written data silently
+	PipeFaultDrop
+
+	// PipeFaultCorrupt delivers the written data with a byte in the middle
+	// replaced by NUL, which is never valid in JSON
+	PipeFaultCorrupt
+
+	// PipeFaultTruncate delivers only the first half of the written data
+	PipeFaultTruncate
+
+	// PipeFaultClose delivers the first half of the written data, then
+	// closes the pipe as if the connection dropped mid-message
+	PipeFaultClose
+)
+
+// PipeConfig configures one direction of an in-memory pipe. The zero
+// value delivers every write immediately and intact.
+type PipeConfig struct {
+	// Latency delays the delivery of every write
+	Latency time.Duration
+
+	// Bandwidth limits the delivery rate in bytes per second. Writes are
+	// transmitted one after another. Zero means unlimited.
+	Bandwidth int
+
+	// Fault, if set, is called with the data of every write and decides
+	// the fault injected into it
+	Fault func(p []byte) PipeFault
+}
+
+// Pipe creates an in-memory connection and returns its two ends. Data
+// written to one end is read from the other, as configured by aToB and
+// bToA, which may be nil. Writes never block on the reader. Closing an end
+// makes the other end read io.EOF once the delivered data are read.
+func Pipe(aToB, bToA *PipeConfig) (a, b io.ReadWriteCloser) {
+	ab := newPipeBuffer(aToB)
+	ba := newPipeBuffer(bToA)
+	return &pipeEnd{in: ba, out: ab}, &pipeEnd{in: ab, out: ba}
+}
+
+// SessionPairConfig contains options for NewSessionPair
+type SessionPairConfig struct {
+	// Method is the method requested by the client session
+	Method string
+
+	// Headers are the request headers of the client session
+	Headers http.Header
+
+	// ClientToServer configures the pipe from the client to the server.
+	// Its Fault is not applied to the request header, which is exchanged
+	// by NewSessionPair, but to every later write of the client.
+	ClientToServer *PipeConfig
+
+	// ServerToClient configures the pipe from the server to the client.
+	// Its Fault is applied to every write of the server, including the
+	// response header.
+	ServerToClient *PipeConfig
+
+	// Logger is used for both sessions. The default logger is used if nil.
+	Logger *slog.Logger
+}
+
+// NewSessionPair returns a client session and a server session connected
+// over an in-memory Pipe, to exercise session handlers without sockets.
+//
+// The request header of the client is already read by the server session,
+// which is ready to be passed to a session handler. The client session
+// must read the response header with ReadResponseHeader, as a Dialer does,
+// before reading responses. A nil config uses a fault free pipe.
+func NewSessionPair(config *SessionPairConfig) (client, server *Session) {
+	if config == nil {
+		config = &SessionPairConfig{}
+	}
+	logger := config.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	ab := newPipeBuffer(config.ClientToServer)
+	ba := newPipeBuffer(config.ServerToClient)
+	clientConn, serverConn := &pipeEnd{in: ba, out: ab}, &pipeEnd{in: ab, out: ba}
+
+	// faults are injected once the request header is exchanged, so that
+	// the server session is always ready
+	fault := ab.config.Fault
+	ab.setFault(nil)
+	defer ab.setFault(fault)
+
+	client = &Session{
+		ID:           newSessionID(),
+		LocalHeaders: config.Headers.Clone(),
+		Context:      context.Background(),
+		Conn:         clientConn,
+	}
+	if client.LocalHeaders == nil {
+		client.LocalHeaders = make(http.Header)
+	}
+	client.Logger = logger.With("session", client.ID, "side", "client")
+
+	server = &Session{
+		ID:           newSessionID(),
+		LocalHeaders: make(http.Header),
+		Context:      context.Background(),
+		Conn:         serverConn,
+	}
+	server.Logger = logger.With("session", server.ID, "side", "server")
+
+	client.WriteRequestHeader(config.Method)
+	if err := server.ReadRequestHeader(); err != nil {
+		server.Logger.Debug("Reading request header failed", "error", err)
+	}
+	return client, server
+}
+
+// pipeChunk is the data of a write, deliverable from a point of time
+type pipeChunk struct {
+	data []byte
+	at   time.Time
+}
+
+// pipeBuffer buffers the data in one direction of a pipe
+type pipeBuffer struct {
+	config PipeConfig
+
+	mu          sync.Mutex
+	chunks      []pipeChunk
+	linkFree    time.Time // when the previous write is fully transmitted
+	writeClosed bool      // the writing end closed
+	readClosed  bool      // the reading end closed
+
+	// notify wakes up the reader on writes and closes
+	notify chan struct{}
+}
+
+// newPipeBuffer creates a pipe buffer with the config, if any
+func newPipeBuffer(config *PipeConfig) *pipeBuffer {
+	b := &pipeBuffer{notify: make(chan struct{}, 1)}
+	if config != nil {
+		b.config = *config
+	}
+	return b
+}
+
+// wake wakes up the reader, if waiting
+func (b *pipeBuffer) wake() {
+	select {
+	case b.notify <- struct{}{}:
+	default:
+	}
+}
+
+// setFault sets the Fault of the config
+func (b *pipeBuffer) setFault(fault func(p []byte) PipeFault) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.config.Fault = fault
+}
+
+// write buffers the data with the configured delay and faults, and
+// returns the injected fault
+func (b *pipeBuffer) write(p []byte) (int, PipeFault, error) {
+	b.mu.Lock()
+	faultFunc := b.config.Fault
+	b.mu.Unlock()
+	fault := PipeFaultNone
+	if faultFunc != nil {
+		fault = faultFunc(p)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.writeClosed || b.readClosed {
+		return 0, fault, io.ErrClosedPipe
+	}
+
+	data := append([]byte(nil), p...)
+	switch fault {
+	case PipeFaultDrop:
+		return len(p), fault, nil
+	case PipeFaultCorrupt:
+		if len(data) > 0 {
+			data[len(data)/2] = 0
+		}
+	case PipeFaultTruncate, PipeFaultClose:
+		data = data[:len(data)/2]
+	}
+
+	now := time.Now()
+	start := now
+	if b.linkFree.After(start) {
+		start = b.linkFree
+	}
+	b.linkFree = start
+	if b.config.Bandwidth > 0 {
+		b.linkFree = start.Add(time.Duration(len(data)) * time.Second / time.Duration(b.config.Bandwidth))
+	}
+	if len(data) > 0 {
+		b.chunks = append(b.chunks, pipeChunk{data: data, at: b.linkFree.Add(b.config.Latency)})
+	}
+	b.wake()
+
+	if fault == PipeFaultClose {
+		return len(data), fault, io.ErrClosedPipe
+	}
+	return len(p), fault, nil
+}
+
+// read reads the delivered data, waiting for them if needed
+func (b *pipeBuffer) read(p []byte) (int, error) {
+	var timer *time.Timer
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
+
+	for {
+		var wait <-chan time.Time
+		b.mu.Lock()
+		if b.readClosed {
+			b.mu.Unlock()
+			return 0, io.ErrClosedPipe
+		}
+		if len(b.chunks) > 0 {
+			chunk := &b.chunks[0]
+			delay := time.Until(chunk.at)
+			if delay <= 0 {
+				n := copy(p, chunk.data)
+				chunk.data = chunk.data[n:]
+				if len(chunk.data) == 0 {
+					b.chunks = b.chunks[1:]
+				}
+				b.mu.Unlock()
+				return n, nil
+			}
+			if timer == nil {
+				timer = time.NewTimer(delay)
+			} else {
+				timer.Reset(delay)
+			}
+			wait = timer.C
+		} else if b.writeClosed {
+			b.mu.Unlock()
+			return 0, io.EOF
+		}
+		b.mu.Unlock()
+
+		select {
+		case <-b.notify:
+		case <-wait:
+		}
+	}
+}
+
+// closeWrite closes the writing end. The reader reads io.EOF once the
+// buffered data are read.
+func (b *pipeBuffer) closeWrite() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.writeClosed = true
+	b.wake()
+}
+
+// closeRead closes the reading end, discarding the buffered data
+func (b *pipeBuffer) closeRead() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.readClosed = true
+	b.chunks = nil
+	b.wake()
+}
+
+// pipeEnd is an end of an in-memory pipe
+type pipeEnd struct {
+	in  *pipeBuffer
+	out *pipeBuffer
+}
+
+// Read reads the data written to the other end
+func (e *pipeEnd) Read(p []byte) (int, error) {
+	return e.in.read(p)
+}
+
+// Write writes the data for the other end
+func (e *pipeEnd) Write(p []byte) (int, error) {
+	n, fault, err := e.out.write(p)
+	if fault == PipeFaultClose {
+		e.Close()
+	}
+	return n, err
+}
+
+// Close closes both directions of the pipe
+func (e *pipeEnd) Close() error {
+	e.out.closeWrite()
+	e.in.closeRead()
+	return nil
+}
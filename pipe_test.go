@@ -0,0 +1,174 @@
+package jsonrps_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yookoala/jsonrps"
+)
+
+func TestNewSessionPair_Dispatcher(t *testing.T) {
+	mux := jsonrps.NewMethodMux()
+	mux.Handle("echo", echoHandler)
+
+	client, server := jsonrps.NewSessionPair(&jsonrps.SessionPairConfig{
+		Method:  "tools",
+		Headers: http.Header{"User-Agent": {"test-client/1.0"}},
+		Logger:  newTestLogger(t),
+	})
+	if server.Method != "tools" || server.RemoteHeaders.Get("User-Agent") != "test-client/1.0" {
+		t.Errorf("Unexpected server session method %q, headers %v", server.Method, server.RemoteHeaders)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		(&jsonrps.Dispatcher{Handler: mux}).HandleSession(server)
+	}()
+
+	if err := client.ReadResponseHeader(); err != nil || client.StatusCode != http.StatusOK {
+		t.Fatalf("Unexpected response header status %d, error %v", client.StatusCode, err)
+	}
+	client.WriteRequest(&jsonrps.JSONRPCRequest{
+		Version: jsonrps.JSONRPCVersion,
+		Method:  "echo",
+		Params:  json.RawMessage(`{"a":1}`),
+		ID:      1,
+	})
+	resp, err := client.ReadResponse()
+	if err != nil {
+		t.Fatalf("Unexpected read error: %v", err)
+	}
+	if string(resp.Result) != `{"a":1}` {
+		t.Errorf("Unexpected response %#v", resp)
+	}
+
+	client.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Expected dispatcher to end once the client closed")
+	}
+}
+
+func TestPipe_Delay(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  *jsonrps.PipeConfig
+		minimum time.Duration
+	}{
+		{"latency", &jsonrps.PipeConfig{Latency: 50 * time.Millisecond}, 50 * time.Millisecond},
+		{"bandwidth", &jsonrps.PipeConfig{Bandwidth: 1000}, 100 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := jsonrps.Pipe(tt.config, nil)
+			defer a.Close()
+
+			start := time.Now()
+			a.Write(bytes.Repeat([]byte("x"), 50))
+			a.Write(bytes.Repeat([]byte("y"), 50))
+			got := make([]byte, 100)
+			if _, err := io.ReadFull(b, got); err != nil {
+				t.Fatalf("Unexpected read error: %v", err)
+			}
+			if elapsed := time.Since(start); elapsed < tt.minimum {
+				t.Errorf("Expected delivery after %v, got %v", tt.minimum, elapsed)
+			}
+		})
+	}
+}
+
+func TestPipe_Faults(t *testing.T) {
+	tests := []struct {
+		fault    jsonrps.PipeFault
+		expected string
+		writeErr bool
+	}{
+		{jsonrps.PipeFaultNone, "abcdefgh|tail", false},
+		{jsonrps.PipeFaultDrop, "tail", false},
+		{jsonrps.PipeFaultCorrupt, "abcd\x00fgh|tail", false},
+		{jsonrps.PipeFaultTruncate, "abcdtail", false},
+		{jsonrps.PipeFaultClose, "abcd", true},
+	}
+	for _, tt := range tests {
+		a, b := jsonrps.Pipe(&jsonrps.PipeConfig{
+			Fault: func(p []byte) jsonrps.PipeFault {
+				if bytes.HasPrefix(p, []byte("abc")) {
+					return tt.fault
+				}
+				return jsonrps.PipeFaultNone
+			},
+		}, nil)
+
+		_, err := a.Write([]byte("abcdefgh|"))
+		if (err != nil) != tt.writeErr {
+			t.Errorf("fault %d: unexpected write error %v", tt.fault, err)
+		}
+		a.Write([]byte("tail"))
+		a.Close()
+
+		got, err := io.ReadAll(b)
+		if err != nil {
+			t.Errorf("fault %d: unexpected read error %v", tt.fault, err)
+		}
+		if string(got) != tt.expected {
+			t.Errorf("fault %d: expected %q, got %q", tt.fault, tt.expected, got)
+		}
+	}
+}
+
+func TestPipe_CorruptRequest(t *testing.T) {
+	client, server := jsonrps.NewSessionPair(&jsonrps.SessionPairConfig{
+		ClientToServer: &jsonrps.PipeConfig{
+			Fault: func(p []byte) jsonrps.PipeFault {
+				if strings.Contains(string(p), `"method":"echo"`) {
+					return jsonrps.PipeFaultCorrupt
+				}
+				return jsonrps.PipeFaultNone
+			},
+		},
+		Logger: newTestLogger(t),
+	})
+	defer client.Close()
+	go (&jsonrps.Dispatcher{Handler: echoHandler}).HandleSession(server)
+
+	client.ReadResponseHeader()
+	client.WriteRequest(&jsonrps.JSONRPCRequest{Version: jsonrps.JSONRPCVersion, Method: "echo", ID: 1})
+	resp, err := client.ReadResponse()
+	if err != nil {
+		t.Fatalf("Unexpected read error: %v", err)
+	}
+	if resp.Error == nil || resp.Error.Code != jsonrps.ErrCodeParseError {
+		t.Errorf("Expected parse error, got %#v", resp)
+	}
+}
+
+func TestNewSessionPair_DropAll(t *testing.T) {
+	created := make(chan *jsonrps.Session, 1)
+	go func() {
+		_, server := jsonrps.NewSessionPair(&jsonrps.SessionPairConfig{
+			Method: "tools",
+			ClientToServer: &jsonrps.PipeConfig{
+				Fault: func(p []byte) jsonrps.PipeFault { return jsonrps.PipeFaultDrop },
+			},
+			Logger: newTestLogger(t),
+		})
+		created <- server
+	}()
+
+	// the request header is exchanged before faults are injected
+	select {
+	case server := <-created:
+		if server.Method != "tools" {
+			t.Errorf("Expected method tools, got %q", server.Method)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected NewSessionPair to return despite the faults")
+	}
+}
@@ -0,0 +1,61 @@
+package jsonrps
+
+import (
+	"context"
+	"encoding/json"
+)
+
+// ProgressMethod is the Method of the notifications reporting the progress
+// of a request, with a Progress as Params
+const ProgressMethod = "$/progress"
+
+// Progress is the params of a progress notification
+type Progress struct {
+	// Token is the ProgressToken of the originating request
+	Token any `json:"token"`
+
+	// Value is the progress reported by the handler
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// progressContextKey is the context key of the progress reporter of
+// a request
+type progressContextKey struct{}
+
+// progressReporter sends the progress notifications of a request
+type progressReporter struct {
+	sess  *Session
+	token any
+}
+
+// contextWithProgress returns a context reporting the progress of the
+// request, if it has a progress token
+func contextWithProgress(ctx context.Context, sess *Session, req *JSONRPCRequest) context.Context {
+	if req.ProgressToken == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, progressContextKey{}, &progressReporter{sess: sess, token: req.ProgressToken})
+}
+
+// ReportProgress sends the JSON encoded value as a progress notification
+// of the request served with the context, tied to the request by its
+// ProgressToken. It does nothing if the caller requested no progress.
+func ReportProgress(ctx context.Context, value any) error {
+	reporter, ok := ctx.Value(progressContextKey{}).(*progressReporter)
+	if !ok {
+		return nil
+	}
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	params, err := json.Marshal(Progress{Token: reporter.token, Value: raw})
+	if err != nil {
+		return err
+	}
+	return reporter.sess.WriteResponse(&JSONRPCResponse{
+		Version: JSONRPCVersion,
+		Method:  ProgressMethod,
+		Params:  params,
+	})
+}
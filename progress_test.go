@@ -0,0 +1,74 @@
+package jsonrps_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/yookoala/jsonrps"
+)
+
+// exportHandler reports the progress of an export in steps
+var exportHandler = jsonrps.MethodHandlerFunc(func(ctx context.Context, sess *jsonrps.Session, req *jsonrps.JSONRPCRequest) *jsonrps.JSONRPCResponse {
+	for percent := 25; percent <= 75; percent += 25 {
+		if err := jsonrps.ReportProgress(ctx, map[string]int{"percent": percent}); err != nil {
+			return jsonrps.NewErrorResponse(req.ID, jsonrps.ErrCodeInternalError, err.Error(), nil)
+		}
+	}
+	resp, _ := jsonrps.NewResultResponse(req.ID, "exported")
+	return resp
+})
+
+func TestReportProgress_Dispatcher(t *testing.T) {
+	conn := &mockReadWriteCloser{
+		readData: `{"jsonrpc":"2.0","method":"export","id":1,"progressToken":"export-1"}` + "\n" +
+			`{"jsonrpc":"2.0","method":"export","id":2}` + "\n",
+	}
+	session := &jsonrps.Session{Conn: conn, Logger: newTestLogger(t)}
+	(&jsonrps.Dispatcher{Handler: exportHandler}).HandleSession(session)
+
+	responses := decodeResponses(t, conn.writeData.String())
+	if len(responses) != 5 {
+		t.Fatalf("Expected 3 progress notifications and 2 results, got %d", len(responses))
+	}
+	for i, resp := range responses[:3] {
+		var progress jsonrps.Progress
+		json.Unmarshal(resp.Params, &progress)
+		if resp.Method != jsonrps.ProgressMethod || resp.ID != nil || progress.Token != "export-1" {
+			t.Errorf("Unexpected progress notification %d: %#v", i, resp)
+		}
+	}
+	if string(responses[3].Result) != `"exported"` || string(responses[4].Result) != `"exported"` {
+		t.Errorf("Expected results without progress for the second request, got %#v", responses[3:])
+	}
+}
+
+func TestPeer_CallWithProgress(t *testing.T) {
+	server := jsonrps.NewMethodMux()
+	server.Handle("export", exportHandler)
+	peer := startTestPeers(t, &jsonrps.PeerHandler{Handler: server}, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	var values []string
+	var result string
+	err := peer.CallWithProgress(ctx, "export", nil, &result, func(value json.RawMessage) {
+		values = append(values, string(value))
+	})
+	if err != nil {
+		t.Fatalf("Unexpected call error: %v", err)
+	}
+	if result != "exported" {
+		t.Errorf("Unexpected result %q", result)
+	}
+	expected := []string{`{"percent":25}`, `{"percent":50}`, `{"percent":75}`}
+	if len(values) != len(expected) {
+		t.Fatalf("Expected progress %v, got %v", expected, values)
+	}
+	for i := range expected {
+		if values[i] != expected[i] {
+			t.Errorf("Expected progress %s, got %s", expected[i], values[i])
+		}
+	}
+}
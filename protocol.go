@@ -1,6 +1,52 @@
 package jsonrps
 
-import "encoding/json"
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// JSONRPCVersion is the version string of the JSON-RPC protocol
+// implemented by this package.
+const JSONRPCVersion = "2.0"
+
+// Error codes defined by the JSON-RPC 2.0 specification.
+const (
+	// ErrCodeParseError indicates invalid JSON was received
+	ErrCodeParseError = -32700
+
+	// ErrCodeInvalidRequest indicates the JSON sent is not a valid request object
+	ErrCodeInvalidRequest = -32600
+
+	// ErrCodeMethodNotFound indicates the method does not exist or is not available
+	ErrCodeMethodNotFound = -32601
+
+	// ErrCodeInvalidParams indicates invalid method parameters
+	ErrCodeInvalidParams = -32602
+
+	// ErrCodeInternalError indicates an internal JSON-RPC error
+	ErrCodeInternalError = -32603
+)
+
+// Error codes used by this package. They are taken from the range
+// -32000 to -32099 which the JSON-RPC 2.0 specification reserves for
+// implementation-defined server errors.
+const (
+	// ErrCodeForbidden indicates the caller is not allowed to invoke the
+	// method or to access the requested topic
+	ErrCodeForbidden = -32001
+
+	// ErrCodeCancelled indicates the request was cancelled by the caller
+	// with CancelRequestMethod
+	ErrCodeCancelled = -32002
+
+	// ErrCodeTimeout indicates the request was not handled within the
+	// timeout of the request
+	ErrCodeTimeout = -32003
+
+	// ErrCodeRateLimited indicates the caller exceeded a rate limit. The
+	// error data is a RateLimitedData.
+	ErrCodeRateLimited = -32004
+)
 
 // JSONRPCRequest represents a JSON-RPC 2.0 request object.
 type JSONRPCRequest struct {
@@ -15,6 +61,26 @@ type JSONRPCRequest struct {
 
 	// ID is the unique identifier for the request
 	ID any `json:"id,omitempty"`
+
+	// -- Below are extended fields for request metadata --
+
+	// Timeout is the time in milliseconds the caller waits for the response,
+	// counted from when the request is read. The handler context expires
+	// once it is exceeded. Zero means no timeout.
+	Timeout int64 `json:"timeout,omitempty"`
+
+	// ProgressToken, if set, requests progress notifications of the
+	// request, which carry the token (see ReportProgress)
+	ProgressToken any `json:"progressToken,omitempty"`
+
+	// Upload, if set, announces the chunks of an upload following the
+	// request (see UploadHandler)
+	Upload bool `json:"upload,omitempty"`
+
+	// StreamCredits, if set, is the number of items of a streamed result
+	// the caller is ready to receive before granting more (see
+	// StreamHandler)
+	StreamCredits int `json:"streamCredits,omitempty"`
 }
 
 // JSONRPCError represents the error object in a JSON-RPC 2.0 response.
@@ -29,6 +95,11 @@ type JSONRPCError struct {
 	Data any `json:"data,omitempty"`
 }
 
+// Error implements the error interface
+func (e *JSONRPCError) Error() string {
+	return fmt.Sprintf("jsonrpc error %d: %s", e.Code, e.Message)
+}
+
 // JSONRPCResponse represents a JSON-RPC 2.0 response object.
 type JSONRPCResponse struct {
 	// Version of the JSON-RPC protocol
@@ -51,3 +122,41 @@ type JSONRPCResponse struct {
 	// Params is the parameters for the subscription notification
 	Params json.RawMessage `json:"params,omitempty"`
 }
+
+// NewErrorResponse creates a JSON-RPC error response to the request of the given ID
+func NewErrorResponse(id any, code int, message string, data any) *JSONRPCResponse {
+	return &JSONRPCResponse{
+		Version: JSONRPCVersion,
+		ID:      id,
+		Error: &JSONRPCError{
+			Code:    code,
+			Message: message,
+			Data:    data,
+		},
+	}
+}
+
+// NewResultResponse creates a successful JSON-RPC response to the request of
+// the given ID with the JSON encoded result
+func NewResultResponse(id any, result any) (*JSONRPCResponse, error) {
+	raw, err := json.Marshal(result)
+	if err != nil {
+		return nil, err
+	}
+	return &JSONRPCResponse{
+		Version: JSONRPCVersion,
+		ID:      id,
+		Result:  raw,
+	}, nil
+}
+
+// isResponseLine tells if the JSON-RPC message line is a response, with a
+// result or an error. Responses are never responded, even when they match
+// no call, so that two sides never respond to each other endlessly.
+func isResponseLine(line []byte) bool {
+	var msg struct {
+		Result json.RawMessage `json:"result"`
+		Error  json.RawMessage `json:"error"`
+	}
+	return json.Unmarshal(line, &msg) == nil && (len(msg.Result) > 0 || len(msg.Error) > 0)
+}
@@ -0,0 +1,230 @@
+package jsonrps
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sync"
+	"time"
+)
+
+// minRateLimitSweep is the number of sessions and principals tracked by a
+// RateLimiter from which the idle ones are swept
+const minRateLimitSweep = 1024
+
+// ErrRateLimitExceeded is the termination reason of sessions closed by a
+// RateLimiter for persistently exceeding the limits
+var ErrRateLimitExceeded = errors.New("jsonrps: rate limit exceeded")
+
+// RateLimit is a token bucket limit on the rate of requests
+type RateLimit struct {
+	// Rate is the number of requests allowed per second in the long run.
+	// Zero means no limit.
+	Rate float64 `json:"rate"`
+
+	// Burst is the number of requests allowed at once. It is at least 1.
+	Burst int `json:"burst,omitempty"`
+}
+
+// RateLimitedData is the data of the ErrCodeRateLimited errors
+type RateLimitedData struct {
+	// RetryAfter is the time in milliseconds before the request would be
+	// allowed
+	RetryAfter int64 `json:"retryAfter"`
+}
+
+// RateLimiter is a method level layer limiting the rate of requests. The
+// requests exceeding any of the limits are responded with
+// ErrCodeRateLimited, and do not count against the other limits.
+//
+// The zero value limits nothing.
+type RateLimiter struct {
+	// Session limits the requests of each session
+	Session RateLimit `json:"session"`
+
+	// Principal limits the requests of each authenticated principal,
+	// across all its sessions, by Principal.Name
+	Principal RateLimit `json:"principal"`
+
+	// Methods limits the requests of each session by method name
+	Methods map[string]RateLimit `json:"methods,omitempty"`
+
+	// MaxRejections is the number of requests in a row rejected on a
+	// session after which the session is closed, with ErrRateLimitExceeded
+	// as termination reason. Zero never closes sessions.
+	MaxRejections int `json:"maxRejections,omitempty"`
+
+	mu         sync.Mutex
+	sessions   map[*Session]*sessionRateLimits
+	principals map[string]*tokenBucket
+	sweepAt    int // the number of tracked states triggering a sweep
+}
+
+// sessionRateLimits is the state of the limits of a session
+type sessionRateLimits struct {
+	bucket     tokenBucket
+	methods    map[string]*tokenBucket
+	rejections int
+
+	// stop stops the removal of the state once the session ends
+	stop func() bool
+}
+
+// tokenBucket is the state of a RateLimit
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// refill adds the tokens accumulated since the last refill, and returns
+// the delay until a token is available
+func (b *tokenBucket) refill(limit RateLimit, now time.Time) time.Duration {
+	burst := float64(max(limit.Burst, 1))
+	if b.last.IsZero() {
+		b.tokens = burst
+	} else {
+		b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*limit.Rate)
+	}
+	b.last = now
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second))
+}
+
+// full tells if the bucket is refilled to the burst of the limit by now,
+// in which case it is no different from a new bucket
+func (b *tokenBucket) full(limit RateLimit, now time.Time) bool {
+	if b.last.IsZero() || limit.Rate <= 0 {
+		return true
+	}
+	return b.tokens+now.Sub(b.last).Seconds()*limit.Rate >= float64(max(limit.Burst, 1))
+}
+
+// sweep forgets the sessions and principals whose buckets are all full,
+// so that the state does not grow with the sessions never ending, such as
+// those without Context, and with the principals. It runs once the state
+// doubled since the last sweep. The caller must hold l.mu.
+func (l *RateLimiter) sweep(now time.Time) {
+	if len(l.sessions)+len(l.principals) < max(l.sweepAt, minRateLimitSweep) {
+		return
+	}
+	for sess, state := range l.sessions {
+		idle := state.rejections == 0 && state.bucket.full(l.Session, now)
+		for method, bucket := range state.methods {
+			idle = idle && bucket.full(l.Methods[method], now)
+		}
+		if idle {
+			state.stop()
+			delete(l.sessions, sess)
+		}
+	}
+	for name, bucket := range l.principals {
+		if bucket.full(l.Principal, now) {
+			delete(l.principals, name)
+		}
+	}
+	l.sweepAt = 2 * (len(l.sessions) + len(l.principals))
+}
+
+// limitedBucket is a bucket limiting a request
+type limitedBucket struct {
+	bucket *tokenBucket
+	limit  RateLimit
+}
+
+// allow takes a token from each bucket limiting the request of the method,
+// if all of them have one. It returns the delay until the request would be
+// allowed otherwise, and the number of requests in a row rejected on the
+// session.
+func (l *RateLimiter) allow(sess *Session, principal *Principal, method string) (wait time.Duration, rejections int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.sweep(now)
+
+	state := l.sessions[sess]
+	if state == nil {
+		state = &sessionRateLimits{methods: make(map[string]*tokenBucket)}
+		if l.sessions == nil {
+			l.sessions = make(map[*Session]*sessionRateLimits)
+		}
+		l.sessions[sess] = state
+		state.stop = context.AfterFunc(sess.context(), func() {
+			l.mu.Lock()
+			if l.sessions[sess] == state {
+				delete(l.sessions, sess)
+			}
+			l.mu.Unlock()
+		})
+	}
+
+	var buckets []limitedBucket
+	if l.Session.Rate > 0 {
+		buckets = append(buckets, limitedBucket{&state.bucket, l.Session})
+	}
+	if limit := l.Methods[method]; limit.Rate > 0 {
+		bucket := state.methods[method]
+		if bucket == nil {
+			bucket = &tokenBucket{}
+			state.methods[method] = bucket
+		}
+		buckets = append(buckets, limitedBucket{bucket, limit})
+	}
+	if principal != nil && l.Principal.Rate > 0 {
+		bucket := l.principals[principal.Name]
+		if bucket == nil {
+			bucket = &tokenBucket{}
+			if l.principals == nil {
+				l.principals = make(map[string]*tokenBucket)
+			}
+			l.principals[principal.Name] = bucket
+		}
+		buckets = append(buckets, limitedBucket{bucket, l.Principal})
+	}
+
+	for _, b := range buckets {
+		wait = max(wait, b.bucket.refill(b.limit, now))
+	}
+	if wait > 0 {
+		state.rejections++
+		return wait, state.rejections
+	}
+	for _, b := range buckets {
+		b.bucket.tokens--
+	}
+	state.rejections = 0
+	return 0, 0
+}
+
+// Wrap returns a MethodHandler which only passes the requests within the
+// limits to next. Others are responded with ErrCodeRateLimited.
+//
+// The principal is looked up from the handler context, then from
+// Session.Context.
+func (l *RateLimiter) Wrap(next MethodHandler) MethodHandler {
+	return MethodHandlerFunc(func(ctx context.Context, sess *Session, req *JSONRPCRequest) *JSONRPCResponse {
+		wait, rejections := l.allow(sess, sessionPrincipal(ctx, sess), req.Method)
+		if wait == 0 {
+			return next.ServeMethod(ctx, sess, req)
+		}
+
+		var resp *JSONRPCResponse
+		if req.ID != nil {
+			retryAfter := (wait + time.Millisecond - 1) / time.Millisecond
+			resp = NewErrorResponse(req.ID, ErrCodeRateLimited, "rate limited", RateLimitedData{RetryAfter: int64(retryAfter)})
+		}
+		if l.MaxRejections > 0 && rejections >= l.MaxRejections {
+			sess.logger().Info("Closing session exceeding rate limits", "rejections", rejections)
+			if resp != nil {
+				if err := sess.WriteResponse(resp); err != nil {
+					sess.logger().Debug("Writing response failed", "error", err)
+				}
+			}
+			sess.terminate(ErrRateLimitExceeded)
+			sess.Conn.Close()
+			return nil
+		}
+		return resp
+	})
+}
@@ -0,0 +1,136 @@
+package jsonrps_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/yookoala/jsonrps"
+)
+
+// serveRateLimited serves the request lines on a session with the limiter
+// and returns the responses
+func serveRateLimited(t *testing.T, limiter *jsonrps.RateLimiter, session *jsonrps.Session, lines ...string) []*jsonrps.JSONRPCResponse {
+	t.Helper()
+	mux := jsonrps.NewMethodMux()
+	mux.Handle("echo", echoHandler)
+	mux.Handle("expensive", echoHandler)
+
+	conn := &mockReadWriteCloser{readData: strings.Join(lines, "\n") + "\n"}
+	session.Conn = conn
+	session.Logger = newTestLogger(t)
+	(&jsonrps.Dispatcher{Handler: limiter.Wrap(mux)}).HandleSession(session)
+	return decodeResponses(t, conn.writeData.String())
+}
+
+// assertRateLimited checks if the responses are rate limited as expected
+func assertRateLimited(t *testing.T, responses []*jsonrps.JSONRPCResponse, expected ...bool) {
+	t.Helper()
+	if len(responses) != len(expected) {
+		t.Fatalf("Expected %d responses, got %d", len(expected), len(responses))
+	}
+	for i, resp := range responses {
+		limited := resp.Error != nil && resp.Error.Code == jsonrps.ErrCodeRateLimited
+		if limited != expected[i] {
+			t.Errorf("Expected response %d rate limited %v, got %#v", i, expected[i], resp)
+		}
+	}
+}
+
+func TestRateLimiter_Session(t *testing.T) {
+	limiter := &jsonrps.RateLimiter{Session: jsonrps.RateLimit{Rate: 1, Burst: 2}}
+	responses := serveRateLimited(t, limiter, &jsonrps.Session{},
+		`{"jsonrpc":"2.0","method":"echo","id":1}`,
+		`{"jsonrpc":"2.0","method":"echo","id":2}`,
+		`{"jsonrpc":"2.0","method":"echo","id":3}`,
+		`{"jsonrpc":"2.0","method":"echo"}`,
+		`{"jsonrpc":"2.0","method":"echo","id":4}`,
+	)
+	assertRateLimited(t, responses, false, false, true, true)
+
+	var data jsonrps.RateLimitedData
+	raw, _ := json.Marshal(responses[2].Error.Data)
+	if err := json.Unmarshal(raw, &data); err != nil || data.RetryAfter <= 0 || data.RetryAfter > 1000 {
+		t.Errorf("Expected retry after up to 1000 ms, got %s", raw)
+	}
+
+	// each session has its own limit
+	responses = serveRateLimited(t, limiter, &jsonrps.Session{},
+		`{"jsonrpc":"2.0","method":"echo","id":1}`,
+	)
+	assertRateLimited(t, responses, false)
+}
+
+func TestRateLimiter_Methods(t *testing.T) {
+	limiter := &jsonrps.RateLimiter{Methods: map[string]jsonrps.RateLimit{"expensive": {Rate: 1}}}
+	responses := serveRateLimited(t, limiter, &jsonrps.Session{},
+		`{"jsonrpc":"2.0","method":"expensive","id":1}`,
+		`{"jsonrpc":"2.0","method":"expensive","id":2}`,
+		`{"jsonrpc":"2.0","method":"echo","id":3}`,
+		`{"jsonrpc":"2.0","method":"echo","id":4}`,
+	)
+	assertRateLimited(t, responses, false, true, false, false)
+}
+
+func TestRateLimiter_Principal(t *testing.T) {
+	limiter := &jsonrps.RateLimiter{
+		Session:   jsonrps.RateLimit{Rate: 1, Burst: 2},
+		Principal: jsonrps.RateLimit{Rate: 1, Burst: 3},
+	}
+	alice := jsonrps.ContextWithPrincipal(context.Background(), &jsonrps.Principal{Name: "alice"})
+
+	// the limit of the principal is shared by its sessions
+	responses := serveRateLimited(t, limiter, &jsonrps.Session{Context: alice},
+		`{"jsonrpc":"2.0","method":"echo","id":1}`,
+		`{"jsonrpc":"2.0","method":"echo","id":2}`,
+	)
+	assertRateLimited(t, responses, false, false)
+	responses = serveRateLimited(t, limiter, &jsonrps.Session{Context: alice},
+		`{"jsonrpc":"2.0","method":"echo","id":1}`,
+		`{"jsonrpc":"2.0","method":"echo","id":2}`,
+	)
+	assertRateLimited(t, responses, false, true)
+
+	// anonymous sessions are only limited by session
+	responses = serveRateLimited(t, limiter, &jsonrps.Session{},
+		`{"jsonrpc":"2.0","method":"echo","id":1}`,
+		`{"jsonrpc":"2.0","method":"echo","id":2}`,
+	)
+	assertRateLimited(t, responses, false, false)
+}
+
+func TestRateLimiter_MaxRejections(t *testing.T) {
+	limiter := &jsonrps.RateLimiter{Session: jsonrps.RateLimit{Rate: 1}, MaxRejections: 2}
+	session := &jsonrps.Session{}
+	responses := serveRateLimited(t, limiter, session,
+		`{"jsonrpc":"2.0","method":"echo","id":1}`,
+		`{"jsonrpc":"2.0","method":"echo","id":2}`,
+		`{"jsonrpc":"2.0","method":"echo","id":3}`,
+		`{"jsonrpc":"2.0","method":"echo","id":4}`,
+	)
+	assertRateLimited(t, responses, false, true, true)
+	if err := session.Err(); !errors.Is(err, jsonrps.ErrRateLimitExceeded) {
+		t.Errorf("Expected session closed for exceeding the rate limit, got %v", err)
+	}
+}
+
+func TestRateLimiter_Sweep(t *testing.T) {
+	limiter := &jsonrps.RateLimiter{Session: jsonrps.RateLimit{Rate: 1, Burst: 2}}
+	handler := limiter.Wrap(echoHandler)
+	call := func(sess *jsonrps.Session) *jsonrps.JSONRPCResponse {
+		return handler.ServeMethod(context.Background(), sess, &jsonrps.JSONRPCRequest{Version: jsonrps.JSONRPCVersion, Method: "echo", ID: 1})
+	}
+	busy := &jsonrps.Session{Logger: newTestLogger(t)}
+	call(busy)
+	call(busy)
+
+	// sweeping the idle sessions keeps the state of the busy one
+	for range 3000 {
+		call(&jsonrps.Session{Logger: newTestLogger(t)})
+	}
+	if resp := call(busy); resp.Error == nil || resp.Error.Code != jsonrps.ErrCodeRateLimited {
+		t.Errorf("Expected the busy session still rate limited, got %#v", resp)
+	}
+}
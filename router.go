@@ -0,0 +1,173 @@
+package jsonrps
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Route is a declarative rule of SessionRouter. A session matches the
+// route only if it matches all the conditions which are set.
+//
+// Patterns use the syntax of [path.Match]. A pattern ending with "**"
+// matches any string starting with the part before "**".
+type Route struct {
+	// Name describes the route for introspection
+	Name string
+
+	// Method is the pattern of the method requested in the request line
+	// of the session (e.g. "GET", "SUBSCRIBE /news/*" or "/admin/**").
+	// Empty pattern matches any method.
+	Method string
+
+	// Headers maps the remote header names to the value patterns.
+	// A header matches if any of its values matches the pattern.
+	Headers map[string]string
+
+	// Match is an optional matcher for conditions not expressible
+	// with patterns (e.g. checking [Session.PeerIdentities])
+	Match func(sess *Session) bool
+
+	// Priority orders the routes. Routes of higher priority are tried
+	// first. Routes of the same priority are tried in registration order.
+	Priority int
+
+	// Handler handles the matched sessions
+	Handler SessionHandler
+}
+
+// Validate checks the patterns and handler of the route
+func (route *Route) Validate() error {
+	if route.Handler == nil {
+		return fmt.Errorf("route %q has no handler", route.Name)
+	}
+	if _, err := path.Match(route.Method, ""); err != nil {
+		return fmt.Errorf("route %q: invalid method pattern %q: %w", route.Name, route.Method, err)
+	}
+	for key, pattern := range route.Headers {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("route %q: invalid pattern %q of header %s: %w", route.Name, pattern, key, err)
+		}
+	}
+	return nil
+}
+
+// Matches reports if the session matches all the conditions of the route
+func (route *Route) Matches(sess *Session) bool {
+	if route.Method != "" && !matchPattern(route.Method, sess.Method) {
+		return false
+	}
+	for key, pattern := range route.Headers {
+		if !containsPattern(sess.RemoteHeaders.Values(key), pattern) {
+			return false
+		}
+	}
+	return route.Match == nil || route.Match(sess)
+}
+
+// containsPattern reports if any of the values matches the pattern
+func containsPattern(values []string, pattern string) bool {
+	for _, value := range values {
+		if matchPattern(pattern, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchPattern reports if the name matches the pattern in the syntax of
+// [path.Match], or starts with the prefix of a pattern ending with "**"
+func matchPattern(pattern, name string) bool {
+	if prefix, ok := strings.CutSuffix(pattern, "**"); ok {
+		return strings.HasPrefix(name, prefix)
+	}
+	ok, _ := path.Match(pattern, name)
+	return ok
+}
+
+// SessionRouter is a ServerSessionHandler which routes sessions to
+// handlers by declarative routes matching the requested method and
+// the request headers.
+//
+// The zero value is ready to use.
+type SessionRouter struct {
+	// Fallback handles sessions matching no route. If nil, such sessions
+	// are not handled by the router.
+	Fallback SessionHandler
+
+	mu     sync.RWMutex
+	routes []Route
+}
+
+// NewSessionRouter creates a new SessionRouter with the fallback handler,
+// which may be nil
+func NewSessionRouter(fallback SessionHandler) *SessionRouter {
+	return &SessionRouter{Fallback: fallback}
+}
+
+// Handle registers the route. It returns error if the route is invalid.
+func (r *SessionRouter) Handle(route Route) error {
+	if err := route.Validate(); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.routes = append(r.routes, route)
+	sort.SliceStable(r.routes, func(i, j int) bool {
+		return r.routes[i].Priority > r.routes[j].Priority
+	})
+	return nil
+}
+
+// HandleMethod registers a route of the method pattern to the handler
+func (r *SessionRouter) HandleMethod(method string, handler SessionHandler) error {
+	return r.Handle(Route{Name: method, Method: method, Handler: handler})
+}
+
+// Routes returns the registered routes in the order they are tried
+func (r *SessionRouter) Routes() []Route {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	routes := make([]Route, len(r.routes))
+	copy(routes, r.routes)
+	return routes
+}
+
+// Route returns the first route matching the session
+func (r *SessionRouter) Route(sess *Session) (route Route, ok bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, route := range r.routes {
+		if route.Matches(sess) {
+			return route, true
+		}
+	}
+	return Route{}, false
+}
+
+// CanHandleSession checks if any route matches the session, or if
+// there is a fallback handler
+func (r *SessionRouter) CanHandleSession(sess *Session) bool {
+	if _, ok := r.Route(sess); ok {
+		return true
+	}
+	return r.Fallback != nil
+}
+
+// HandleSession passes the session to the handler of the first matching
+// route, or to the fallback handler. Sessions which cannot be handled are
+// responded with 404 Not Found.
+func (r *SessionRouter) HandleSession(sess *Session) {
+	if route, ok := r.Route(sess); ok {
+		route.Handler.HandleSession(sess)
+		return
+	}
+	if r.Fallback != nil {
+		r.Fallback.HandleSession(sess)
+		return
+	}
+	sess.WriteResponseHeader(http.StatusNotFound)
+}
@@ -0,0 +1,150 @@
+package jsonrps_test
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/yookoala/jsonrps"
+)
+
+// namedSessionHandler records the name of the handler handling a session
+type namedSessionHandler struct {
+	name    string
+	handled *string
+}
+
+func (h *namedSessionHandler) HandleSession(sess *jsonrps.Session) {
+	*h.handled = h.name
+}
+
+func TestSessionRouter_Routing(t *testing.T) {
+	var handled string
+	handler := func(name string) jsonrps.SessionHandler {
+		return &namedSessionHandler{name: name, handled: &handled}
+	}
+
+	router := jsonrps.NewSessionRouter(handler("fallback"))
+	routes := []jsonrps.Route{
+		{Name: "get", Method: "GET", Handler: handler("get")},
+		{Name: "news", Method: "SUBSCRIBE /news/*", Handler: handler("news")},
+		{Name: "admin", Method: "/admin/**", Handler: handler("admin")},
+		{Name: "v2", Method: "GET", Headers: map[string]string{"X-Version": "2*"}, Priority: 10, Handler: handler("v2")},
+		{Name: "json", Headers: map[string]string{"Accept": "application/json*"}, Priority: -1, Handler: handler("json")},
+		{
+			Name:    "internal",
+			Method:  "POST",
+			Match:   func(sess *jsonrps.Session) bool { return sess.RemoteHeaders.Get("X-Internal") == "yes" },
+			Handler: handler("internal"),
+		},
+	}
+	for _, route := range routes {
+		if err := router.Handle(route); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	tests := []struct {
+		method   string
+		headers  http.Header
+		expected string
+	}{
+		{"GET", nil, "get"},
+		{"GET", http.Header{"X-Version": {"2.1"}}, "v2"},
+		{"GET", http.Header{"X-Version": {"1.0", "2.0"}}, "v2"},
+		{"GET", http.Header{"X-Version": {"1.0"}}, "get"},
+		{"SUBSCRIBE /news/sports", nil, "news"},
+		{"SUBSCRIBE /news/sports/football", nil, "fallback"},
+		{"/admin/users/delete", nil, "admin"},
+		{"POST", http.Header{"Accept": {"application/json+rps"}}, "json"},
+		{"POST", http.Header{"X-Internal": {"yes"}}, "internal"},
+		{"DELETE", nil, "fallback"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method, func(t *testing.T) {
+			handled = ""
+			sess := &jsonrps.Session{Method: tt.method, RemoteHeaders: tt.headers}
+			if !router.CanHandleSession(sess) {
+				t.Fatal("Expected router to handle session")
+			}
+			router.HandleSession(sess)
+			if handled != tt.expected {
+				t.Errorf("Expected handler %q, got %q", tt.expected, handled)
+			}
+		})
+	}
+}
+
+func TestSessionRouter_Routes(t *testing.T) {
+	var router jsonrps.SessionRouter
+	handler := &mockSessionHandler{}
+	router.Handle(jsonrps.Route{Name: "low", Priority: -5, Handler: handler})
+	router.Handle(jsonrps.Route{Name: "first", Handler: handler})
+	router.Handle(jsonrps.Route{Name: "high", Priority: 5, Handler: handler})
+	router.HandleMethod("GET", handler)
+
+	var names []string
+	for _, route := range router.Routes() {
+		names = append(names, route.Name)
+	}
+	if strings.Join(names, ",") != "high,first,GET,low" {
+		t.Errorf("Unexpected route order %v", names)
+	}
+}
+
+func TestSessionRouter_Invalid(t *testing.T) {
+	var router jsonrps.SessionRouter
+	if err := router.Handle(jsonrps.Route{Name: "no handler"}); err == nil {
+		t.Error("Expected error for route without handler")
+	}
+	if err := router.HandleMethod("[GET", &mockSessionHandler{}); err == nil {
+		t.Error("Expected error for invalid method pattern")
+	}
+	err := router.Handle(jsonrps.Route{
+		Headers: map[string]string{"Accept": "[json"},
+		Handler: &mockSessionHandler{},
+	})
+	if err == nil {
+		t.Error("Expected error for invalid header pattern")
+	}
+	if len(router.Routes()) != 0 {
+		t.Errorf("Expected no route registered, got %d", len(router.Routes()))
+	}
+}
+
+func TestSessionRouter_NoMatch(t *testing.T) {
+	var router jsonrps.SessionRouter
+	router.HandleMethod("GET", &mockSessionHandler{})
+
+	conn := &mockReadWriteCloser{}
+	sess := &jsonrps.Session{Method: "POST", Conn: conn, Logger: newTestLogger(t)}
+	if router.CanHandleSession(sess) {
+		t.Error("Expected router not to handle session")
+	}
+	router.HandleSession(sess)
+	if !strings.HasPrefix(conn.writeData.String(), "RPS/1.0 404 Not Found\r\n") {
+		t.Errorf("Expected 404 response, got %q", conn.writeData.String())
+	}
+}
+
+func TestSessionRouter_WithServer(t *testing.T) {
+	router := jsonrps.NewSessionRouter(nil)
+	router.Handle(jsonrps.Route{
+		Method:  "RPC",
+		Headers: map[string]string{"Accept": jsonrps.DefaultMimeType},
+		Handler: &jsonrps.Dispatcher{Handler: echoHandler},
+	})
+	addr := startTestServer(t, &jsonrps.Server{Handler: router, Logger: newTestLogger(t)})
+
+	d := &jsonrps.Dialer{Headers: http.Header{"Accept": {jsonrps.DefaultMimeType}}}
+	sess, err := d.DialContext(context.Background(), "tcp", addr, "RPC")
+	if err != nil {
+		t.Fatalf("Unexpected dial error: %v", err)
+	}
+	sess.Close()
+
+	if _, err := jsonrps.Dial("tcp", addr, "RPC"); err == nil {
+		t.Error("Expected dial without Accept header to fail")
+	}
+}
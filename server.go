@@ -0,0 +1,285 @@
+package jsonrps
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ErrServerClosed is returned by the Server's Serve and ListenAndServe
+// methods after a call to Close.
+var ErrServerClosed = errors.New("jsonrps: Server closed")
+
+// Server accepts RPS connections and serves each of them as a Session
+type Server struct {
+	// Handler handles every accepted session. If it implements
+	// ServerSessionHandler, sessions it cannot handle are responded
+	// with 404 Not Found and closed.
+	Handler SessionHandler
+
+	// SessionMiddlewares wrap Handler for every session it can handle.
+	// The first middleware is the outermost one.
+	SessionMiddlewares []SessionMiddleware
+
+	// TLSConfig, if set, makes the server accept TLS connections only.
+	// Set ClientAuth to tls.RequireAndVerifyClientCert for mutual TLS.
+	TLSConfig *tls.Config
+
+	// HandshakeTimeout limits the time to read the request header of a
+	// new session. Zero means no timeout.
+	HandshakeTimeout time.Duration
+
+	// Logger is used for the server and all its sessions. The default
+	// logger is used if nil.
+	Logger *slog.Logger
+
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	closed    bool
+}
+
+// ListenAndServe listens on the TCP network address and serves
+// accepted connections
+func (srv *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return srv.Serve(l)
+}
+
+// Serve accepts connections on the listener and serves each of them in
+// a new goroutine. The listener is wrapped with TLS if TLSConfig is set.
+func (srv *Server) Serve(l net.Listener) error {
+	if srv.TLSConfig != nil {
+		l = tls.NewListener(l, srv.TLSConfig)
+	}
+	if !track(srv, l, &srv.listeners) {
+		l.Close()
+		return ErrServerClosed
+	}
+	defer untrack(srv, l, srv.listeners)
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if srv.isClosed() {
+				return ErrServerClosed
+			}
+			return err
+		}
+		go srv.ServeConn(context.Background(), conn)
+	}
+}
+
+// ServeConn reads the request header of a single connection and serves
+// it as a Session. It blocks until the session handler returns, then
+// closes the connection.
+func (srv *Server) ServeConn(ctx context.Context, conn net.Conn) {
+	if !track(srv, conn, &srv.conns) {
+		conn.Close()
+		return
+	}
+	defer untrack(srv, conn, srv.conns)
+	defer conn.Close()
+
+	logger := srv.logger()
+	if srv.HandshakeTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(srv.HandshakeTimeout))
+	}
+
+	sess := &Session{
+		ID:           newSessionID(),
+		LocalHeaders: make(http.Header),
+		Conn:         conn,
+		Logger:       logger,
+	}
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			logger.Debug("TLS handshake failed", "remote", conn.RemoteAddr(), "error", err)
+			return
+		}
+		state := tlsConn.ConnectionState()
+		sess.TLS = &state
+	}
+	if err := sess.ReadRequestHeader(); err != nil {
+		logger.Debug("Reading request header failed", "remote", conn.RemoteAddr(), "error", err)
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	serveSession(ctx, srv.Handler, srv.SessionMiddlewares, sess, logger)
+}
+
+// serveSession passes the session, whose request header has been read,
+// to the handler wrapped by the middlewares. Sessions the handler cannot
+// handle are responded with 404 Not Found. The session context is
+// cancelled once the session is handled.
+func serveSession(ctx context.Context, handler SessionHandler, middlewares []SessionMiddleware, sess *Session, logger *slog.Logger) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	sess.Context = ctx
+	sess.Logger = logger.With("session", sess.ID)
+
+	if h, ok := handler.(ServerSessionHandler); ok && !h.CanHandleSession(sess) {
+		sess.WriteResponseHeader(http.StatusNotFound)
+		return
+	}
+	ChainSession(handler, middlewares...).HandleSession(sess)
+}
+
+// Close immediately closes all listeners and connections of the server
+func (srv *Server) Close() error {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.closed = true
+	var err error
+	for l := range srv.listeners {
+		err = errors.Join(err, l.Close())
+	}
+	for conn := range srv.conns {
+		err = errors.Join(err, conn.Close())
+	}
+	return err
+}
+
+// logger returns the server logger, or the default logger if none
+// has been set
+func (srv *Server) logger() *slog.Logger {
+	if srv.Logger == nil {
+		return slog.Default()
+	}
+	return srv.Logger
+}
+
+// isClosed reports if the server has been closed
+func (srv *Server) isClosed() bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.closed
+}
+
+// track adds the item to the set, unless the server has been closed
+func track[T comparable](srv *Server, item T, set *map[T]struct{}) bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.closed {
+		return false
+	}
+	if *set == nil {
+		*set = make(map[T]struct{})
+	}
+	(*set)[item] = struct{}{}
+	return true
+}
+
+// untrack removes the item from the set
+func untrack[T comparable](srv *Server, item T, set map[T]struct{}) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	delete(set, item)
+}
+
+// Dialer contains options for connecting to an RPS server
+type Dialer struct {
+	// NetDialer is used to establish the network connection
+	NetDialer net.Dialer
+
+	// TLSConfig, if set, makes the dialer connect with TLS. Set
+	// Certificates for mutual TLS.
+	TLSConfig *tls.Config
+
+	// Headers are sent as the request headers of the session
+	Headers http.Header
+
+	// Logger is used for the dialed sessions. The default logger is
+	// used if nil.
+	Logger *slog.Logger
+}
+
+// Dial connects to the address on the named network, requests the method
+// and returns the established client session.
+func Dial(network, address, method string) (*Session, error) {
+	var d Dialer
+	return d.DialContext(context.Background(), network, address, method)
+}
+
+// DialContext connects to the address on the named network, requests
+// the method and returns the established client session.
+//
+// The context only limits the connection and the header exchange. Once
+// the session is established, expiration of the context does not affect it.
+// It returns error if the server does not respond with status 200 OK.
+func (d *Dialer) DialContext(ctx context.Context, network, address, method string) (*Session, error) {
+	var conn net.Conn
+	var err error
+	if d.TLSConfig != nil {
+		tlsDialer := &tls.Dialer{NetDialer: &d.NetDialer, Config: d.TLSConfig}
+		conn, err = tlsDialer.DialContext(ctx, network, address)
+	} else {
+		conn, err = d.NetDialer.DialContext(ctx, network, address)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	logger := d.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	sess := &Session{
+		ID:           newSessionID(),
+		LocalHeaders: d.Headers.Clone(),
+		Context:      context.Background(),
+		Conn:         conn,
+		Logger:       logger,
+	}
+	if sess.LocalHeaders == nil {
+		sess.LocalHeaders = make(http.Header)
+	}
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		state := tlsConn.ConnectionState()
+		sess.TLS = &state
+	}
+
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now())
+	})
+	defer stop()
+
+	sess.WriteRequestHeader(method)
+	if err = sess.ReadResponseHeader(); err != nil {
+		conn.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	if !stop() {
+		conn.Close()
+		return nil, ctx.Err()
+	}
+	conn.SetDeadline(time.Time{})
+
+	if sess.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("jsonrps: server responded %d %s", sess.StatusCode, http.StatusText(sess.StatusCode))
+	}
+	return sess, nil
+}
+
+// newSessionID generates a random session identifier
+func newSessionID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,212 @@
+package jsonrps_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yookoala/jsonrps"
+)
+
+// startTestServer serves the server on a local listener until the test ends
+func startTestServer(t *testing.T, srv *jsonrps.Server) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- srv.Serve(l)
+	}()
+	t.Cleanup(func() {
+		srv.Close()
+		if err := <-done; !errors.Is(err, jsonrps.ErrServerClosed) {
+			t.Errorf("Expected ErrServerClosed, got %v", err)
+		}
+	})
+	return l.Addr().String()
+}
+
+func TestServer_DialAndCall(t *testing.T) {
+	mux := jsonrps.NewMethodMux()
+	mux.Handle("echo", echoHandler)
+
+	var gotMethod, gotAgent string
+	handler := jsonrps.MethodHandlerFunc(func(ctx context.Context, sess *jsonrps.Session, req *jsonrps.JSONRPCRequest) *jsonrps.JSONRPCResponse {
+		gotMethod = sess.Method
+		gotAgent = sess.RemoteHeaders.Get("User-Agent")
+		return mux.ServeMethod(ctx, sess, req)
+	})
+
+	addr := startTestServer(t, &jsonrps.Server{
+		Handler:          &jsonrps.Dispatcher{Handler: handler},
+		HandshakeTimeout: time.Second,
+		Logger:           newTestLogger(t),
+	})
+
+	dialer := &jsonrps.Dialer{
+		Headers: http.Header{"User-Agent": []string{"test-client/1.0"}},
+		Logger:  newTestLogger(t),
+	}
+	sess, err := dialer.DialContext(context.Background(), "tcp", addr, "GET")
+	if err != nil {
+		t.Fatalf("Unexpected dial error: %v", err)
+	}
+	defer sess.Close()
+
+	if sess.StatusCode != http.StatusOK {
+		t.Errorf("Expected status 200, got %d", sess.StatusCode)
+	}
+	if sess.ProtocolSignature != jsonrps.DefaultProtocolSignature {
+		t.Errorf("Expected protocol signature %q, got %q", jsonrps.DefaultProtocolSignature, sess.ProtocolSignature)
+	}
+
+	for i := 1; i <= 2; i++ {
+		err = sess.WriteRequest(&jsonrps.JSONRPCRequest{
+			Version: "2.0",
+			Method:  "echo",
+			Params:  json.RawMessage(`"hello"`),
+			ID:      i,
+		})
+		if err != nil {
+			t.Fatalf("Unexpected write error: %v", err)
+		}
+		resp, err := sess.ReadResponse()
+		if err != nil {
+			t.Fatalf("Unexpected read error: %v", err)
+		}
+		if string(resp.Result) != `"hello"` {
+			t.Errorf("Expected echoed result, got %s", resp.Result)
+		}
+		if resp.ID != float64(i) {
+			t.Errorf("Expected ID %d, got %v", i, resp.ID)
+		}
+	}
+
+	if gotMethod != "GET" {
+		t.Errorf("Expected session method %q, got %q", "GET", gotMethod)
+	}
+	if gotAgent != "test-client/1.0" {
+		t.Errorf("Expected remote User-Agent %q, got %q", "test-client/1.0", gotAgent)
+	}
+}
+
+func TestServer_CannotHandleSession(t *testing.T) {
+	addr := startTestServer(t, &jsonrps.Server{
+		Handler: jsonrps.ServerSessionRouter{&mockServerSessionHandler{canHandle: false}},
+		Logger:  newTestLogger(t),
+	})
+
+	_, err := jsonrps.Dial("tcp", addr, "GET")
+	if err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("Expected 404 error, got %v", err)
+	}
+}
+
+func TestServer_MalformedRequestLine(t *testing.T) {
+	addr := startTestServer(t, &jsonrps.Server{
+		Handler: &mockSessionHandler{},
+		Logger:  newTestLogger(t),
+	})
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Error("Expected connection to be closed")
+	}
+}
+
+func TestDialer_ContextTimeout(t *testing.T) {
+	// a listener which accepts but never responds
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			defer conn.Close()
+			time.Sleep(time.Second)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	var d jsonrps.Dialer
+	if _, err := d.DialContext(ctx, "tcp", l.Addr().String(), "GET"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected deadline exceeded, got %v", err)
+	}
+}
+
+func TestSession_ReadRequestHeader(t *testing.T) {
+	conn := &mockReadWriteCloser{
+		readData: "RPS/1.0 SUBSCRIBE\r\nAccept: application/json+rps\r\nX-Version: 2\r\n\r\n" +
+			`{"jsonrpc":"2.0","method":"ping","id":1}` + "\n",
+	}
+	sess := &jsonrps.Session{Conn: conn}
+
+	if err := sess.ReadRequestHeader(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if sess.ProtocolSignature != "RPS/1.0" || sess.Method != "SUBSCRIBE" {
+		t.Errorf("Unexpected request line %q %q", sess.ProtocolSignature, sess.Method)
+	}
+	if sess.RemoteHeaders.Get("X-Version") != "2" {
+		t.Errorf("Unexpected headers %v", sess.RemoteHeaders)
+	}
+
+	req, err := sess.ReadRequest()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if req.Method != "ping" {
+		t.Errorf("Expected method ping, got %q", req.Method)
+	}
+}
+
+func TestSession_ReadResponseHeader(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		code    int
+		wantErr bool
+	}{
+		{"ok", "RPS/1.0 200 OK\r\nContent-Type: application/json+rps\r\n\r\n", 200, false},
+		{"not found", "RPS/1.0 404 Not Found\r\n\r\n", 404, false},
+		{"not rps", "HTTP/1.1 200 OK\r\n\r\n", 0, true},
+		{"bad code", "RPS/1.0 OK\r\n\r\n", 0, true},
+		{"truncated", "RPS/1.0 200 OK\r\n", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sess := &jsonrps.Session{Conn: &mockReadWriteCloser{readData: tt.input}}
+			err := sess.ReadResponseHeader()
+			if tt.wantErr {
+				if err == nil {
+					t.Error("Expected error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if sess.StatusCode != tt.code {
+				t.Errorf("Expected status %d, got %d", tt.code, sess.StatusCode)
+			}
+		})
+	}
+}
@@ -3,11 +3,17 @@ package jsonrps
 import (
 	"bufio"
 	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
 )
 
 const (
@@ -21,6 +27,10 @@ const (
 	DefaultMimeType = "application/json+rps"
 )
 
+// ErrSessionClosed is the termination reason of sessions closed by
+// [Session.Close]
+var ErrSessionClosed = errors.New("jsonrps: session closed")
+
 // Session is the raw I/O session between a server and a client
 type Session struct {
 	// ID is the internal identifier of a server-client session
@@ -30,6 +40,14 @@ type Session struct {
 	// by the server of the protocol type and version
 	ProtocolSignature string
 
+	// Method is the method requested by the client in the request line
+	// of the session (e.g. "RPS/1.0 GET")
+	Method string
+
+	// StatusCode is the status code responded by the server in the
+	// response line of the session (e.g. "RPS/1.0 200 OK")
+	StatusCode int
+
 	// LocalHeaders is the HTTP headers associated with this side
 	// of this session
 	LocalHeaders http.Header
@@ -45,11 +63,58 @@ type Session struct {
 	// Conn is the session connection between a server and a client
 	Conn io.ReadWriteCloser
 
+	// TLS contains information about the TLS connection of the session,
+	// or nil if the session is not over TLS
+	TLS *tls.ConnectionState
+
 	// Logger is a properly initialized for logger
 	Logger *slog.Logger
 
 	// headerSent indicates if the headers have been sent
 	headerSent bool
+
+	// handshake, if set, sends the response status and LocalHeaders
+	// through the transport handshake instead of writing them to Conn
+	handshake func(statusCode int)
+
+	// reader buffers reads from Conn so that consecutive lines
+	// are not lost between calls
+	reader *bufio.Reader
+
+	// writeMu serializes writes of lines to Conn
+	writeMu sync.Mutex
+
+	// mu protects err
+	mu sync.Mutex
+
+	// err is the reason of the session termination
+	err error
+}
+
+// logger returns the session logger, or the default logger if none
+// has been set
+func (sess *Session) logger() *slog.Logger {
+	if sess.Logger == nil {
+		return slog.Default()
+	}
+	return sess.Logger
+}
+
+// context returns the session context, or a background context if none
+// has been set
+func (sess *Session) context() context.Context {
+	if sess.Context == nil {
+		return context.Background()
+	}
+	return sess.Context
+}
+
+// readLine reads a single "\n" terminated line from the session connection
+func (sess *Session) readLine() ([]byte, error) {
+	if sess.reader == nil {
+		sess.reader = bufio.NewReader(sess.Conn)
+	}
+	return sess.reader.ReadBytes('\n')
 }
 
 // WriteHeaders sends the local header for the session without any protocol signature
@@ -58,13 +123,13 @@ func (sess *Session) WriteHeaders() {
 	for key, values := range sess.LocalHeaders {
 		for _, value := range values {
 			fmt.Fprintf(sess.Conn, "%s: %s\r\n", key, value)
-			sess.Logger.Debug("Writing header", "key", key, "value", value)
+			sess.logger().Debug("Writing header", "key", key, "value", value)
 		}
 	}
 
 	// Finish sending the header over
 	fmt.Fprintf(sess.Conn, "\r\n")
-	sess.Logger.Debug("Writing header finishing mark")
+	sess.logger().Debug("Writing header finishing mark")
 	sess.headerSent = true
 }
 
@@ -78,13 +143,77 @@ func (sess *Session) WriteRequestHeader(method string) {
 // WriteResponseHeader sends the status code along with local header for the session with resposne
 // protocol signature.
 func (sess *Session) WriteResponseHeader(statusCode int) {
+	if sess.handshake != nil {
+		// The transport sends the header in its own handshake
+		sess.handshake(statusCode)
+		sess.headerSent = true
+		return
+	}
 	fmt.Fprintf(sess.Conn, "%s %d %s\r\n", DefaultProtocolSignature, statusCode, http.StatusText(statusCode))
 	sess.WriteHeaders()
 }
 
+// readHeaderLine reads the first line of the session and the header fields
+// following it, up to the finishing blank line
+func (sess *Session) readHeaderLine() (line string, err error) {
+	if sess.reader == nil {
+		sess.reader = bufio.NewReader(sess.Conn)
+	}
+	reader := textproto.NewReader(sess.reader)
+	if line, err = reader.ReadLine(); err != nil {
+		return
+	}
+	header, err := reader.ReadMIMEHeader()
+	if err != nil {
+		return
+	}
+	sess.RemoteHeaders = http.Header(header)
+	return
+}
+
+// ReadRequestHeader reads the request line and the headers sent by the
+// client side of the session. It fills ProtocolSignature, Method and
+// RemoteHeaders of the session.
+func (sess *Session) ReadRequestHeader() error {
+	line, err := sess.readHeaderLine()
+	if err != nil {
+		return err
+	}
+	signature, method, _ := strings.Cut(line, " ")
+	if !strings.HasPrefix(signature, "RPS/") {
+		return fmt.Errorf("malformed request line: %q", line)
+	}
+	sess.ProtocolSignature = signature
+	sess.Method = method
+	return nil
+}
+
+// ReadResponseHeader reads the status line and the headers sent by the
+// server side of the session. It fills ProtocolSignature, StatusCode and
+// RemoteHeaders of the session.
+func (sess *Session) ReadResponseHeader() error {
+	line, err := sess.readHeaderLine()
+	if err != nil {
+		return err
+	}
+	signature, status, _ := strings.Cut(line, " ")
+	code, _, _ := strings.Cut(status, " ")
+	statusCode, err := strconv.Atoi(code)
+	if !strings.HasPrefix(signature, "RPS/") || err != nil {
+		return fmt.Errorf("malformed status line: %q", line)
+	}
+	sess.ProtocolSignature = signature
+	sess.StatusCode = statusCode
+	return nil
+}
+
 // Write writes the response body to the session.
 func (sess *Session) Write(p []byte) (n int, err error) {
-	if !sess.headerSent {
+	sess.writeMu.Lock()
+	defer sess.writeMu.Unlock()
+	if !sess.headerSent && sess.handshake != nil {
+		sess.WriteResponseHeader(http.StatusOK)
+	} else if !sess.headerSent {
 		// Finish sending the header over
 		fmt.Fprintf(sess.Conn, "\r\n")
 		sess.headerSent = true
@@ -107,12 +236,12 @@ func (sess *Session) WriteRequest(request *JSONRPCRequest) (err error) {
 // ReadRequest reads a single line from the session connection,
 // and they try to decoded it as JSON
 func (sess *Session) ReadRequest() (request *JSONRPCRequest, err error) {
-	var line string
-	line, err = bufio.NewReader(sess.Conn).ReadString('\n')
+	var line []byte
+	line, err = sess.readLine()
 	if err != nil {
 		return
 	}
-	err = json.Unmarshal([]byte(line), &request)
+	err = json.Unmarshal(line, &request)
 	return
 }
 
@@ -131,12 +260,12 @@ func (sess *Session) WriteResponse(response *JSONRPCResponse) (err error) {
 // ReadResponse reads a JSON-RPC response from the session connection
 // with an ending "\n"
 func (sess *Session) ReadResponse() (response *JSONRPCResponse, err error) {
-	var line string
-	line, err = bufio.NewReader(sess.Conn).ReadString('\n')
+	var line []byte
+	line, err = sess.readLine()
 	if err != nil {
 		return
 	}
-	err = json.Unmarshal([]byte(line), &response)
+	err = json.Unmarshal(line, &response)
 	return
 }
 
@@ -161,8 +290,29 @@ func (sess *Session) Header() http.Header {
 	return sess.LocalHeaders
 }
 
+// Err returns the reason the session terminated, or nil while the session
+// is active. It is io.EOF if the remote side closed the session,
+// ErrSessionClosed if the session was closed by [Session.Close], the
+// cause of the session context if it is done, or any connection error.
+func (sess *Session) Err() error {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	return sess.err
+}
+
+// terminate records the reason of the session termination. Only the
+// first reason is kept.
+func (sess *Session) terminate(err error) {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	if sess.err == nil {
+		sess.err = err
+	}
+}
+
 // Close closes the session connection
 func (sess *Session) Close() error {
+	sess.terminate(ErrSessionClosed)
 	return sess.Conn.Close()
 }
 
@@ -0,0 +1,219 @@
+package jsonrps
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DefaultSSEBufferSize is the default number of notifications buffered
+// for a slow SSE client before its stream is closed
+const DefaultSSEBufferSize = 64
+
+// errSSEOverflow is returned to the broker when the buffer of an SSE
+// client is full
+var errSSEOverflow = errors.New("jsonrps: server-sent events buffer overflow")
+
+// SSEHandler is an http.Handler which streams the notifications of
+// Broker topics to HTTP clients as Server-Sent Events, for clients
+// which cannot use RPS sessions or WebSocket.
+//
+// The topics are requested by the "topic" query parameter, which may
+// be repeated (e.g. "/events?topic=news&topic=weather"). Each notification
+// is sent as the data of an SSE "message" event, encoded as a JSON-RPC
+// notification with Method and Params.
+//
+// The "id" of each event holds the sequence numbers of the last
+// notification of every topic of the stream, as a query string (e.g.
+// "news=42&weather=7"). A client reconnecting with the Last-Event-ID
+// header resumes with the notifications retained by Broker.Store after
+// them, before the new notifications.
+type SSEHandler struct {
+	// Broker is the source of the notifications
+	Broker *Broker
+
+	// BufferSize is the number of notifications buffered for a slow
+	// client before its stream is closed. DefaultSSEBufferSize is used
+	// if zero.
+	BufferSize int
+
+	// KeepAlive is the interval of the comment lines sent to keep idle
+	// streams open through proxies. Zero disables them.
+	KeepAlive time.Duration
+
+	// Logger is used for all streams. The default logger is used if nil.
+	Logger *slog.Logger
+}
+
+// ServeHTTP subscribes to the requested topics and streams the
+// notifications until the client disconnects
+func (h *SSEHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	topics := r.URL.Query()["topic"]
+	if len(topics) == 0 {
+		http.Error(w, "topic is required", http.StatusBadRequest)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	logger := h.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	size := h.BufferSize
+	if size <= 0 {
+		size = DefaultSSEBufferSize
+	}
+	lastEventID, err := url.ParseQuery(r.Header.Get("Last-Event-ID"))
+	if err != nil {
+		http.Error(w, "invalid Last-Event-ID", http.StatusBadRequest)
+		return
+	}
+
+	sink := &sseSink{
+		notifications: make(chan *JSONRPCResponse, size),
+		overflow:      make(chan struct{}),
+	}
+	seqs := make(url.Values, len(topics))
+	for _, topic := range topics {
+		sub, err := h.subscribe(topic, lastEventID.Get(topic), sink)
+		if err != nil {
+			logger.Error("Resuming server-sent events failed", "topic", topic, "error", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		defer sub.Unsubscribe()
+		seqs.Set(topic, strconv.FormatUint(sub.Seq, 10))
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	var keepAlive <-chan time.Time
+	if h.KeepAlive > 0 {
+		ticker := time.NewTicker(h.KeepAlive)
+		defer ticker.Stop()
+		keepAlive = ticker.C
+	}
+
+	// the replay and the notifications published while subscribing
+	for _, notification := range sink.goLive() {
+		if err := writeEvent(w, notification, seqs); err != nil {
+			logger.Debug("Writing event failed", "error", err)
+			return
+		}
+	}
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-sink.overflow:
+			logger.Warn("Closing slow server-sent events stream", "topics", topics)
+			return
+		case <-keepAlive:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case notification := <-sink.notifications:
+			if err := writeEvent(w, notification, seqs); err != nil {
+				logger.Debug("Writing event failed", "error", err)
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// subscribe subscribes the sink to the topic, resuming after the sequence
+// number of the Last-Event-ID, if any
+func (h *SSEHandler) subscribe(topic, since string, sink NotificationSink) (*Subscription, error) {
+	if since == "" {
+		return h.Broker.Subscribe(topic, sink), nil
+	}
+	seq, err := strconv.ParseUint(since, 10, 64)
+	if err != nil {
+		return h.Broker.Subscribe(topic, sink), nil
+	}
+	return h.Broker.SubscribeSince(topic, seq, sink)
+}
+
+// writeEvent writes the notification as an event, identified by the
+// sequence numbers of the stream updated with the notification
+func writeEvent(w http.ResponseWriter, notification *JSONRPCResponse, seqs url.Values) error {
+	var params Notification
+	if err := json.Unmarshal(notification.Params, &params); err == nil && params.Seq > 0 {
+		seqs.Set(params.Topic, strconv.FormatUint(params.Seq, 10))
+	}
+	data, err := json.Marshal(notification)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %s\ndata: %s\n\n", seqs.Encode(), data)
+	return err
+}
+
+// sseSink is the NotificationSink of an SSE stream, which buffers the
+// notifications for the handler to write. Until the stream is live, the
+// notifications are kept without limit, so that a replay is not mistaken
+// for a slow client.
+type sseSink struct {
+	notifications chan *JSONRPCResponse
+	overflow      chan struct{}
+	overflowOnce  sync.Once
+
+	mu      sync.Mutex // protects pending and live
+	pending []*JSONRPCResponse
+	live    bool
+}
+
+// goLive returns the notifications received before the stream is live,
+// then buffers the next ones with limit
+func (s *sseSink) goLive() []*JSONRPCResponse {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.live = true
+	pending := s.pending
+	s.pending = nil
+	return pending
+}
+
+// WriteResponse buffers the notification, or signals overflow if the
+// buffer is full
+func (s *sseSink) WriteResponse(response *JSONRPCResponse) error {
+	s.mu.Lock()
+	if !s.live {
+		s.pending = append(s.pending, response)
+		s.mu.Unlock()
+		return nil
+	}
+	s.mu.Unlock()
+
+	select {
+	case s.notifications <- response:
+		return nil
+	default:
+		s.overflowOnce.Do(func() {
+			close(s.overflow)
+		})
+		return errSSEOverflow
+	}
+}
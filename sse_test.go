@@ -0,0 +1,115 @@
+package jsonrps_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yookoala/jsonrps"
+)
+
+func TestSSEHandler_Stream(t *testing.T) {
+	broker := jsonrps.NewBroker()
+	srv := httptest.NewServer(&jsonrps.SSEHandler{Broker: broker, Logger: newTestLogger(t)})
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/?topic=news&topic=weather", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("Unexpected response %d %v", resp.StatusCode, resp.Header)
+	}
+
+	// the handler subscribes before responding
+	broker.Publish("weather", "sunny")
+	broker.Publish("sports", "ignored")
+	broker.Publish("news", "hello")
+
+	var topics []string
+	scanner := bufio.NewScanner(resp.Body)
+	for len(topics) < 2 && scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		var notification jsonrps.JSONRPCResponse
+		if err := json.Unmarshal([]byte(data), &notification); err != nil {
+			t.Fatalf("Unexpected event data %q: %v", data, err)
+		}
+		var params jsonrps.Notification
+		json.Unmarshal(notification.Params, &params)
+		if notification.Method != jsonrps.NotificationMethod {
+			t.Errorf("Unexpected notification %#v", notification)
+		}
+		topics = append(topics, params.Topic)
+	}
+	if strings.Join(topics, ",") != "weather,news" {
+		t.Errorf("Expected weather and news events, got %v", topics)
+	}
+
+	// subscriptions are removed once the client disconnects
+	cancel()
+	if !waitFor(t, time.Second, func() bool { return len(broker.Topics()) == 0 }) {
+		t.Errorf("Expected no topics after disconnect, got %v", broker.Topics())
+	}
+}
+
+func TestSSEHandler_Resume(t *testing.T) {
+	broker := &jsonrps.Broker{Store: jsonrps.NewMemoryStore(0)}
+	broker.Publish("news", "a")
+	broker.Publish("news", "b")
+	broker.Publish("news", "c")
+	broker.Publish("weather", "sunny")
+	srv := httptest.NewServer(&jsonrps.SSEHandler{Broker: broker, Logger: newTestLogger(t)})
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/?topic=news&topic=weather", nil)
+	req.Header.Set("Last-Event-ID", "news=1")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer resp.Body.Close()
+	broker.Publish("weather", "rainy")
+
+	// the missed news are replayed, the weather resumes live
+	var ids []string
+	scanner := bufio.NewScanner(resp.Body)
+	for len(ids) < 3 && scanner.Scan() {
+		if id, ok := strings.CutPrefix(scanner.Text(), "id: "); ok {
+			ids = append(ids, id)
+		}
+	}
+	expected := []string{"news=2&weather=1", "news=3&weather=1", "news=3&weather=2"}
+	if strings.Join(ids, " ") != strings.Join(expected, " ") {
+		t.Errorf("Expected event ids %v, got %v", expected, ids)
+	}
+}
+
+func TestSSEHandler_BadRequest(t *testing.T) {
+	handler := &jsonrps.SSEHandler{Broker: jsonrps.NewBroker()}
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 without topic, got %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/?topic=news", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected status 405, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,326 @@
+package jsonrps
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// DefaultCommandCloseTimeout is the default time a child process is given
+// to exit after its session is closed, before it is killed
+const DefaultCommandCloseTimeout = 5 * time.Second
+
+// ErrProcessExited is the termination reason of command sessions whose
+// process exited successfully
+var ErrProcessExited = errors.New("jsonrps: process exited")
+
+// StdioServer serves a single session over the standard input and output
+// of the process, for RPS services run as child processes (e.g. plugins
+// and tool servers) by a CommandDialer.
+//
+// Nothing else may be written to the standard output while serving. Logs
+// should go to the standard error, which the parent forwards to its logger.
+type StdioServer struct {
+	// Handler handles the session. If it implements ServerSessionHandler,
+	// a session it cannot handle is responded with 404 Not Found.
+	Handler SessionHandler
+
+	// SessionMiddlewares wrap Handler for every session it can handle.
+	// The first middleware is the outermost one.
+	SessionMiddlewares []SessionMiddleware
+
+	// Stdin is read for the session. os.Stdin is used if nil.
+	Stdin io.Reader
+
+	// Stdout is written for the session. os.Stdout is used if nil.
+	Stdout io.Writer
+
+	// Logger is used for the session. The default logger is used if nil.
+	Logger *slog.Logger
+}
+
+// Serve reads the request header from the standard input and passes the
+// session to the handler. It returns once the session is handled, which
+// is usually when the parent closes the standard input.
+func (srv *StdioServer) Serve(ctx context.Context) error {
+	conn := &stdioConn{Reader: srv.Stdin, Writer: srv.Stdout}
+	if conn.Reader == nil {
+		conn.Reader = os.Stdin
+	}
+	if conn.Writer == nil {
+		conn.Writer = os.Stdout
+	}
+	defer conn.Close()
+
+	logger := srv.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	sess := &Session{
+		ID:           newSessionID(),
+		LocalHeaders: make(http.Header),
+		Conn:         conn,
+		Logger:       logger,
+	}
+	if err := sess.ReadRequestHeader(); err != nil {
+		return err
+	}
+	serveSession(ctx, srv.Handler, srv.SessionMiddlewares, sess, logger)
+	return nil
+}
+
+// stdioConn is the connection of a session over a pair of streams
+type stdioConn struct {
+	io.Reader
+	io.Writer
+}
+
+// Close closes the streams which can be closed
+func (c *stdioConn) Close() error {
+	var errs []error
+	if closer, ok := c.Reader.(io.Closer); ok {
+		errs = append(errs, closer.Close())
+	}
+	if closer, ok := c.Writer.(io.Closer); ok {
+		errs = append(errs, closer.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// CommandDialer contains options for starting a child process serving RPS
+// over its standard input and output (e.g. with a StdioServer)
+type CommandDialer struct {
+	// Headers are sent as the request headers of the session
+	Headers http.Header
+
+	// CloseTimeout is the time the process is given to exit after the
+	// session is closed, before it is killed. DefaultCommandCloseTimeout
+	// is used if zero.
+	CloseTimeout time.Duration
+
+	// Logger is used for the dialed sessions, and receives the lines
+	// written by the process to its standard error. The default logger
+	// is used if nil.
+	Logger *slog.Logger
+}
+
+// DialCommand starts the command, requests the method and returns the
+// established client session.
+func DialCommand(cmd *exec.Cmd, method string) (*Session, error) {
+	var d CommandDialer
+	return d.DialContext(context.Background(), cmd, method)
+}
+
+// DialContext starts the command, requests the method and returns the
+// established client session. The command must not have Stdin or Stdout
+// set. If the command has no Stderr, its standard error is forwarded to
+// the session logger line by line.
+//
+// The context only limits the start of the process and the header
+// exchange. Once the session is established, the exit of the process
+// closes the session: its Context is cancelled and its Err reports the
+// exit error, or ErrProcessExited. Closing the session closes the standard
+// input of the process and waits for it to exit.
+func (d *CommandDialer) DialContext(ctx context.Context, cmd *exec.Cmd, method string) (*Session, error) {
+	if cmd.Stdin != nil || cmd.Stdout != nil {
+		return nil, errors.New("jsonrps: command Stdin or Stdout already set")
+	}
+
+	logger := d.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+
+	// os.Pipe gives the process the file descriptors directly, so that
+	// waiting for the process does not wait for or close our ends
+	stdinReader, stdinWriter, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	stdoutReader, stdoutWriter, err := os.Pipe()
+	if err != nil {
+		stdinReader.Close()
+		stdinWriter.Close()
+		return nil, err
+	}
+	var stderrReader, stderrWriter *os.File
+	if cmd.Stderr == nil {
+		if stderrReader, stderrWriter, err = os.Pipe(); err != nil {
+			stdinReader.Close()
+			stdinWriter.Close()
+			stdoutReader.Close()
+			stdoutWriter.Close()
+			return nil, err
+		}
+		cmd.Stderr = stderrWriter
+	}
+	cmd.Stdin = stdinReader
+	cmd.Stdout = stdoutWriter
+
+	err = cmd.Start()
+	stdinReader.Close()
+	stdoutWriter.Close()
+	if stderrWriter != nil {
+		stderrWriter.Close()
+	}
+	if err != nil {
+		stdinWriter.Close()
+		stdoutReader.Close()
+		if stderrReader != nil {
+			stderrReader.Close()
+		}
+		return nil, err
+	}
+
+	sessCtx, cancel := context.WithCancelCause(context.Background())
+	closeTimeout := d.CloseTimeout
+	if closeTimeout <= 0 {
+		closeTimeout = DefaultCommandCloseTimeout
+	}
+	conn := &commandConn{
+		Reader:       stdoutReader,
+		stdin:        stdinWriter,
+		cmd:          cmd,
+		closeTimeout: closeTimeout,
+		exited:       make(chan struct{}),
+	}
+	sess := &Session{
+		ID:           newSessionID(),
+		LocalHeaders: d.Headers.Clone(),
+		Context:      sessCtx,
+		Conn:         conn,
+		Logger:       logger.With("pid", cmd.Process.Pid),
+	}
+	if sess.LocalHeaders == nil {
+		sess.LocalHeaders = make(http.Header)
+	}
+
+	if stderrReader != nil {
+		go forwardStderr(stderrReader, sess.Logger)
+	}
+	go func() {
+		conn.exitErr = cmd.Wait()
+		close(conn.exited)
+		cause := ErrProcessExited
+		if conn.exitErr != nil {
+			cause = fmt.Errorf("jsonrps: process exited: %w", conn.exitErr)
+		}
+		sess.terminate(cause)
+		cancel(cause)
+	}()
+
+	stop := context.AfterFunc(ctx, func() {
+		cmd.Process.Kill()
+	})
+	defer stop()
+
+	sess.WriteRequestHeader(method)
+	if err = sess.ReadResponseHeader(); err != nil {
+		conn.kill()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	if !stop() {
+		conn.kill()
+		return nil, ctx.Err()
+	}
+
+	if sess.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("jsonrps: server responded %d %s", sess.StatusCode, http.StatusText(sess.StatusCode))
+	}
+	return sess, nil
+}
+
+// maxStderrLine is the length above which the lines of the standard
+// error of a process are truncated in the log
+const maxStderrLine = 64 << 10
+
+// forwardStderr logs each line read from the standard error of a process.
+// The pipe is read until the process closes it, as closing it earlier
+// would kill the process with SIGPIPE on its next write.
+func forwardStderr(stderr io.ReadCloser, logger *slog.Logger) {
+	defer stderr.Close()
+	r := bufio.NewReader(stderr)
+	var line []byte
+	truncated := false
+	for {
+		chunk, isPrefix, err := r.ReadLine()
+		if err != nil {
+			if err != io.EOF {
+				logger.Debug("Reading process stderr failed", "error", err)
+				io.Copy(io.Discard, r)
+			}
+			return
+		}
+		if room := maxStderrLine - len(line); len(chunk) > room {
+			chunk, truncated = chunk[:room], true
+		}
+		line = append(line, chunk...)
+		if isPrefix {
+			continue
+		}
+		if truncated {
+			logger.Info("Process stderr", "line", string(line), "truncated", true)
+		} else {
+			logger.Info("Process stderr", "line", string(line))
+		}
+		line, truncated = line[:0], false
+	}
+}
+
+// commandConn is the connection of a session with a child process over
+// its standard input and output
+type commandConn struct {
+	io.Reader
+
+	stdin        io.WriteCloser
+	cmd          *exec.Cmd
+	closeTimeout time.Duration
+
+	// exited is closed once the process exited with exitErr
+	exited  chan struct{}
+	exitErr error
+
+	closeOnce sync.Once
+}
+
+// Write writes to the standard input of the process
+func (c *commandConn) Write(p []byte) (int, error) {
+	return c.stdin.Write(p)
+}
+
+// Close closes the standard input of the process and waits for the process
+// to exit, killing it after the close timeout. It returns the exit error.
+func (c *commandConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.stdin.Close()
+		select {
+		case <-c.exited:
+		case <-time.After(c.closeTimeout):
+			c.cmd.Process.Kill()
+			<-c.exited
+		}
+		if closer, ok := c.Reader.(io.Closer); ok {
+			closer.Close()
+		}
+	})
+	<-c.exited
+	return c.exitErr
+}
+
+// kill kills the process and releases the connection
+func (c *commandConn) kill() {
+	c.cmd.Process.Kill()
+	c.Close()
+}
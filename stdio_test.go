@@ -0,0 +1,194 @@
+package jsonrps_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/yookoala/jsonrps"
+)
+
+// syncBuffer is a bytes.Buffer safe for concurrent use
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// TestHelperStdioServer is not a real test. It is run as the child process
+// of the CommandDialer tests.
+func TestHelperStdioServer(t *testing.T) {
+	if os.Getenv("JSONRPS_TEST_STDIO_SERVER") != "1" {
+		return
+	}
+
+	mux := jsonrps.NewMethodMux()
+	mux.Handle("echo", echoHandler)
+	mux.HandleFunc("exit", func(ctx context.Context, sess *jsonrps.Session, req *jsonrps.JSONRPCRequest) *jsonrps.JSONRPCResponse {
+		os.Exit(3)
+		return nil
+	})
+	mux.HandleFunc("noisy", func(ctx context.Context, sess *jsonrps.Session, req *jsonrps.JSONRPCRequest) *jsonrps.JSONRPCResponse {
+		fmt.Fprintln(os.Stderr, strings.Repeat("x", 70000))
+		fmt.Fprintln(os.Stderr, "after long line")
+		resp, _ := jsonrps.NewResultResponse(req.ID, "done")
+		return resp
+	})
+	fmt.Fprintln(os.Stderr, "helper started")
+
+	srv := &jsonrps.StdioServer{
+		Handler: &jsonrps.Dispatcher{Handler: mux},
+		Logger:  slog.New(slog.NewTextHandler(os.Stderr, nil)),
+	}
+	if err := srv.Serve(context.Background()); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// dialTestHelper starts TestHelperStdioServer as a child process
+func dialTestHelper(t *testing.T, logs *syncBuffer) (*jsonrps.Session, error) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], "-test.run=^TestHelperStdioServer$")
+	cmd.Env = append(os.Environ(), "JSONRPS_TEST_STDIO_SERVER=1")
+	d := &jsonrps.CommandDialer{
+		Headers: map[string][]string{"User-Agent": {"test-client/1.0"}},
+		Logger:  slog.New(slog.NewTextHandler(logs, nil)),
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return d.DialContext(ctx, cmd, "tools")
+}
+
+func TestCommandDialer_Call(t *testing.T) {
+	var logs syncBuffer
+	sess, err := dialTestHelper(t, &logs)
+	if err != nil {
+		t.Fatalf("Unexpected dial error: %v", err)
+	}
+
+	sess.WriteRequest(&jsonrps.JSONRPCRequest{
+		Version: jsonrps.JSONRPCVersion,
+		Method:  "echo",
+		Params:  json.RawMessage(`["hello"]`),
+		ID:      1,
+	})
+	resp, err := sess.ReadResponse()
+	if err != nil {
+		t.Fatalf("Unexpected read error: %v", err)
+	}
+	if string(resp.Result) != `["hello"]` {
+		t.Errorf("Unexpected response %#v", resp)
+	}
+
+	// closing the standard input lets the process exit cleanly
+	if err := sess.Close(); err != nil {
+		t.Errorf("Unexpected close error: %v", err)
+	}
+	if !waitFor(t, time.Second, func() bool { return strings.Contains(logs.String(), "helper started") }) {
+		t.Errorf("Expected stderr forwarded to the logger, got %q", logs.String())
+	}
+}
+
+func TestCommandDialer_LongStderrLine(t *testing.T) {
+	var logs syncBuffer
+	sess, err := dialTestHelper(t, &logs)
+	if err != nil {
+		t.Fatalf("Unexpected dial error: %v", err)
+	}
+
+	sess.WriteRequest(&jsonrps.JSONRPCRequest{
+		Version: jsonrps.JSONRPCVersion,
+		Method:  "noisy",
+		ID:      1,
+	})
+	resp, err := sess.ReadResponse()
+	if err != nil {
+		t.Fatalf("Unexpected read error: %v", err)
+	}
+	if string(resp.Result) != `"done"` {
+		t.Errorf("Unexpected response %#v", resp)
+	}
+
+	// the process survives writing to stderr after a line too long to log
+	if err := sess.Close(); err != nil {
+		t.Errorf("Unexpected close error: %v", err)
+	}
+	if !waitFor(t, time.Second, func() bool { return strings.Contains(logs.String(), "after long line") }) {
+		t.Errorf("Expected the lines after the long line forwarded, got %q", logs.String())
+	}
+	if !strings.Contains(logs.String(), "truncated=true") {
+		t.Error("Expected the long line logged truncated")
+	}
+}
+
+func TestCommandDialer_ProcessExit(t *testing.T) {
+	var logs syncBuffer
+	sess, err := dialTestHelper(t, &logs)
+	if err != nil {
+		t.Fatalf("Unexpected dial error: %v", err)
+	}
+	defer sess.Close()
+
+	sess.WriteRequest(&jsonrps.JSONRPCRequest{
+		Version: jsonrps.JSONRPCVersion,
+		Method:  "exit",
+		ID:      1,
+	})
+	if _, err := sess.ReadResponse(); err == nil {
+		t.Error("Expected read error after process exit")
+	}
+
+	select {
+	case <-sess.Context.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected session context to be done after process exit")
+	}
+	if err := sess.Err(); err == nil || !strings.Contains(err.Error(), "exit status 3") {
+		t.Errorf("Expected exit status in session error, got %v", err)
+	}
+}
+
+func TestCommandDialer_StdoutSet(t *testing.T) {
+	cmd := exec.Command(os.Args[0])
+	cmd.Stdout = &bytes.Buffer{}
+	if _, err := jsonrps.DialCommand(cmd, "tools"); err == nil {
+		t.Error("Expected error for command with Stdout set")
+	}
+}
+
+func TestStdioServer_CannotHandleSession(t *testing.T) {
+	var stdout bytes.Buffer
+	srv := &jsonrps.StdioServer{
+		Handler: &mockServerSessionHandler{canHandle: false},
+		Stdin:   strings.NewReader("RPS/1.0 tools\r\n\r\n"),
+		Stdout:  &stdout,
+		Logger:  newTestLogger(t),
+	}
+	if err := srv.Serve(context.Background()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !strings.HasPrefix(stdout.String(), "RPS/1.0 404 Not Found\r\n") {
+		t.Errorf("Expected 404 response, got %q", stdout.String())
+	}
+}
@@ -0,0 +1,91 @@
+package jsonrps
+
+import (
+	"slices"
+	"sort"
+	"sync"
+)
+
+// DefaultMemoryStoreSize is the default number of notifications retained
+// by topic in a MemoryStore
+const DefaultMemoryStoreSize = 1024
+
+// NotificationStore retains the notifications published by a Broker, for
+// subscribers to resume from a sequence number. Implementations must be
+// safe for concurrent use.
+type NotificationStore interface {
+	// Append retains the notification, numbered by the broker after the
+	// last notification of its topic
+	Append(notification Notification) error
+
+	// Since returns the retained notifications of the topic with a
+	// sequence number greater than seq, in order
+	Since(topic string, seq uint64) ([]Notification, error)
+
+	// LastSeq returns the sequence number of the last notification of
+	// the topic appended, or zero if none
+	LastSeq(topic string) (uint64, error)
+}
+
+// MemoryStore is a NotificationStore retaining the last notifications of
+// each topic in memory.
+//
+// The zero value is ready to use.
+type MemoryStore struct {
+	// Size is the number of notifications retained by topic.
+	// DefaultMemoryStoreSize is used if zero.
+	Size int
+
+	mu     sync.RWMutex
+	topics map[string][]Notification
+}
+
+// NewMemoryStore creates a MemoryStore retaining the last size
+// notifications of each topic
+func NewMemoryStore(size int) *MemoryStore {
+	return &MemoryStore{Size: size}
+}
+
+// Append retains the notification, dropping the oldest notification of
+// the topic if the store is full
+func (s *MemoryStore) Append(notification Notification) error {
+	size := s.Size
+	if size <= 0 {
+		size = DefaultMemoryStoreSize
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.topics == nil {
+		s.topics = make(map[string][]Notification)
+	}
+	notifications := append(s.topics[notification.Topic], notification)
+	if len(notifications) > size {
+		notifications = notifications[len(notifications)-size:]
+	}
+	s.topics[notification.Topic] = notifications
+	return nil
+}
+
+// Since returns the retained notifications of the topic with a sequence
+// number greater than seq
+func (s *MemoryStore) Since(topic string, seq uint64) ([]Notification, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	notifications := s.topics[topic]
+	i := sort.Search(len(notifications), func(i int) bool {
+		return notifications[i].Seq > seq
+	})
+	return slices.Clone(notifications[i:]), nil
+}
+
+// LastSeq returns the sequence number of the last notification of the topic
+func (s *MemoryStore) LastSeq(topic string) (uint64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	notifications := s.topics[topic]
+	if len(notifications) == 0 {
+		return 0, nil
+	}
+	return notifications[len(notifications)-1].Seq, nil
+}
@@ -0,0 +1,53 @@
+package jsonrps_test
+
+import (
+	"testing"
+
+	"github.com/yookoala/jsonrps"
+)
+
+func TestMemoryStore(t *testing.T) {
+	store := jsonrps.NewMemoryStore(3)
+	if seq, err := store.LastSeq("news"); err != nil || seq != 0 {
+		t.Errorf("Expected no last seq, got %d, error %v", seq, err)
+	}
+
+	for seq := uint64(1); seq <= 5; seq++ {
+		if err := store.Append(jsonrps.Notification{Topic: "news", Seq: seq}); err != nil {
+			t.Fatalf("Unexpected append error: %v", err)
+		}
+	}
+	store.Append(jsonrps.Notification{Topic: "weather", Seq: 1})
+
+	if seq, _ := store.LastSeq("news"); seq != 5 {
+		t.Errorf("Expected last seq 5, got %d", seq)
+	}
+	tests := []struct {
+		since    uint64
+		expected []uint64
+	}{
+		{0, []uint64{3, 4, 5}},
+		{3, []uint64{4, 5}},
+		{5, nil},
+	}
+	for _, tt := range tests {
+		notifications, err := store.Since("news", tt.since)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		var seqs []uint64
+		for _, n := range notifications {
+			seqs = append(seqs, n.Seq)
+		}
+		if len(seqs) != len(tt.expected) {
+			t.Errorf("Expected seqs %v since %d, got %v", tt.expected, tt.since, seqs)
+			continue
+		}
+		for i := range seqs {
+			if seqs[i] != tt.expected[i] {
+				t.Errorf("Expected seqs %v since %d, got %v", tt.expected, tt.since, seqs)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,368 @@
+package jsonrps
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"iter"
+	"strconv"
+	"sync"
+)
+
+// StreamItemMethod is the Method of the notifications carrying the items
+// of a streamed result, with a StreamItem as Params
+const StreamItemMethod = "$/streamItem"
+
+// StreamCreditMethod is the Method of the notifications granting the
+// handler of a streamed result credit for more items, with a StreamCredit
+// as Params
+const StreamCreditMethod = "$/streamCredit"
+
+// DefaultStreamBufferSize is the default Peer.StreamBufferSize
+const DefaultStreamBufferSize = 1024
+
+// ErrStreamOverflow ends the iteration of Peer.Stream when the other side
+// sends more items than the consumer granted credit for
+var ErrStreamOverflow = errors.New("jsonrps: stream buffer overflow")
+
+// StreamItem is the params of a notification carrying an item of a
+// streamed result
+type StreamItem struct {
+	// ID is the ID of the originating request
+	ID any `json:"id"`
+
+	// Seq is the position of the item in the stream, from 0
+	Seq int `json:"seq"`
+
+	// Item is the JSON encoded item
+	Item json.RawMessage `json:"item"`
+}
+
+// StreamCredit is the params of a notification granting credit for more
+// items of a streamed result
+type StreamCredit struct {
+	// ID is the ID of the originating request
+	ID any `json:"id"`
+
+	// Credits is the number of items granted
+	Credits int `json:"credits"`
+}
+
+// StreamResult is the result of the terminal response of a stream
+type StreamResult struct {
+	// Count is the number of items sent
+	Count int `json:"count"`
+}
+
+// StreamHandler is a MethodHandler for methods whose result is a sequence
+// of items, too large for a single response. The items yielded by the
+// function are sent in order as StreamItemMethod notifications, followed
+// by the terminal response with a StreamResult.
+//
+// The stream ends with an error response at the first error yielded,
+// which is responded as is if it is a *JSONRPCError. The stream stops
+// once the request context is done (e.g. the request is cancelled).
+//
+// If the request has StreamCredits set, as by Peer.Stream, each item waits
+// for a credit granted by the caller with StreamCreditMethod notifications,
+// which slows the sequence down to the pace of the consumer. Credits are
+// only received by Peer sessions. Otherwise writing the items only blocks
+// while the transport cannot take more.
+type StreamHandler func(ctx context.Context, sess *Session, req *JSONRPCRequest) iter.Seq2[any, error]
+
+// ServeMethod sends the items of the sequence and the terminal response
+func (h StreamHandler) ServeMethod(ctx context.Context, sess *Session, req *JSONRPCRequest) *JSONRPCResponse {
+	if req.ID == nil {
+		return nil
+	}
+
+	credit, _ := ctx.Value(streamCreditContextKey{}).(*credit)
+	count := 0
+	for item, err := range h(ctx, sess, req) {
+		if err != nil {
+			var rpcErr *JSONRPCError
+			if errors.As(err, &rpcErr) {
+				return &JSONRPCResponse{ID: req.ID, Error: rpcErr}
+			}
+			return NewErrorResponse(req.ID, ErrCodeInternalError, err.Error(), nil)
+		}
+		if ctx.Err() != nil || credit != nil && credit.take(ctx) != nil {
+			break
+		}
+
+		raw, err := json.Marshal(item)
+		if err != nil {
+			return NewErrorResponse(req.ID, ErrCodeInternalError, err.Error(), nil)
+		}
+		params, _ := json.Marshal(StreamItem{ID: req.ID, Seq: count, Item: raw})
+		err = sess.WriteResponse(&JSONRPCResponse{
+			Version: JSONRPCVersion,
+			Method:  StreamItemMethod,
+			Params:  params,
+		})
+		if err != nil {
+			sess.logger().Debug("Writing stream item failed", "error", err)
+			return nil
+		}
+		count++
+	}
+	if ctx.Err() != nil {
+		return NewErrorResponse(req.ID, ErrCodeCancelled, "request cancelled", nil)
+	}
+	resp, _ := NewResultResponse(req.ID, StreamResult{Count: count})
+	return resp
+}
+
+// StreamChannel adapts a channel of items to the sequence of a
+// StreamHandler. The sequence ends once the channel is closed.
+func StreamChannel[T any](ch <-chan T) iter.Seq2[any, error] {
+	return func(yield func(any, error) bool) {
+		for item := range ch {
+			if !yield(item, nil) {
+				return
+			}
+		}
+	}
+}
+
+// StreamSeq adapts a sequence of items to the sequence of a StreamHandler
+func StreamSeq[T any](seq iter.Seq[T]) iter.Seq2[any, error] {
+	return func(yield func(any, error) bool) {
+		for item := range seq {
+			if !yield(item, nil) {
+				return
+			}
+		}
+	}
+}
+
+// streamCreditContextKey is the context key of the credit of the streamed
+// result of a request
+type streamCreditContextKey struct{}
+
+// credit counts the items, or chunks, the other side is ready to receive
+type credit struct {
+	mu      sync.Mutex
+	n       int
+	granted chan struct{}
+}
+
+// newCredit creates a credit of n items
+func newCredit(n int) *credit {
+	return &credit{n: n, granted: make(chan struct{}, 1)}
+}
+
+// grant adds n items to the credit
+func (c *credit) grant(n int) {
+	c.mu.Lock()
+	c.n += n
+	c.mu.Unlock()
+	select {
+	case c.granted <- struct{}{}:
+	default:
+	}
+}
+
+// tryTake takes the credit of an item, if any
+func (c *credit) tryTake() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.n == 0 {
+		return false
+	}
+	c.n--
+	return true
+}
+
+// take waits for the credit of an item and takes it, or returns the cause
+// of the context once done
+func (c *credit) take(ctx context.Context) error {
+	for !c.tryTake() {
+		select {
+		case <-c.granted:
+		case <-ctx.Done():
+			return context.Cause(ctx)
+		}
+	}
+	return nil
+}
+
+// peerStream is a stream of items received for a call of Peer.Stream
+type peerStream struct {
+	items chan json.RawMessage
+
+	// overflow is closed once an item is dropped for the buffer is full
+	overflow     chan struct{}
+	overflowOnce sync.Once
+}
+
+// Stream calls the streaming method of the other side (e.g. served by a
+// StreamHandler) with the JSON encoded params, which may be nil, and
+// iterates over the items of the result. The call is sent once the
+// iteration starts.
+//
+// The iteration ends after the last item, or with a non-nil error as last
+// value: the *JSONRPCError responded by the other side, or the context
+// error. Stopping the iteration early, or the context being done, cancels
+// the request with a CancelRequestMethod notification.
+//
+// The other side is granted credit for StreamBufferSize items, renewed as
+// the items are consumed, so that a StreamHandler served by a Peer waits
+// for the consumer. If the other side sends more items than granted
+// anyway, the stream is cancelled and the iteration ends with
+// ErrStreamOverflow after the buffered items, as waiting for the consumer
+// would block the read loop of the peer, and with it the responses to the
+// other calls, including those made by the consumer.
+func (p *Peer) Stream(ctx context.Context, method string, params any) iter.Seq2[json.RawMessage, error] {
+	return func(yield func(json.RawMessage, error) bool) {
+		raw, err := marshalParams(params)
+		if err != nil {
+			yield(nil, err)
+			return
+		}
+
+		id := p.nextID.Add(1)
+		key := strconv.FormatInt(id, 10)
+		ch := make(chan *JSONRPCResponse, 1)
+		size := p.StreamBufferSize
+		if size <= 0 {
+			size = DefaultStreamBufferSize
+		}
+		stream := &peerStream{
+			items:    make(chan json.RawMessage, size),
+			overflow: make(chan struct{}),
+		}
+		p.mu.Lock()
+		if p.err != nil {
+			p.mu.Unlock()
+			yield(nil, p.err)
+			return
+		}
+		p.pending[key] = ch
+		p.streams[key] = stream
+		p.mu.Unlock()
+
+		finished := false
+		defer func() {
+			p.mu.Lock()
+			delete(p.pending, key)
+			delete(p.streams, key)
+			p.mu.Unlock()
+			if !finished {
+				if err := p.Notify(CancelRequestMethod, cancelParams{ID: json.RawMessage(key)}); err != nil {
+					p.Session.logger().Debug("Cancelling stream failed", "id", key, "error", err)
+				}
+			}
+		}()
+
+		req := newCallRequest(ctx, method, raw, id)
+		req.StreamCredits = size
+		if err := p.Session.WriteRequest(req); err != nil {
+			finished = true
+			yield(nil, err)
+			return
+		}
+
+		// credit is granted again by halves of the buffer
+		consumed := 0
+		for {
+			select {
+			case item := <-stream.items:
+				if !yield(item, nil) {
+					return
+				}
+				if consumed++; consumed >= max(size/2, 1) {
+					if err := p.Notify(StreamCreditMethod, StreamCredit{ID: id, Credits: consumed}); err != nil {
+						p.Session.logger().Debug("Granting stream credit failed", "id", key, "error", err)
+					}
+					consumed = 0
+				}
+			case resp := <-ch:
+				finished = true
+				// all items are received before the terminal response
+				for len(stream.items) > 0 {
+					if !yield(<-stream.items, nil) {
+						return
+					}
+				}
+				select {
+				case <-stream.overflow:
+					yield(nil, ErrStreamOverflow)
+					return
+				default:
+				}
+				if resp.Error != nil {
+					yield(nil, resp.Error)
+				}
+				return
+			case <-stream.overflow:
+				for len(stream.items) > 0 {
+					if !yield(<-stream.items, nil) {
+						return
+					}
+				}
+				yield(nil, ErrStreamOverflow)
+				return
+			case <-ctx.Done():
+				yield(nil, ctx.Err())
+				return
+			case <-p.done:
+				finished = true
+				yield(nil, p.err)
+				return
+			}
+		}
+	}
+}
+
+// receiveStreamItem passes the item of the StreamItemMethod notification
+// to the matching stream, if any, without waiting: the stream overflows if
+// its buffer is full. It reports if the notification matched a stream.
+func (p *Peer) receiveStreamItem(line []byte) bool {
+	var notification struct {
+		Params struct {
+			ID   json.RawMessage `json:"id"`
+			Item json.RawMessage `json:"item"`
+		} `json:"params"`
+	}
+	if err := json.Unmarshal(line, &notification); err != nil || len(notification.Params.ID) == 0 {
+		return false
+	}
+	p.mu.Lock()
+	stream := p.streams[idKey(notification.Params.ID)]
+	p.mu.Unlock()
+	if stream == nil {
+		return false
+	}
+	select {
+	case stream.items <- notification.Params.Item:
+	default:
+		stream.overflowOnce.Do(func() {
+			close(stream.overflow)
+		})
+	}
+	return true
+}
+
+// grantStreamCredit grants the credit of the StreamCreditMethod
+// notification to the matching streamed result in progress, if any. It
+// reports if the notification matched a request.
+func (p *Peer) grantStreamCredit(line []byte) bool {
+	var notification struct {
+		Params struct {
+			ID      json.RawMessage `json:"id"`
+			Credits int             `json:"credits"`
+		} `json:"params"`
+	}
+	if err := json.Unmarshal(line, &notification); err != nil || len(notification.Params.ID) == 0 {
+		return false
+	}
+	p.mu.Lock()
+	credit := p.credits[idKey(notification.Params.ID)]
+	p.mu.Unlock()
+	if credit == nil {
+		return false
+	}
+	credit.grant(notification.Params.Credits)
+	return true
+}
@@ -0,0 +1,195 @@
+package jsonrps_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"iter"
+	"slices"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/yookoala/jsonrps"
+)
+
+// newStreamTestServer creates the methods of the streaming tests. The
+// context errors of the "forever" streams are sent to stopped.
+func newStreamTestServer(stopped chan<- error) *jsonrps.MethodMux {
+	mux := jsonrps.NewMethodMux()
+	mux.Handle("range", jsonrps.StreamHandler(func(ctx context.Context, sess *jsonrps.Session, req *jsonrps.JSONRPCRequest) iter.Seq2[any, error] {
+		return jsonrps.StreamSeq(slices.Values([]int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}))
+	}))
+	mux.Handle("failing", jsonrps.StreamHandler(func(ctx context.Context, sess *jsonrps.Session, req *jsonrps.JSONRPCRequest) iter.Seq2[any, error] {
+		return func(yield func(any, error) bool) {
+			if yield("a", nil) && yield("b", nil) {
+				yield(nil, &jsonrps.JSONRPCError{Code: jsonrps.ErrCodeInvalidParams, Message: "no more"})
+			}
+		}
+	}))
+	mux.Handle("forever", jsonrps.StreamHandler(func(ctx context.Context, sess *jsonrps.Session, req *jsonrps.JSONRPCRequest) iter.Seq2[any, error] {
+		ch := make(chan int)
+		go func() {
+			defer close(ch)
+			for i := 0; ; i++ {
+				select {
+				case ch <- i:
+				case <-ctx.Done():
+					stopped <- ctx.Err()
+					return
+				}
+			}
+		}()
+		return jsonrps.StreamChannel(ch)
+	}))
+	mux.Handle("echo", echoHandler)
+	return mux
+}
+
+func TestPeer_Stream(t *testing.T) {
+	peer := startTestPeers(t, &jsonrps.PeerHandler{Handler: newStreamTestServer(nil)}, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	var items []string
+	for item, err := range peer.Stream(ctx, "range", nil) {
+		if err != nil {
+			t.Fatalf("Unexpected stream error: %v", err)
+		}
+		items = append(items, string(item))
+	}
+	if len(items) != 10 {
+		t.Fatalf("Expected 10 items, got %v", items)
+	}
+	for i, item := range items {
+		if item != strconv.Itoa(i) {
+			t.Errorf("Expected item %d, got %s", i, item)
+		}
+	}
+
+	items = nil
+	var streamErr error
+	for item, err := range peer.Stream(ctx, "failing", nil) {
+		if err != nil {
+			streamErr = err
+			continue
+		}
+		items = append(items, string(item))
+	}
+	var rpcErr *jsonrps.JSONRPCError
+	if !errors.As(streamErr, &rpcErr) || rpcErr.Code != jsonrps.ErrCodeInvalidParams {
+		t.Errorf("Expected invalid params error, got %v", streamErr)
+	}
+	if len(items) != 2 {
+		t.Errorf("Expected 2 items before the error, got %v", items)
+	}
+}
+
+func TestPeer_Stream_Cancel(t *testing.T) {
+	stopped := make(chan error, 1)
+	peer := startTestPeers(t, &jsonrps.PeerHandler{Handler: newStreamTestServer(stopped)}, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	// stopping the iteration cancels the stream on the server
+	count := 0
+	for _, err := range peer.Stream(ctx, "forever", nil) {
+		if err != nil {
+			t.Fatalf("Unexpected stream error: %v", err)
+		}
+		if count++; count == 5 {
+			break
+		}
+	}
+	select {
+	case err := <-stopped:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Expected stream context cancelled, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the stream to stop on the server")
+	}
+
+	// the peer keeps serving other calls
+	var result string
+	if err := peer.Call(ctx, "echo", "still here", &result); err != nil || result != "still here" {
+		t.Errorf("Unexpected call result %q, error %v", result, err)
+	}
+}
+
+func TestPeer_Stream_FlowControl(t *testing.T) {
+	var produced atomic.Int32
+	server := newStreamTestServer(nil)
+	server.Handle("many", jsonrps.StreamHandler(func(ctx context.Context, sess *jsonrps.Session, req *jsonrps.JSONRPCRequest) iter.Seq2[any, error] {
+		return func(yield func(any, error) bool) {
+			for i := 0; i < 100 && yield(i, nil); i++ {
+				produced.Add(1)
+			}
+		}
+	}))
+	peer := startTestPeers(t, &jsonrps.PeerHandler{Handler: server}, nil)
+	peer.StreamBufferSize = 4
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// the handler waits for the credit granted by the slow consumer
+	count := 0
+	for item, err := range peer.Stream(ctx, "many", nil) {
+		if err != nil {
+			t.Fatalf("Unexpected stream error: %v", err)
+		}
+		if string(item) != strconv.Itoa(count) {
+			t.Errorf("Expected item %d, got %s", count, item)
+		}
+		count++
+		time.Sleep(time.Millisecond)
+		if ahead := int(produced.Load()) - count; ahead > 5 {
+			t.Fatalf("Expected the handler to wait for the consumer, %d items ahead", ahead)
+		}
+	}
+	if count != 100 {
+		t.Errorf("Expected 100 items, got %d", count)
+	}
+}
+
+func TestPeer_Stream_Overflow(t *testing.T) {
+	server := newStreamTestServer(nil)
+	server.Handle("many", jsonrps.StreamHandler(func(ctx context.Context, sess *jsonrps.Session, req *jsonrps.JSONRPCRequest) iter.Seq2[any, error] {
+		return func(yield func(any, error) bool) {
+			for i := 0; i < 100 && yield(i, nil); i++ {
+			}
+		}
+	}))
+
+	// a Dispatcher sends the items without waiting for credit, and serves
+	// the nested call once the stream is sent
+	peer := startTestPeers(t, &jsonrps.Dispatcher{Handler: server}, nil)
+	peer.StreamBufferSize = 4
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	// calling while iterating is not held up by the items of the stream
+	// flooding the buffer
+	var items []json.RawMessage
+	var streamErr error
+	for item, err := range peer.Stream(ctx, "many", nil) {
+		if err != nil {
+			streamErr = err
+			break
+		}
+		if len(items) == 0 {
+			var result string
+			if err := peer.Call(ctx, "echo", "nested", &result); err != nil || result != "nested" {
+				t.Fatalf("Unexpected call result %q, error %v", result, err)
+			}
+		}
+		items = append(items, item)
+	}
+	if !errors.Is(streamErr, jsonrps.ErrStreamOverflow) {
+		t.Errorf("Expected ErrStreamOverflow, got %v", streamErr)
+	}
+	if len(items) == 0 || len(items) > 5 || string(items[0]) != "0" {
+		t.Errorf("Expected the buffered items before the error, got %s", items)
+	}
+}
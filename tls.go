@@ -0,0 +1,64 @@
+package jsonrps
+
+import (
+	"crypto/x509"
+	"net/url"
+)
+
+// PeerCertificates returns the certificate chain of the other side of the
+// session, starting with the leaf certificate. The first verified chain is
+// returned if the chain has been verified. It returns nil if the session
+// is not over TLS or the peer sent no certificate.
+func (sess *Session) PeerCertificates() []*x509.Certificate {
+	if sess.TLS == nil {
+		return nil
+	}
+	if len(sess.TLS.VerifiedChains) > 0 {
+		return sess.TLS.VerifiedChains[0]
+	}
+	return sess.TLS.PeerCertificates
+}
+
+// PeerIdentities returns the SPIFFE-style identities (URI SANs with the
+// "spiffe" scheme, e.g. "spiffe://example.org/service/billing") of the
+// verified peer leaf certificate. Unverified certificates yield no identity.
+func (sess *Session) PeerIdentities() []*url.URL {
+	if sess.TLS == nil || len(sess.TLS.VerifiedChains) == 0 {
+		return nil
+	}
+	var identities []*url.URL
+	for _, uri := range sess.TLS.VerifiedChains[0][0].URIs {
+		if uri.Scheme == "spiffe" {
+			identities = append(identities, uri)
+		}
+	}
+	return identities
+}
+
+// PeerIdentityHandler is a ServerSessionHandler which only handles the
+// sessions of TLS peers having a verified identity matching one of the
+// Identities. It can be used in ServerSessionRouter to route sessions
+// by client identity.
+type PeerIdentityHandler struct {
+	// Identities are the accepted identity patterns, in the syntax of
+	// [AccessRule] patterns (e.g. "spiffe://example.org/service/*")
+	Identities []string
+
+	// Handler handles the sessions of accepted peers
+	Handler SessionHandler
+}
+
+// CanHandleSession checks if the session peer has an accepted identity
+func (h *PeerIdentityHandler) CanHandleSession(session *Session) bool {
+	for _, identity := range session.PeerIdentities() {
+		if matchAny(h.Identities, identity.String()) {
+			return true
+		}
+	}
+	return false
+}
+
+// HandleSession passes the session to the underlying handler
+func (h *PeerIdentityHandler) HandleSession(session *Session) {
+	h.Handler.HandleSession(session)
+}
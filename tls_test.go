@@ -0,0 +1,176 @@
+package jsonrps_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/yookoala/jsonrps"
+)
+
+// testCA is a locally generated certificate authority for tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+// newTestCA generates a self-signed certificate authority
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{cert: cert, key: key, pool: pool}
+}
+
+// issue generates a certificate for localhost signed by the CA, with
+// the given SPIFFE ID, if any
+func (ca *testCA) issue(t *testing.T, serial int64, spiffeID string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	if spiffeID != "" {
+		uri, _ := url.Parse(spiffeID)
+		template.URIs = []*url.URL{uri, {Scheme: "https", Host: "example.org"}}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// identitySessionHandler records the peer identities of a session
+type identitySessionHandler struct {
+	identities chan []*url.URL
+}
+
+func (h *identitySessionHandler) HandleSession(sess *jsonrps.Session) {
+	h.identities <- sess.PeerIdentities()
+	sess.WriteResponseHeader(200)
+}
+
+func TestServer_MutualTLS(t *testing.T) {
+	ca := newTestCA(t)
+
+	billing := &identitySessionHandler{identities: make(chan []*url.URL, 1)}
+	fallback := &mockServerSessionHandler{canHandle: false}
+	addr := startTestServer(t, &jsonrps.Server{
+		Handler: jsonrps.ServerSessionRouter{
+			&jsonrps.PeerIdentityHandler{
+				Identities: []string{"spiffe://example.org/billing/*"},
+				Handler:    billing,
+			},
+			fallback,
+		},
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{ca.issue(t, 2, "")},
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+			ClientCAs:    ca.pool,
+		},
+		Logger: newTestLogger(t),
+	})
+
+	dial := func(clientCert *tls.Certificate) (*jsonrps.Session, error) {
+		config := &tls.Config{RootCAs: ca.pool}
+		if clientCert != nil {
+			config.Certificates = []tls.Certificate{*clientCert}
+		}
+		d := &jsonrps.Dialer{TLSConfig: config, Logger: newTestLogger(t)}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		return d.DialContext(ctx, "tcp", addr, "GET")
+	}
+
+	t.Run("accepted identity", func(t *testing.T) {
+		cert := ca.issue(t, 3, "spiffe://example.org/billing/worker")
+		sess, err := dial(&cert)
+		if err != nil {
+			t.Fatalf("Unexpected dial error: %v", err)
+		}
+		defer sess.Close()
+
+		identities := <-billing.identities
+		if len(identities) != 1 || identities[0].String() != "spiffe://example.org/billing/worker" {
+			t.Errorf("Unexpected peer identities %v", identities)
+		}
+
+		chain := sess.PeerCertificates()
+		if len(chain) != 2 || chain[1].Subject.CommonName != "test ca" {
+			t.Errorf("Expected verified server chain up to the CA, got %d certificates", len(chain))
+		}
+		if len(sess.PeerIdentities()) != 0 {
+			t.Errorf("Expected no server identity, got %v", sess.PeerIdentities())
+		}
+	})
+
+	t.Run("other identity", func(t *testing.T) {
+		cert := ca.issue(t, 4, "spiffe://example.org/frontend/web")
+		if _, err := dial(&cert); err == nil {
+			t.Error("Expected session of other identity to be rejected")
+		}
+	})
+
+	t.Run("no client certificate", func(t *testing.T) {
+		if _, err := dial(nil); err == nil {
+			t.Error("Expected dial without client certificate to fail")
+		}
+	})
+
+	t.Run("untrusted client certificate", func(t *testing.T) {
+		cert := newTestCA(t).issue(t, 5, "spiffe://example.org/billing/worker")
+		if _, err := dial(&cert); err == nil {
+			t.Error("Expected dial with untrusted certificate to fail")
+		}
+	})
+}
+
+func TestSession_PeerCertificates_NoTLS(t *testing.T) {
+	sess := &jsonrps.Session{}
+	if sess.PeerCertificates() != nil || sess.PeerIdentities() != nil {
+		t.Error("Expected no peer certificates without TLS")
+	}
+
+	sess.TLS = &tls.ConnectionState{}
+	if sess.PeerCertificates() != nil || sess.PeerIdentities() != nil {
+		t.Error("Expected no peer certificates without peer certificate")
+	}
+}
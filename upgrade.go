@@ -0,0 +1,348 @@
+package jsonrps
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// UpgradeProtocol is the protocol token of the HTTP "Upgrade" header
+// which switches an HTTP/1.1 connection to RPS
+const UpgradeProtocol = "rps/1.0"
+
+// errUpgradeRejected is returned by the reads and writes of an upgraded
+// session whose handler rejected the upgrade
+var errUpgradeRejected = errors.New("jsonrps: upgrade rejected")
+
+// UpgradeHandler is an http.Handler which switches HTTP/1.1 requests
+// with "Upgrade: rps/1.0" to RPS, and serves each of them as a Session.
+// It allows serving RPS on the same port as other HTTP APIs.
+//
+// The HTTP request headers become Session.RemoteHeaders and the request
+// path becomes Session.Method. Session.LocalHeaders are sent with the
+// "101 Switching Protocols" response when the session handler writes its
+// response header, and a status other than 200 OK rejects the upgrade with
+// that HTTP status. JSON-RPC lines follow the response on the connection.
+type UpgradeHandler struct {
+	// Handler handles every upgraded session. If it implements
+	// ServerSessionHandler, sessions it cannot handle are responded
+	// with 404 Not Found.
+	Handler SessionHandler
+
+	// Logger is used for all sessions. The default logger is used if nil.
+	Logger *slog.Logger
+}
+
+// ServeHTTP validates the upgrade request and serves the session
+func (h *UpgradeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !headerContainsToken(r.Header, "Connection", "upgrade") ||
+		!headerContainsToken(r.Header, "Upgrade", UpgradeProtocol) {
+		w.Header().Set("Upgrade", UpgradeProtocol)
+		w.Header().Set("Connection", "Upgrade")
+		http.Error(w, "rps upgrade required", http.StatusUpgradeRequired)
+		return
+	}
+
+	conn := &upgradeConn{}
+	sess := newUpgradedSession(r, conn, conn, h.Logger)
+	sess.handshake = func(statusCode int) {
+		conn.handshake(w, sess.LocalHeaders, statusCode, http.Header{
+			"Upgrade":    {UpgradeProtocol},
+			"Connection": {"Upgrade"},
+		})
+	}
+	serveUpgradedSession(h.Handler, sess)
+}
+
+// newUpgradedSession creates the server side session of an HTTP request.
+// The session reads and writes through conn, which wraps the upgrade
+// connection.
+func newUpgradedSession(r *http.Request, conn io.ReadWriteCloser, upgrade *upgradeConn, logger *slog.Logger) *Session {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	sess := &Session{
+		ID:                newSessionID(),
+		ProtocolSignature: DefaultProtocolSignature,
+		Method:            r.URL.Path,
+		LocalHeaders:      make(http.Header),
+		RemoteHeaders:     r.Header.Clone(),
+		Context:           r.Context(),
+		Conn:              conn,
+		TLS:               r.TLS,
+	}
+	sess.Logger = logger.With("session", sess.ID)
+	upgrade.accept = func() {
+		sess.WriteResponseHeader(http.StatusOK)
+	}
+	return sess
+}
+
+// serveUpgradedSession passes the session to the handler, and closes
+// the session connection once handled
+func serveUpgradedSession(handler SessionHandler, sess *Session) {
+	defer sess.Conn.Close()
+
+	if h, ok := handler.(ServerSessionHandler); ok && !h.CanHandleSession(sess) {
+		sess.WriteResponseHeader(http.StatusNotFound)
+		return
+	}
+	handler.HandleSession(sess)
+}
+
+// upgradeConn is the connection of an HTTP request which is hijacked once
+// the session handler accepts the upgrade
+type upgradeConn struct {
+	// accept upgrades the server side connection before the first
+	// read or write
+	accept func()
+
+	mu       sync.Mutex // protects the fields below and the writes to conn
+	conn     net.Conn
+	reader   *bufio.Reader
+	upgraded bool
+	err      error
+}
+
+// handshake responds to the upgrade request with the headers. The
+// connection is switched, with the additional upgrade headers, if
+// statusCode is 200 OK. Else the request is responded with the HTTP status.
+func (c *upgradeConn) handshake(w http.ResponseWriter, headers http.Header, statusCode int, upgrade http.Header) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.upgraded || c.err != nil {
+		return
+	}
+
+	if statusCode != http.StatusOK {
+		for key, values := range headers {
+			w.Header()[key] = values
+		}
+		http.Error(w, http.StatusText(statusCode), statusCode)
+		c.err = errUpgradeRejected
+		return
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "upgrade not supported", http.StatusInternalServerError)
+		c.err = errors.New("jsonrps: response writer does not support hijacking")
+		return
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		c.err = err
+		return
+	}
+
+	var response bytes.Buffer
+	response.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	headers.Write(&response)
+	upgrade.Write(&response)
+	response.WriteString("\r\n")
+	if _, err = conn.Write(response.Bytes()); err != nil {
+		conn.Close()
+		c.err = err
+		return
+	}
+
+	c.conn = conn
+	c.reader = rw.Reader
+	c.upgraded = true
+}
+
+// ready upgrades the connection if needed, and returns any error
+// preventing reads and writes
+func (c *upgradeConn) ready() error {
+	c.mu.Lock()
+	upgraded, err := c.upgraded, c.err
+	c.mu.Unlock()
+	if !upgraded && err == nil && c.accept != nil {
+		c.accept()
+		c.mu.Lock()
+		err = c.err
+		c.mu.Unlock()
+	}
+	return err
+}
+
+// Read reads from the upgraded connection
+func (c *upgradeConn) Read(p []byte) (int, error) {
+	if err := c.ready(); err != nil {
+		return 0, err
+	}
+	return c.reader.Read(p)
+}
+
+// Write writes to the upgraded connection
+func (c *upgradeConn) Write(p []byte) (int, error) {
+	if err := c.ready(); err != nil {
+		return 0, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn.Write(p)
+}
+
+// Close closes the upgraded connection, if any
+func (c *upgradeConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil {
+		return nil
+	}
+	return c.conn.Close()
+}
+
+// headerContainsToken reports if the comma separated values of the header
+// contain the token, case-insensitively
+func headerContainsToken(header http.Header, key, token string) bool {
+	for _, value := range header.Values(key) {
+		for _, item := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(item), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// UpgradeDialer contains options for connecting to an RPS server
+// through an HTTP/1.1 upgrade
+type UpgradeDialer struct {
+	// NetDialer is used to establish the network connection
+	NetDialer net.Dialer
+
+	// TLSConfig is used for "https" URLs
+	TLSConfig *tls.Config
+
+	// Headers are sent as the headers of the upgrade request
+	Headers http.Header
+
+	// Logger is used for the dialed sessions. The default logger is
+	// used if nil.
+	Logger *slog.Logger
+}
+
+// DialContext sends the upgrade request to the "http" or "https" URL and
+// returns the established client session. The headers of the "101 Switching
+// Protocols" response become the RemoteHeaders of the session.
+func (d *UpgradeDialer) DialContext(ctx context.Context, rawURL string) (*Session, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("jsonrps: unsupported upgrade scheme %q", u.Scheme)
+	}
+
+	header := d.Headers.Clone()
+	if header == nil {
+		header = make(http.Header)
+	}
+	header.Set("Upgrade", UpgradeProtocol)
+	header.Set("Connection", "Upgrade")
+
+	conn, reader, resp, err := dialUpgrade(ctx, &d.NetDialer, d.TLSConfig, u, u.Scheme == "https", header)
+	if err != nil {
+		return nil, err
+	}
+	sess := newDialedSession(conn, u, header, resp, d.Logger)
+	sess.reader = reader
+	return sess, nil
+}
+
+// dialUpgrade connects to the URL and sends the upgrade request with the
+// headers. It returns the connection, with the reader buffering it, once
+// the server switched protocols.
+func dialUpgrade(ctx context.Context, netDialer *net.Dialer, tlsConfig *tls.Config, u *url.URL, secure bool, header http.Header) (net.Conn, *bufio.Reader, *http.Response, error) {
+	var conn net.Conn
+	var err error
+	if secure {
+		tlsDialer := &tls.Dialer{NetDialer: netDialer, Config: tlsConfig}
+		conn, err = tlsDialer.DialContext(ctx, "tcp", hostPort(u, "443"))
+	} else {
+		conn, err = netDialer.DialContext(ctx, "tcp", hostPort(u, "80"))
+	}
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	stop := context.AfterFunc(ctx, func() {
+		conn.Close()
+	})
+	defer stop()
+
+	req := &http.Request{
+		Method:     http.MethodGet,
+		URL:        u,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     header,
+		Host:       u.Host,
+	}
+	var reader *bufio.Reader
+	var resp *http.Response
+	if err = req.Write(conn); err == nil {
+		reader = bufio.NewReader(conn)
+		resp, err = http.ReadResponse(reader, req)
+	}
+	if !stop() {
+		conn.Close()
+		return nil, nil, nil, ctx.Err()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, nil, nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		resp.Body.Close()
+		conn.Close()
+		return nil, nil, nil, fmt.Errorf("jsonrps: server responded %s", resp.Status)
+	}
+	return conn, reader, resp, nil
+}
+
+// newDialedSession creates the client side session of an upgraded connection
+func newDialedSession(conn net.Conn, u *url.URL, header http.Header, resp *http.Response, logger *slog.Logger) *Session {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	sess := &Session{
+		ID:                newSessionID(),
+		ProtocolSignature: DefaultProtocolSignature,
+		Method:            u.Path,
+		StatusCode:        http.StatusOK,
+		LocalHeaders:      header,
+		RemoteHeaders:     resp.Header,
+		Context:           context.Background(),
+		Conn:              conn,
+		Logger:            logger,
+		headerSent:        true,
+	}
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		state := tlsConn.ConnectionState()
+		sess.TLS = &state
+	}
+	return sess
+}
+
+// hostPort returns the host and port of the URL, with the default port
+// if the URL has none
+func hostPort(u *url.URL, defaultPort string) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	return net.JoinHostPort(u.Hostname(), defaultPort)
+}
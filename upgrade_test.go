@@ -0,0 +1,134 @@
+package jsonrps_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yookoala/jsonrps"
+)
+
+// dialTestUpgrade dials the path of the test server with the headers
+func dialTestUpgrade(t *testing.T, srv *httptest.Server, path string, headers http.Header) (*jsonrps.Session, error) {
+	t.Helper()
+	d := &jsonrps.UpgradeDialer{Headers: headers, Logger: newTestLogger(t)}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	return d.DialContext(ctx, srv.URL+path)
+}
+
+func TestUpgradeHandler_SharedPort(t *testing.T) {
+	methods := jsonrps.NewMethodMux()
+	methods.Handle("echo", echoHandler)
+
+	router := jsonrps.NewSessionRouter(nil)
+	router.Handle(jsonrps.Route{
+		Method:  "/rps",
+		Handler: &jsonrps.Dispatcher{Handler: methods},
+	})
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	mux.Handle("/rps", &jsonrps.UpgradeHandler{Handler: router, Logger: newTestLogger(t)})
+	mux.Handle("/other", &jsonrps.UpgradeHandler{Handler: router, Logger: newTestLogger(t)})
+
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	// plain HTTP API on the same port
+	resp, err := http.Get(srv.URL + "/health")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected status 200, got %d", resp.StatusCode)
+	}
+
+	sess, err := dialTestUpgrade(t, srv, "/rps", http.Header{"User-Agent": {"test-client/1.0"}})
+	if err != nil {
+		t.Fatalf("Unexpected dial error: %v", err)
+	}
+	defer sess.Close()
+
+	if !strings.EqualFold(sess.RemoteHeaders.Get("Upgrade"), jsonrps.UpgradeProtocol) {
+		t.Errorf("Expected Upgrade response header, got %v", sess.RemoteHeaders)
+	}
+
+	for i := 1; i <= 3; i++ {
+		err = sess.WriteRequest(&jsonrps.JSONRPCRequest{
+			Version: "2.0",
+			Method:  "echo",
+			Params:  json.RawMessage(`{"n":1}`),
+			ID:      i,
+		})
+		if err != nil {
+			t.Fatalf("Unexpected write error: %v", err)
+		}
+		resp, err := sess.ReadResponse()
+		if err != nil {
+			t.Fatalf("Unexpected read error: %v", err)
+		}
+		if string(resp.Result) != `{"n":1}` || resp.ID != float64(i) {
+			t.Errorf("Unexpected response %#v", resp)
+		}
+	}
+
+	if _, err = dialTestUpgrade(t, srv, "/other", nil); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("Expected 404 error, got %v", err)
+	}
+}
+
+func TestUpgradeHandler_RemoteHeaders(t *testing.T) {
+	headers := make(chan http.Header, 1)
+	handler := jsonrps.SessionHandlerFunc(func(sess *jsonrps.Session) {
+		headers <- sess.RemoteHeaders
+		sess.LocalHeaders.Set("X-Session-ID", sess.ID)
+		sess.WriteResponseHeader(http.StatusOK)
+	})
+	srv := httptest.NewServer(&jsonrps.UpgradeHandler{Handler: handler})
+	defer srv.Close()
+
+	sess, err := dialTestUpgrade(t, srv, "/", http.Header{"Authorization": {"Bearer abc"}})
+	if err != nil {
+		t.Fatalf("Unexpected dial error: %v", err)
+	}
+	defer sess.Close()
+
+	if got := (<-headers).Get("Authorization"); got != "Bearer abc" {
+		t.Errorf("Expected Authorization remote header, got %q", got)
+	}
+	if sess.RemoteHeaders.Get("X-Session-ID") == "" {
+		t.Errorf("Expected X-Session-ID response header, got %v", sess.RemoteHeaders)
+	}
+}
+
+func TestUpgradeHandler_NotUpgradeRequest(t *testing.T) {
+	srv := httptest.NewServer(&jsonrps.UpgradeHandler{Handler: &mockSessionHandler{}})
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUpgradeRequired {
+		t.Errorf("Expected status 426, got %d", resp.StatusCode)
+	}
+	if resp.Header.Get("Upgrade") != jsonrps.UpgradeProtocol {
+		t.Errorf("Expected Upgrade header %q, got %q", jsonrps.UpgradeProtocol, resp.Header.Get("Upgrade"))
+	}
+}
+
+func TestUpgradeDialer_UnsupportedScheme(t *testing.T) {
+	var d jsonrps.UpgradeDialer
+	if _, err := d.DialContext(context.Background(), "ws://localhost/"); err == nil {
+		t.Error("Expected error for unsupported scheme")
+	}
+}
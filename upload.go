@@ -0,0 +1,382 @@
+package jsonrps
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"iter"
+	"strconv"
+)
+
+// Methods of the notifications of uploads
+const (
+	// UploadChunkMethod is the Method of the notifications carrying the
+	// chunks of an upload, with an UploadChunk as Params
+	UploadChunkMethod = "$/uploadChunk"
+
+	// UploadEndMethod is the Method of the notification ending an upload.
+	// Its params hold the ID of the request (e.g. {"id": 1}).
+	UploadEndMethod = "$/uploadEnd"
+
+	// UploadCreditMethod is the Method of the notifications granting the
+	// caller credit for more chunks of an upload. Its params hold the ID of
+	// the request and the number of chunks (e.g. {"id": 1, "credits": 8}).
+	UploadCreditMethod = "$/uploadCredit"
+)
+
+// DefaultUploadBufferSize is the number of chunks of an upload buffered
+// by a Peer. It is the credit of the caller when the upload starts.
+const DefaultUploadBufferSize = 16
+
+// ErrUploadFinished is returned when sending to an upload whose request
+// has already been responded
+var ErrUploadFinished = errors.New("jsonrps: upload finished")
+
+// ErrUploadOverflow is the cause of the context of a request whose caller
+// sent more chunks of the upload than granted credit for
+var ErrUploadOverflow = errors.New("jsonrps: upload buffer overflow")
+
+// UploadChunk is the params of a notification carrying a chunk of an upload
+type UploadChunk struct {
+	// ID is the ID of the originating request
+	ID any `json:"id"`
+
+	// Seq is the position of the chunk in the upload, from 0
+	Seq int `json:"seq"`
+
+	// Data is the JSON encoded chunk. Chunks of bytes are base64 encoded
+	// strings.
+	Data json.RawMessage `json:"data"`
+}
+
+// uploadContextKey is the context key of the Upload of a request
+type uploadContextKey struct{}
+
+// Upload is the sequence of chunks sent by the caller of a request with
+// Upload set, after the request and before an UploadEndMethod notification.
+// It is consumed by an UploadHandler either as JSON chunks or as an
+// io.Reader of the bytes of the chunks.
+//
+// The caller may send DefaultUploadBufferSize chunks, and is granted
+// credit for more with UploadCreditMethod notifications as the chunks are
+// consumed. The request of a caller sending more chunks than granted is
+// cancelled with ErrUploadOverflow as cause.
+type Upload struct {
+	// ctx is the context of the handler
+	ctx    context.Context
+	chunks chan json.RawMessage
+
+	peer     *Peer
+	id       json.RawMessage
+	consumed int // chunks consumed since credit was last granted
+
+	// ended is only used by the read loop of the peer
+	ended bool
+
+	buf []byte
+}
+
+// newUpload creates the upload of the request of the ID served by the peer
+func newUpload(p *Peer, id json.RawMessage) *Upload {
+	return &Upload{
+		chunks: make(chan json.RawMessage, DefaultUploadBufferSize),
+		peer:   p,
+		id:     id,
+	}
+}
+
+// next returns the next chunk, or io.EOF once the upload ended. Credit is
+// granted again to the caller by halves of the buffer.
+func (u *Upload) next() (json.RawMessage, error) {
+	select {
+	case chunk, ok := <-u.chunks:
+		if !ok {
+			return nil, io.EOF
+		}
+		if u.consumed++; u.consumed >= DefaultUploadBufferSize/2 {
+			if err := u.peer.Notify(UploadCreditMethod, creditParams{ID: u.id, Credits: u.consumed}); err != nil {
+				u.peer.Session.logger().Debug("Granting upload credit failed", "error", err)
+			}
+			u.consumed = 0
+		}
+		return chunk, nil
+	case <-u.ctx.Done():
+		return nil, context.Cause(u.ctx)
+	}
+}
+
+// Chunks iterates over the JSON encoded chunks until the upload ends. The
+// iteration ends with a non-nil error if the request context is done
+// before the end of the upload.
+func (u *Upload) Chunks() iter.Seq2[json.RawMessage, error] {
+	return func(yield func(json.RawMessage, error) bool) {
+		for {
+			chunk, err := u.next()
+			if err == io.EOF {
+				return
+			}
+			if !yield(chunk, err) || err != nil {
+				return
+			}
+		}
+	}
+}
+
+// Read reads the bytes of the chunks, which must be base64 encoded strings
+// (e.g. sent with UploadStream.Write). It returns io.EOF once the upload ends.
+func (u *Upload) Read(p []byte) (int, error) {
+	for len(u.buf) == 0 {
+		chunk, err := u.next()
+		if err != nil {
+			return 0, err
+		}
+		if err := json.Unmarshal(chunk, &u.buf); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, u.buf)
+	u.buf = u.buf[n:]
+	return n, nil
+}
+
+// UploadHandler is a MethodHandler for methods receiving an upload from
+// the caller. The handler consumes the upload before returning the final
+// response. Uploads are only received by Peer sessions. Requests without
+// Upload set are responded with ErrCodeInvalidRequest.
+type UploadHandler func(ctx context.Context, sess *Session, req *JSONRPCRequest, upload *Upload) *JSONRPCResponse
+
+// ServeMethod passes the upload of the request to the handler
+func (h UploadHandler) ServeMethod(ctx context.Context, sess *Session, req *JSONRPCRequest) *JSONRPCResponse {
+	upload, ok := ctx.Value(uploadContextKey{}).(*Upload)
+	if !ok {
+		return NewErrorResponse(req.ID, ErrCodeInvalidRequest, "invalid request", "upload expected")
+	}
+	upload.ctx = ctx
+	return h(ctx, sess, req, upload)
+}
+
+// creditParams is the params of UploadCreditMethod
+type creditParams struct {
+	ID      json.RawMessage `json:"id"`
+	Credits int             `json:"credits"`
+}
+
+// receiveUploadChunk passes the chunk of the UploadChunkMethod notification
+// to the matching upload, if any, without waiting: the request is cancelled
+// if the buffer of the upload is full. It reports if the notification
+// matched an upload.
+func (p *Peer) receiveUploadChunk(line []byte) bool {
+	var notification struct {
+		Params struct {
+			ID   json.RawMessage `json:"id"`
+			Data json.RawMessage `json:"data"`
+		} `json:"params"`
+	}
+	if err := json.Unmarshal(line, &notification); err != nil || len(notification.Params.ID) == 0 {
+		return false
+	}
+	key := idKey(notification.Params.ID)
+	p.mu.Lock()
+	upload, cancel := p.uploads[key], p.inflight[key]
+	p.mu.Unlock()
+	if upload == nil {
+		return false
+	}
+	if !upload.ended {
+		select {
+		case upload.chunks <- notification.Params.Data:
+		default:
+			upload.ended = true
+			cancel(ErrUploadOverflow)
+		}
+	}
+	return true
+}
+
+// endUpload ends the upload matching the UploadEndMethod notification, if
+// any. It reports if the notification matched an upload.
+func (p *Peer) endUpload(line []byte) bool {
+	var notification struct {
+		Params cancelParams `json:"params"`
+	}
+	if err := json.Unmarshal(line, &notification); err != nil || len(notification.Params.ID) == 0 {
+		return false
+	}
+	p.mu.Lock()
+	upload := p.uploads[idKey(notification.Params.ID)]
+	p.mu.Unlock()
+	if upload == nil {
+		return false
+	}
+	if !upload.ended {
+		upload.ended = true
+		close(upload.chunks)
+	}
+	return true
+}
+
+// grantUploadCredit grants the credit of the UploadCreditMethod
+// notification to the matching upload of a call, if any. It reports if the
+// notification matched an upload.
+func (p *Peer) grantUploadCredit(line []byte) bool {
+	var notification struct {
+		Params creditParams `json:"params"`
+	}
+	if err := json.Unmarshal(line, &notification); err != nil || len(notification.Params.ID) == 0 {
+		return false
+	}
+	p.mu.Lock()
+	credit := p.sending[idKey(notification.Params.ID)]
+	p.mu.Unlock()
+	if credit == nil {
+		return false
+	}
+	credit.grant(notification.Params.Credits)
+	return true
+}
+
+// UploadStream is the upload of a call, opened with Peer.OpenUpload
+type UploadStream struct {
+	peer   *Peer
+	ctx    context.Context
+	id     int64
+	key    string
+	seq    int
+	credit *credit
+	ch     chan *JSONRPCResponse
+	resp   *JSONRPCResponse
+}
+
+// OpenUpload calls the method of the other side (e.g. served by an
+// UploadHandler) with the JSON encoded params, which may be nil, and
+// returns the stream to send the chunks of the upload. The upload must
+// be completed with Finish. The context limits the whole upload.
+func (p *Peer) OpenUpload(ctx context.Context, method string, params any) (*UploadStream, error) {
+	raw, err := marshalParams(params)
+	if err != nil {
+		return nil, err
+	}
+
+	id := p.nextID.Add(1)
+	s := &UploadStream{
+		peer:   p,
+		ctx:    ctx,
+		id:     id,
+		key:    strconv.FormatInt(id, 10),
+		credit: newCredit(DefaultUploadBufferSize),
+		ch:     make(chan *JSONRPCResponse, 1),
+	}
+	p.mu.Lock()
+	if p.err != nil {
+		p.mu.Unlock()
+		return nil, p.err
+	}
+	p.pending[s.key] = s.ch
+	p.sending[s.key] = s.credit
+	p.mu.Unlock()
+
+	req := newCallRequest(ctx, method, raw, id)
+	req.Upload = true
+	if err := p.Session.WriteRequest(req); err != nil {
+		s.release()
+		return nil, err
+	}
+	return s, nil
+}
+
+// release unregisters the call of the upload
+func (s *UploadStream) release() {
+	s.peer.mu.Lock()
+	delete(s.peer.pending, s.key)
+	delete(s.peer.sending, s.key)
+	s.peer.mu.Unlock()
+}
+
+// responded returns the response to the upload, if already received
+func (s *UploadStream) responded() *JSONRPCResponse {
+	if s.resp == nil {
+		select {
+		case s.resp = <-s.ch:
+		default:
+		}
+	}
+	return s.resp
+}
+
+// Send sends the JSON encoded chunk, once the other side granted credit for
+// it. It returns ErrUploadFinished if the other side has already responded
+// to the request.
+func (s *UploadStream) Send(chunk any) error {
+	if s.responded() != nil {
+		return ErrUploadFinished
+	}
+	if err := s.ctx.Err(); err != nil {
+		return err
+	}
+	for !s.credit.tryTake() {
+		select {
+		case <-s.credit.granted:
+		case s.resp = <-s.ch:
+			return ErrUploadFinished
+		case <-s.ctx.Done():
+			return s.ctx.Err()
+		case <-s.peer.done:
+			return s.peer.err
+		}
+	}
+	data, err := json.Marshal(chunk)
+	if err != nil {
+		return err
+	}
+	params, _ := json.Marshal(UploadChunk{ID: s.id, Seq: s.seq, Data: data})
+	s.seq++
+	return s.peer.Session.WriteRequest(&JSONRPCRequest{
+		Version: JSONRPCVersion,
+		Method:  UploadChunkMethod,
+		Params:  params,
+	})
+}
+
+// Write sends the bytes as a chunk, so that an UploadStream can be the
+// destination of io.Copy
+func (s *UploadStream) Write(p []byte) (int, error) {
+	if err := s.Send(p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Finish ends the upload and waits for the response, decoding its result
+// into result, unless nil. It returns the *JSONRPCError responded by the
+// other side, if any. If the context is done before the response, the
+// request is cancelled with a CancelRequestMethod notification.
+func (s *UploadStream) Finish(result any) error {
+	defer s.release()
+	p := s.peer
+
+	resp := s.responded()
+	if resp == nil {
+		if err := p.Notify(UploadEndMethod, cancelParams{ID: json.RawMessage(s.key)}); err != nil {
+			return err
+		}
+		select {
+		case resp = <-s.ch:
+		case <-s.ctx.Done():
+			if err := p.Notify(CancelRequestMethod, cancelParams{ID: json.RawMessage(s.key)}); err != nil {
+				p.Session.logger().Debug("Cancelling upload failed", "id", s.key, "error", err)
+			}
+			return s.ctx.Err()
+		case <-p.done:
+			return p.err
+		}
+	}
+
+	if resp.Error != nil {
+		return resp.Error
+	}
+	if result != nil && len(resp.Result) > 0 {
+		return json.Unmarshal(resp.Result, result)
+	}
+	return nil
+}
@@ -0,0 +1,210 @@
+package jsonrps_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yookoala/jsonrps"
+)
+
+// newUploadTestServer creates the methods of the upload tests
+func newUploadTestServer() *jsonrps.MethodMux {
+	mux := jsonrps.NewMethodMux()
+	mux.Handle("checksum", jsonrps.UploadHandler(func(ctx context.Context, sess *jsonrps.Session, req *jsonrps.JSONRPCRequest, upload *jsonrps.Upload) *jsonrps.JSONRPCResponse {
+		hash := sha256.New()
+		if _, err := io.Copy(hash, upload); err != nil {
+			return jsonrps.NewErrorResponse(req.ID, jsonrps.ErrCodeInternalError, err.Error(), nil)
+		}
+		resp, _ := jsonrps.NewResultResponse(req.ID, hex.EncodeToString(hash.Sum(nil)))
+		return resp
+	}))
+	mux.Handle("sum", jsonrps.UploadHandler(func(ctx context.Context, sess *jsonrps.Session, req *jsonrps.JSONRPCRequest, upload *jsonrps.Upload) *jsonrps.JSONRPCResponse {
+		sum := 0
+		for chunk, err := range upload.Chunks() {
+			if err != nil {
+				return jsonrps.NewErrorResponse(req.ID, jsonrps.ErrCodeInternalError, err.Error(), nil)
+			}
+			var n int
+			if err := json.Unmarshal(chunk, &n); err != nil {
+				return jsonrps.NewErrorResponse(req.ID, jsonrps.ErrCodeInvalidParams, "invalid chunk", nil)
+			}
+			sum += n
+		}
+		resp, _ := jsonrps.NewResultResponse(req.ID, sum)
+		return resp
+	}))
+	mux.Handle("reject", jsonrps.UploadHandler(func(ctx context.Context, sess *jsonrps.Session, req *jsonrps.JSONRPCRequest, upload *jsonrps.Upload) *jsonrps.JSONRPCResponse {
+		return jsonrps.NewErrorResponse(req.ID, jsonrps.ErrCodeInvalidParams, "rejected", nil)
+	}))
+	mux.Handle("stall", jsonrps.UploadHandler(func(ctx context.Context, sess *jsonrps.Session, req *jsonrps.JSONRPCRequest, upload *jsonrps.Upload) *jsonrps.JSONRPCResponse {
+		<-ctx.Done()
+		return nil
+	}))
+	mux.Handle("echo", echoHandler)
+	return mux
+}
+
+func TestPeer_OpenUpload(t *testing.T) {
+	peer := startTestPeers(t, &jsonrps.PeerHandler{Handler: newUploadTestServer()}, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	// bytes through io.Reader, larger than the upload buffer
+	data := strings.Repeat("0123456789abcdef", 4096)
+	upload, err := peer.OpenUpload(ctx, "checksum", nil)
+	if err != nil {
+		t.Fatalf("Unexpected error opening upload: %v", err)
+	}
+	src := strings.NewReader(data)
+	if _, err := io.CopyBuffer(upload, src, make([]byte, 1024)); err != nil {
+		t.Fatalf("Unexpected error uploading: %v", err)
+	}
+	var checksum string
+	if err := upload.Finish(&checksum); err != nil {
+		t.Fatalf("Unexpected error finishing upload: %v", err)
+	}
+	expected := sha256.Sum256([]byte(data))
+	if checksum != hex.EncodeToString(expected[:]) {
+		t.Errorf("Unexpected checksum %s", checksum)
+	}
+
+	// JSON chunks through the iterator
+	upload, err = peer.OpenUpload(ctx, "sum", nil)
+	if err != nil {
+		t.Fatalf("Unexpected error opening upload: %v", err)
+	}
+	for i := 1; i <= 100; i++ {
+		if err := upload.Send(i); err != nil {
+			t.Fatalf("Unexpected error sending chunk %d: %v", i, err)
+		}
+	}
+	var sum int
+	if err := upload.Finish(&sum); err != nil {
+		t.Fatalf("Unexpected error finishing upload: %v", err)
+	}
+	if sum != 5050 {
+		t.Errorf("Expected sum 5050, got %d", sum)
+	}
+}
+
+func TestPeer_OpenUpload_Rejected(t *testing.T) {
+	peer := startTestPeers(t, &jsonrps.PeerHandler{Handler: newUploadTestServer()}, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	upload, err := peer.OpenUpload(ctx, "reject", nil)
+	if err != nil {
+		t.Fatalf("Unexpected error opening upload: %v", err)
+	}
+
+	// chunks fail once the handler responded
+	var sendErr error
+	for range 100 {
+		if sendErr = upload.Send("chunk"); sendErr != nil {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if !errors.Is(sendErr, jsonrps.ErrUploadFinished) {
+		t.Errorf("Expected ErrUploadFinished, got %v", sendErr)
+	}
+	var rpcErr *jsonrps.JSONRPCError
+	if err := upload.Finish(nil); !errors.As(err, &rpcErr) || rpcErr.Code != jsonrps.ErrCodeInvalidParams {
+		t.Errorf("Expected invalid params error, got %v", err)
+	}
+
+	// the peer keeps serving other calls
+	var result string
+	if err := peer.Call(ctx, "echo", "still here", &result); err != nil || result != "still here" {
+		t.Errorf("Unexpected call result %q, error %v", result, err)
+	}
+}
+
+func TestPeer_OpenUpload_Stalled(t *testing.T) {
+	peer := startTestPeers(t, &jsonrps.PeerHandler{Handler: newUploadTestServer()}, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	uploadCtx, cancelUpload := context.WithCancel(ctx)
+	upload, err := peer.OpenUpload(uploadCtx, "stall", nil)
+	if err != nil {
+		t.Fatalf("Unexpected error opening upload: %v", err)
+	}
+	for i := range jsonrps.DefaultUploadBufferSize {
+		if err := upload.Send(i); err != nil {
+			t.Fatalf("Unexpected error sending chunk %d: %v", i, err)
+		}
+	}
+
+	// the chunk beyond the credit waits for the handler
+	sendErrs := make(chan error, 1)
+	go func() {
+		sendErrs <- upload.Send("one too many")
+	}()
+
+	// the stalled upload does not hold up the other calls
+	var result string
+	if err := peer.Call(ctx, "echo", "still here", &result); err != nil || result != "still here" {
+		t.Errorf("Unexpected call result %q, error %v", result, err)
+	}
+	select {
+	case err := <-sendErrs:
+		t.Fatalf("Expected the chunk to wait for credit, got %v", err)
+	default:
+	}
+	cancelUpload()
+	if err := <-sendErrs; !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context canceled, got %v", err)
+	}
+}
+
+func TestPeer_UploadOverflow(t *testing.T) {
+	client, serverSess := jsonrps.NewSessionPair(&jsonrps.SessionPairConfig{Logger: newTestLogger(t)})
+	defer client.Close()
+	go (&jsonrps.PeerHandler{Handler: newUploadTestServer()}).HandleSession(serverSess)
+	client.ReadResponseHeader()
+
+	// the chunks sent beyond the credit cancel the upload
+	client.WriteRequest(&jsonrps.JSONRPCRequest{Version: jsonrps.JSONRPCVersion, Method: "stall", ID: "up-1", Upload: true})
+	for i := 0; i <= jsonrps.DefaultUploadBufferSize; i++ {
+		params, _ := json.Marshal(jsonrps.UploadChunk{ID: "up-1", Seq: i, Data: json.RawMessage(`"chunk"`)})
+		client.WriteRequest(&jsonrps.JSONRPCRequest{Version: jsonrps.JSONRPCVersion, Method: jsonrps.UploadChunkMethod, Params: params})
+	}
+	client.WriteRequest(&jsonrps.JSONRPCRequest{Version: jsonrps.JSONRPCVersion, Method: "echo", Params: json.RawMessage(`"still here"`), ID: "req-2"})
+	for range 2 {
+		resp, err := client.ReadResponse()
+		if err != nil {
+			t.Fatalf("Unexpected read error: %v", err)
+		}
+		switch resp.ID {
+		case "up-1":
+			if resp.Error == nil || resp.Error.Code != jsonrps.ErrCodeInvalidRequest {
+				t.Errorf("Expected invalid request error, got %#v", resp)
+			}
+		case "req-2":
+			if string(resp.Result) != `"still here"` {
+				t.Errorf("Unexpected echo result %s", resp.Result)
+			}
+		default:
+			t.Errorf("Unexpected response %#v", resp)
+		}
+	}
+}
+
+func TestUploadHandler_NoUpload(t *testing.T) {
+	peer := startTestPeers(t, &jsonrps.PeerHandler{Handler: newUploadTestServer()}, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	var rpcErr *jsonrps.JSONRPCError
+	if err := peer.Call(ctx, "sum", nil, nil); !errors.As(err, &rpcErr) || rpcErr.Code != jsonrps.ErrCodeInvalidRequest {
+		t.Errorf("Expected invalid request error, got %v", err)
+	}
+}
@@ -0,0 +1,358 @@
+package jsonrps
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+// DefaultWebSocketMessageSize is the default limit of the size of a
+// message received from a WebSocket
+const DefaultWebSocketMessageSize = 1 << 20
+
+// websocketGUID is used to compute the Sec-WebSocket-Accept header
+// as specified by RFC 6455
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// WebSocket frame opcodes defined by RFC 6455
+const (
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xA
+)
+
+// WebSocketHandler is an http.Handler which upgrades HTTP requests to
+// WebSocket and serves each of them as a Session.
+//
+// The HTTP request headers become Session.RemoteHeaders and the request
+// path becomes Session.Method. Session.LocalHeaders are sent with the
+// handshake response when the session handler writes its response header,
+// and a status other than 200 OK rejects the upgrade with that HTTP status.
+// Every text message of the WebSocket is presented as one JSON-RPC line.
+type WebSocketHandler struct {
+	// Handler handles every upgraded session. If it implements
+	// ServerSessionHandler, sessions it cannot handle are responded
+	// with 404 Not Found.
+	Handler SessionHandler
+
+	// CheckOrigin validates the Origin header of the request. All origins
+	// are accepted if nil.
+	CheckOrigin func(r *http.Request) bool
+
+	// MaxMessageSize limits the size of received messages.
+	// DefaultWebSocketMessageSize is used if zero.
+	MaxMessageSize int64
+
+	// Logger is used for all sessions. The default logger is used if nil.
+	Logger *slog.Logger
+}
+
+// ServeHTTP validates the WebSocket upgrade request and serves the session
+func (h *WebSocketHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet ||
+		!headerContainsToken(r.Header, "Connection", "upgrade") ||
+		!headerContainsToken(r.Header, "Upgrade", "websocket") ||
+		r.Header.Get("Sec-WebSocket-Version") != "13" ||
+		r.Header.Get("Sec-WebSocket-Key") == "" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "websocket upgrade required", http.StatusUpgradeRequired)
+		return
+	}
+	if h.CheckOrigin != nil && !h.CheckOrigin(r) {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	conn := &websocketConn{maxMessageSize: h.MaxMessageSize}
+	sess := newUpgradedSession(r, conn, &conn.upgradeConn, h.Logger)
+	sess.handshake = func(statusCode int) {
+		conn.handshake(w, sess.LocalHeaders, statusCode, http.Header{
+			"Upgrade":              {"websocket"},
+			"Connection":           {"Upgrade"},
+			"Sec-Websocket-Accept": {websocketAccept(r.Header.Get("Sec-WebSocket-Key"))},
+		})
+	}
+	serveUpgradedSession(h.Handler, sess)
+}
+
+// websocketAccept computes the Sec-WebSocket-Accept of the key
+func websocketAccept(key string) string {
+	sum := sha1.Sum([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// WebSocketDialer contains options for connecting to an RPS server
+// through WebSocket
+type WebSocketDialer struct {
+	// NetDialer is used to establish the network connection
+	NetDialer net.Dialer
+
+	// TLSConfig is used for "wss" URLs
+	TLSConfig *tls.Config
+
+	// Headers are sent as the headers of the handshake request
+	Headers http.Header
+
+	// MaxMessageSize limits the size of received messages.
+	// DefaultWebSocketMessageSize is used if zero.
+	MaxMessageSize int64
+
+	// Logger is used for the dialed sessions. The default logger is
+	// used if nil.
+	Logger *slog.Logger
+}
+
+// DialContext connects to the "ws" or "wss" URL and returns the established
+// client session. The handshake response headers become the RemoteHeaders
+// of the session.
+func (d *WebSocketDialer) DialContext(ctx context.Context, rawURL string) (*Session, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "ws" && u.Scheme != "wss" {
+		return nil, fmt.Errorf("jsonrps: unsupported websocket scheme %q", u.Scheme)
+	}
+
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	key := base64.StdEncoding.EncodeToString(nonce)
+
+	header := d.Headers.Clone()
+	if header == nil {
+		header = make(http.Header)
+	}
+	header.Set("Upgrade", "websocket")
+	header.Set("Connection", "Upgrade")
+	header.Set("Sec-WebSocket-Key", key)
+	header.Set("Sec-WebSocket-Version", "13")
+
+	conn, reader, resp, err := dialUpgrade(ctx, &d.NetDialer, d.TLSConfig, u, u.Scheme == "wss", header)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Header.Get("Sec-WebSocket-Accept") != websocketAccept(key) {
+		conn.Close()
+		return nil, errors.New("jsonrps: invalid Sec-WebSocket-Accept")
+	}
+
+	sess := newDialedSession(conn, u, header, resp, d.Logger)
+	sess.Conn = &websocketConn{
+		upgradeConn: upgradeConn{
+			conn:     conn,
+			reader:   reader,
+			upgraded: true,
+		},
+		client:         true,
+		maxMessageSize: d.MaxMessageSize,
+	}
+	return sess, nil
+}
+
+// websocketConn presents a WebSocket as a line based io.ReadWriteCloser.
+// Each received text message is read as one line, and each written line
+// is sent as one text message.
+type websocketConn struct {
+	upgradeConn
+
+	// client is true for the client side, which masks the sent frames
+	client bool
+
+	maxMessageSize int64
+
+	pending []byte // received data not yet read
+	partial []byte // written data not yet ending with a line
+}
+
+// Read reads the received messages, each ending with "\n"
+func (c *websocketConn) Read(p []byte) (int, error) {
+	if err := c.ready(); err != nil {
+		return 0, err
+	}
+	for len(c.pending) == 0 {
+		message, err := c.readMessage()
+		if err != nil {
+			return 0, err
+		}
+		c.pending = append(message, '\n')
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// readMessage reads the next data message, answering control frames
+func (c *websocketConn) readMessage() ([]byte, error) {
+	limit := c.maxMessageSize
+	if limit <= 0 {
+		limit = DefaultWebSocketMessageSize
+	}
+
+	var message []byte
+	for {
+		fin, opcode, payload, err := c.readFrame(limit)
+		if err != nil {
+			return nil, err
+		}
+		switch opcode {
+		case wsOpPing:
+			if err = c.writeFrame(wsOpPong, payload); err != nil {
+				return nil, err
+			}
+			continue
+		case wsOpPong:
+			continue
+		case wsOpClose:
+			c.writeFrame(wsOpClose, payload)
+			return nil, io.EOF
+		}
+
+		message = append(message, payload...)
+		if int64(len(message)) > limit {
+			c.writeFrame(wsOpClose, []byte{0x03, 0xF1}) // 1009 message too big
+			return nil, errors.New("jsonrps: websocket message too big")
+		}
+		if fin {
+			return message, nil
+		}
+	}
+}
+
+// readFrame reads a single frame from the connection
+func (c *websocketConn) readFrame(limit int64) (fin bool, opcode byte, payload []byte, err error) {
+	var head [2]byte
+	if _, err = io.ReadFull(c.reader, head[:]); err != nil {
+		return
+	}
+	fin = head[0]&0x80 != 0
+	opcode = head[0] & 0x0F
+	masked := head[1]&0x80 != 0
+	if masked == c.client {
+		err = errors.New("jsonrps: invalid websocket frame masking")
+		return
+	}
+
+	length := int64(head[1] & 0x7F)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(c.reader, ext[:]); err != nil {
+			return
+		}
+		length = int64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(c.reader, ext[:]); err != nil {
+			return
+		}
+		length = int64(binary.BigEndian.Uint64(ext[:]) & (1<<63 - 1))
+	}
+	if length > limit {
+		err = errors.New("jsonrps: websocket frame too big")
+		return
+	}
+
+	var mask [4]byte
+	if masked {
+		if _, err = io.ReadFull(c.reader, mask[:]); err != nil {
+			return
+		}
+	}
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(c.reader, payload); err != nil {
+		return
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return
+}
+
+// Write sends every complete line written as one text message. Empty
+// lines are skipped.
+func (c *websocketConn) Write(p []byte) (int, error) {
+	if err := c.ready(); err != nil {
+		return 0, err
+	}
+	c.partial = append(c.partial, p...)
+	for {
+		i := bytes.IndexByte(c.partial, '\n')
+		if i < 0 {
+			break
+		}
+		line := bytes.TrimRight(c.partial[:i], "\r")
+		c.partial = c.partial[i+1:]
+		if len(line) == 0 {
+			continue
+		}
+		if err := c.writeFrame(wsOpText, line); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// writeFrame sends a single final frame with the payload
+func (c *websocketConn) writeFrame(opcode byte, payload []byte) error {
+	frame := []byte{0x80 | opcode, 0}
+	switch length := len(payload); {
+	case length < 126:
+		frame[1] = byte(length)
+	case length <= 0xFFFF:
+		frame[1] = 126
+		frame = binary.BigEndian.AppendUint16(frame, uint16(length))
+	default:
+		frame[1] = 127
+		frame = binary.BigEndian.AppendUint64(frame, uint64(length))
+	}
+
+	if c.client {
+		var mask [4]byte
+		rand.Read(mask[:])
+		frame[1] |= 0x80
+		frame = append(frame, mask[:]...)
+		start := len(frame)
+		frame = append(frame, payload...)
+		for i := range payload {
+			frame[start+i] ^= mask[i%4]
+		}
+	} else {
+		frame = append(frame, payload...)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil {
+		return errUpgradeRejected
+	}
+	_, err := c.conn.Write(frame)
+	return err
+}
+
+// Close sends a normal closure frame and closes the connection
+func (c *websocketConn) Close() error {
+	c.mu.Lock()
+	conn := c.conn
+	c.mu.Unlock()
+	if conn == nil {
+		return nil
+	}
+	c.writeFrame(wsOpClose, []byte{0x03, 0xE8}) // 1000 normal closure
+	return conn.Close()
+}
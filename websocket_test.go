@@ -0,0 +1,145 @@
+package jsonrps_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yookoala/jsonrps"
+)
+
+// dialTestWebSocket dials the path of the test server with the headers
+func dialTestWebSocket(t *testing.T, srv *httptest.Server, path string, headers http.Header) (*jsonrps.Session, error) {
+	t.Helper()
+	d := &jsonrps.WebSocketDialer{Headers: headers, Logger: newTestLogger(t)}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	return d.DialContext(ctx, "ws"+strings.TrimPrefix(srv.URL, "http")+path)
+}
+
+func TestWebSocket_RoundTrip(t *testing.T) {
+	mux := jsonrps.NewMethodMux()
+	mux.Handle("echo", echoHandler)
+
+	remoteHeaders := make(chan http.Header, 1)
+	handler := jsonrps.ChainSession(&jsonrps.Dispatcher{Handler: mux}, func(next jsonrps.SessionHandler) jsonrps.SessionHandler {
+		return jsonrps.SessionHandlerFunc(func(sess *jsonrps.Session) {
+			remoteHeaders <- sess.RemoteHeaders
+			sess.LocalHeaders.Set("X-Server", "rps")
+			next.HandleSession(sess)
+		})
+	})
+
+	srv := httptest.NewServer(&jsonrps.WebSocketHandler{Handler: handler, Logger: newTestLogger(t)})
+	defer srv.Close()
+
+	sess, err := dialTestWebSocket(t, srv, "/rpc", http.Header{"Authorization": {"Bearer abc"}})
+	if err != nil {
+		t.Fatalf("Unexpected dial error: %v", err)
+	}
+	defer sess.Close()
+
+	if sess.RemoteHeaders.Get("X-Server") != "rps" {
+		t.Errorf("Expected X-Server handshake header, got %v", sess.RemoteHeaders)
+	}
+	if got := (<-remoteHeaders).Get("Authorization"); got != "Bearer abc" {
+		t.Errorf("Expected Authorization remote header, got %q", got)
+	}
+
+	// includes a message larger than 64KiB to exercise extended lengths
+	for i, param := range []string{`"hello"`, `"` + strings.Repeat("x", 70000) + `"`} {
+		err = sess.WriteRequest(&jsonrps.JSONRPCRequest{
+			Version: "2.0",
+			Method:  "echo",
+			Params:  json.RawMessage(param),
+			ID:      i,
+		})
+		if err != nil {
+			t.Fatalf("Unexpected write error: %v", err)
+		}
+		resp, err := sess.ReadResponse()
+		if err != nil {
+			t.Fatalf("Unexpected read error: %v", err)
+		}
+		if string(resp.Result) != param {
+			t.Errorf("Expected echoed result of %d bytes, got %d bytes", len(param), len(resp.Result))
+		}
+	}
+}
+
+func TestWebSocket_RouteByPath(t *testing.T) {
+	router := jsonrps.NewSessionRouter(nil)
+	router.HandleMethod("/rpc", &jsonrps.Dispatcher{Handler: echoHandler})
+
+	srv := httptest.NewServer(&jsonrps.WebSocketHandler{Handler: router, Logger: newTestLogger(t)})
+	defer srv.Close()
+
+	sess, err := dialTestWebSocket(t, srv, "/rpc", nil)
+	if err != nil {
+		t.Fatalf("Unexpected dial error: %v", err)
+	}
+	sess.Close()
+
+	_, err = dialTestWebSocket(t, srv, "/other", nil)
+	if err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("Expected 404 error, got %v", err)
+	}
+}
+
+func TestWebSocket_RejectedByHandler(t *testing.T) {
+	handler := jsonrps.SessionHandlerFunc(func(sess *jsonrps.Session) {
+		sess.LocalHeaders.Set("WWW-Authenticate", "Bearer")
+		sess.WriteResponseHeader(http.StatusUnauthorized)
+	})
+	srv := httptest.NewServer(&jsonrps.WebSocketHandler{Handler: handler, Logger: newTestLogger(t)})
+	defer srv.Close()
+
+	_, err := dialTestWebSocket(t, srv, "/", nil)
+	if err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("Expected 401 error, got %v", err)
+	}
+}
+
+func TestWebSocket_NotUpgradeRequest(t *testing.T) {
+	srv := httptest.NewServer(&jsonrps.WebSocketHandler{Handler: &mockSessionHandler{}})
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUpgradeRequired {
+		t.Errorf("Expected status 426, got %d", resp.StatusCode)
+	}
+}
+
+func TestWebSocket_CheckOrigin(t *testing.T) {
+	srv := httptest.NewServer(&jsonrps.WebSocketHandler{
+		Handler: &jsonrps.Dispatcher{Handler: echoHandler},
+		CheckOrigin: func(r *http.Request) bool {
+			return r.Header.Get("Origin") == "https://app.example.org"
+		},
+	})
+	defer srv.Close()
+
+	if _, err := dialTestWebSocket(t, srv, "/", http.Header{"Origin": {"https://evil.example.org"}}); err == nil {
+		t.Error("Expected dial from other origin to fail")
+	}
+	sess, err := dialTestWebSocket(t, srv, "/", http.Header{"Origin": {"https://app.example.org"}})
+	if err != nil {
+		t.Fatalf("Unexpected dial error: %v", err)
+	}
+	sess.Close()
+}
+
+func TestWebSocketDialer_UnsupportedScheme(t *testing.T) {
+	var d jsonrps.WebSocketDialer
+	if _, err := d.DialContext(context.Background(), "http://localhost/"); err == nil {
+		t.Error("Expected error for unsupported scheme")
+	}
+}